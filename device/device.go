@@ -11,7 +11,8 @@ type Argument struct {
 }
 
 type Response struct {
-	Value        string
-	ErrorCode    int // Value different from 0 will be considered errors (in that case Value is ignored)
+	Value        string     // Value of the first out-argument, used when OutArguments does not contain it
+	OutArguments []Argument // Out-arguments by name, sent in the order of the action definition
+	ErrorCode    int        // Value different from 0 will be considered errors (in that case Value and OutArguments are ignored)
 	ErrorMessage string
 }
@@ -8,7 +8,9 @@ import (
 	"time"
 
 	"github.com/alexflint/go-arg"
+	"github.com/huin/goupnp"
 
+	device "github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
 	mqtt "github.com/DaniDF/MQTT-Discovery-vs-UPnP/mqtt-control-point"
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/upnp-control-point"
@@ -29,7 +31,13 @@ type Args struct {
 	NumUpnpControl int `arg:"-u,--upnp-ctrl" default:"0" help:"Number of UPnP control points to deploy"`
 	NumMqttControl int `arg:"-m,--mqtt-ctrl" default:"0" help:"Number of MQTT control points to deploy"`
 
-	Mx int `arg:"--mx" default:"0" help:"Set a manual value for MX"`
+	Mx        int  `arg:"--mx" default:"0" help:"Set a manual value for MX"`
+	SsdpCache bool `arg:"--ssdp-cache" default:"false" help:"Answer the searches from the cache of the received NOTIFY"`
+
+	Interfaces  []string `arg:"-i,--interface,separate" help:"Network interface used by SSDP, can be repeated (default: the interface of the local IP)"`
+	SsdpNetwork string   `arg:"--ssdp-network" default:"ipv4" help:"IP version used by SSDP: ipv4, ipv6 or dual"`
+
+	MulticastGena bool `arg:"--multicast-gena" default:"false" help:"Receive the events with GENA multicast eventing instead of subscribing"`
 
 	MqttBroker string `arg:"--mqtt-broker" default:" "  help:"MQTT broker"`
 	MqttQos    int    `arg:"--qos" default:"0" help:"Sets the MQTT Qos"`
@@ -111,11 +119,40 @@ func main() {
 	}
 
 	if args.NumUpnpControl > 0 {
+		if args.SsdpCache {
+			registry, err := upnp.NewDeviceRegistryWithConfig(ctx, upnp.SsdpConfig{Interfaces: args.Interfaces, Network: upnp.SsdpNetwork(args.SsdpNetwork)})
+			if err != nil {
+				log.Error("[main-control] Error while creating the device registry: " + err.Error())
+				return
+			}
+			ctx = context.WithValue(ctx, "registry", registry)
+		}
+
 		testSoap(ctx, args, mx, logLevel)
 		testGena(ctx, args, mx, logLevel)
 	}
 }
 
+// Searches the test devices, from the registry cache if available
+func searchDevices(ctx context.Context, args Args, mx int) (map[string]goupnp.RootDevice, error) {
+	registry, isCached := ctx.Value("registry").(*upnp.DeviceRegistry)
+	if isCached {
+		return upnp.SearchRegistry(ctx, registry, "urn:schemas-upnp-org:device:BinaryLight:1", mx)
+	}
+
+	return upnp.SearchMxWithConfig(ctx, "urn:schemas-upnp-org:device:BinaryLight:1", mx, upnp.SsdpConfig{Interfaces: args.Interfaces, Network: upnp.SsdpNetwork(args.SsdpNetwork)})
+}
+
+// Creates the subscription manager of a control point, following the registry cache if available
+func newSubscriptionManager(ctx context.Context) (*upnp.SubscriptionManager, error) {
+	registry, isCached := ctx.Value("registry").(*upnp.DeviceRegistry)
+	if isCached {
+		return upnp.NewSubscriptionManagerWithRegistry(ctx, registry)
+	}
+
+	return upnp.NewSubscriptionManager(ctx)
+}
+
 func testSoap(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 	log := ctx.Value("logger").(logging.Logger)
 
@@ -124,7 +161,7 @@ func testSoap(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 		go func() {
 			// Start - SSDP
 			startSearchTime := time.Now()
-			rootDevices, err := upnp.SearchMx(ctx, "urn:schemas-upnp-org:device:BinaryLight:1", mx)
+			rootDevices, err := searchDevices(ctx, args, mx)
 			if err != nil {
 				log.Error("[main-control] Error fetching rootDevices: " + err.Error())
 				return
@@ -142,11 +179,10 @@ func testSoap(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 			}
 			// End - SSDP
 
-			type TurnArgs struct {
-				StateValue string `xml:"StateValue"`
-			}
-			type TurnReply struct {
-				ActualValue string `xml:"ActualValue"`
+			manager, err := newSubscriptionManager(ctx)
+			if err != nil {
+				log.Error("[main-control] Error creating the subscription manager: " + err.Error())
+				return
 			}
 
 			waitRootDevice := make(chan bool, len(rootDevices))
@@ -155,52 +191,47 @@ func testSoap(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 				go func() {
 					testService := rootDevice.Device.Services[0]
 
-					var startRPCTime time.Time
-
-					waitGena := make(chan bool, 1)
-
 					// Start - GENA
-					var cancel context.CancelFunc
-					cancelP, err := upnp.Subscribe(ctx, rootDevice, testService, func(event string) {
-						log.Trace("[main-control] Event elapsed time: " + time.Since(startRPCTime).String())
-						log.Debug("[main-control] Received event: " + event)
-
-						cancel()
-						upnp.Unsubscribe(ctx, rootDevice, testService)
-						waitGena <- true
-
-					})
+					subscription, err := manager.Subscribe(rootDevice, testService)
 					if err != nil {
 						log.Error("[main-control] Error subscribing to " + testService.ServiceId + ", " + err.Error())
 						waitRootDevice <- true
 						return
 					}
-					cancel = *cancelP
 					// End - GENA
 
 					// Start - SOAP
-					soap := testService.NewSOAPClient()
-					soapArgs := TurnArgs{
-						StateValue: "1",
-					}
-					reply := TurnReply{}
-
-					startRPCTime = time.Now()
-					err = soap.PerformActionCtx(ctx, testService.ServiceType, "Turn", &soapArgs, &reply)
+					startRPCTime := time.Now()
+					reply, err := upnp.InvokeAction(ctx, testService, "Turn", []device.Argument{{Name: "StateValue", Value: "1"}})
 					if err != nil {
 						log.Error("[main-control] Error RPC: " + err.Error())
 					}
 					elapsedTime = time.Since(startRPCTime)
 
-					log.Info("[main-control] RPC returned: " + reply.ActualValue)
+					log.Info("[main-control] RPC returned: " + actualValue(reply))
 					log.Trace("[main-control] RPC Elapsed time: " + elapsedTime.String())
 					// End - SOAP
 
-					select {
-					case <-waitGena:
-					case <-time.After(genaTimeout):
-						log.Warn("[main-control] Not received gena response before timeout")
+					timeout := time.After(genaTimeout)
+				receiving:
+					for {
+						select {
+						case event, open := <-subscription.Events():
+							if !open {
+								break receiving
+							}
+							if event.Seq == 0 {
+								continue
+							}
+							log.Trace("[main-control] Event elapsed time: " + time.Since(startRPCTime).String())
+							log.Debug("[main-control] Received event: " + event.String())
+							break receiving
+						case <-timeout:
+							log.Warn("[main-control] Not received gena response before timeout")
+							break receiving
+						}
 					}
+					subscription.Unsubscribe()
 
 					waitRootDevice <- true
 				}()
@@ -210,6 +241,10 @@ func testSoap(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 				<-waitRootDevice
 			}
 
+			shutdownCtx, cancel := context.WithTimeout(ctx, genaTimeout)
+			manager.Shutdown(shutdownCtx)
+			cancel()
+
 			waitUpnpControls <- true
 		}()
 	}
@@ -229,7 +264,7 @@ func testGena(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 
 	// Start - SSDP
 	startSearchTime := time.Now()
-	rootDevices, err := upnp.SearchMx(ctx, "urn:schemas-upnp-org:device:BinaryLight:1", mx)
+	rootDevices, err := searchDevices(ctx, args, mx)
 	if err != nil {
 		log.Error("[main-control] Error fetching rootDevices: " + err.Error())
 		return
@@ -255,13 +290,6 @@ func testGena(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 		rootDevice := rootDevices[udns[0]]
 		testService := rootDevice.Device.Services[0]
 
-		type TurnArgs struct {
-			StateValue string `xml:"StateValue"`
-		}
-		type TurnReply struct {
-			ActualValue string `xml:"ActualValue"`
-		}
-
 		var startRPCTime time.Time
 
 		waitGenaSubscriptions := make(chan bool, args.NumUpnpControl)
@@ -272,33 +300,90 @@ func testGena(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 
 				waitGena := make(chan bool, 1)
 
-				// Start - GENA
-				var cancel context.CancelFunc
-				cancelP, err := upnp.Subscribe(ctx, rootDevice, testService, func(event string) {
-					log.Trace("[main-control] Event elapsed time: " + time.Since(startRPCTime).String())
-					log.Debug("[main-control] Received event: " + event)
+				if args.MulticastGena {
+					listenCtx, cancelListen := context.WithCancel(ctx)
+					err := upnp.ListenMulticastEventsWithConfig(listenCtx, rootDevice, testService, func(event upnp.MulticastEvent) {
+						log.Trace("[main-control] Multicast event elapsed time: " + time.Since(startRPCTime).String())
+						log.Debug("[main-control] Received multicast event: " + event.String())
+
+						cancelListen()
+						select {
+						case waitGena <- true:
+						default:
+						}
+					}, upnp.SsdpConfig{Interfaces: args.Interfaces, Network: upnp.SsdpNetwork(args.SsdpNetwork)})
+					if err != nil {
+						log.Error("[main-control] Error listening for multicast events of " + testService.ServiceId + ", " + err.Error())
+						cancelListen()
+						waitUpnpControls <- true
+						waitGenaSubscriptions <- true
+						return
+					}
+
+					waitGenaSubscriptions <- true
 
-					cancel()
-					upnp.Unsubscribe(ctx, rootDevice, testService)
-					waitGena <- true
+					select {
+					case <-waitGena:
+					case <-time.After(genaTimeout):
+						log.Warn("[main-control] Not received multicast event before timeout")
+					}
+
+					waitUpnpControls <- true
+					return
+				}
+
+				// Start - GENA
+				manager, err := newSubscriptionManager(ctx)
+				if err != nil {
+					log.Error("[main-control] Error creating the subscription manager: " + err.Error())
+					waitUpnpControls <- true
+					waitGenaSubscriptions <- true
+					return
+				}
+				shutdown := func() {
+					shutdownCtx, cancel := context.WithTimeout(ctx, genaTimeout)
+					defer cancel()
+					err := manager.Shutdown(shutdownCtx)
+					if err != nil {
+						log.Warn("[main-control] Error unsubscribing from " + testService.ServiceId + ", " + err.Error())
+					}
+				}
 
-				})
+				startSubscribeTime := time.Now()
+				subscription, err := manager.Subscribe(rootDevice, testService)
 				if err != nil {
 					log.Error("[main-control] Error subscribing to " + testService.ServiceId + ", " + err.Error())
+					shutdown()
 					waitUpnpControls <- true
 					waitGenaSubscriptions <- true
 					return
 				}
-				cancel = *cancelP
 				// End - GENA
 
 				waitGenaSubscriptions <- true
 
-				select {
-				case <-waitGena:
-				case <-time.After(genaTimeout):
-					log.Warn("[main-control] Not received gena response before timeout")
+				timeout := time.After(genaTimeout)
+			receiving:
+				for {
+					select {
+					case event, open := <-subscription.Events():
+						if !open {
+							break receiving
+						}
+						if event.Seq == 0 {
+							log.Trace("[main-control] Initial event elapsed time: " + time.Since(startSubscribeTime).String())
+							log.Debug("[main-control] Received initial event: " + event.String())
+							continue
+						}
+						log.Trace("[main-control] Event elapsed time: " + time.Since(startRPCTime).String())
+						log.Debug("[main-control] Received event: " + event.String())
+						break receiving
+					case <-timeout:
+						log.Warn("[main-control] Not received gena response before timeout")
+						break receiving
+					}
 				}
+				shutdown()
 
 				waitUpnpControls <- true
 			}()
@@ -313,20 +398,14 @@ func testGena(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 		}
 
 		// Start - SOAP
-		soap := testService.NewSOAPClient()
-		soapArgs := TurnArgs{
-			StateValue: "1",
-		}
-		reply := TurnReply{}
-
 		startRPCTime = time.Now()
-		err = soap.PerformActionCtx(ctx, testService.ServiceType, "Turn", &soapArgs, &reply)
+		reply, err := upnp.InvokeAction(ctx, testService, "Turn", []device.Argument{{Name: "StateValue", Value: "1"}})
 		if err != nil {
 			log.Error("[main-control] Error RPC: " + err.Error())
 		}
 		elapsedTime = time.Since(startRPCTime)
 
-		log.Info("[main-control] RPC returned: " + reply.ActualValue)
+		log.Info("[main-control] RPC returned: " + actualValue(reply))
 		log.Trace("[main-control] RPC Elapsed time: " + elapsedTime.String())
 		// End - SOAP
 
@@ -340,3 +419,13 @@ func testGena(ctx context.Context, args Args, mx int, logLevel slog.Level) {
 		}
 	}
 }
+
+// Returns the ActualValue out-argument of the Turn action, empty if missing
+func actualValue(reply []device.Argument) string {
+	for _, argument := range reply {
+		if argument.Name == "ActualValue" {
+			return argument.Value
+		}
+	}
+	return ""
+}
@@ -1,10 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
 	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/alexflint/go-arg"
@@ -18,9 +28,11 @@ import (
 )
 
 const (
-	devicePresentationUrl = "/device.xml"
+	deviceDescriptionUrl  = "/device.xml"
+	devicePresentationUrl = "/"
 	mqttDiscoveryTopic    = "test/discovery/#"
 	mqttAliveTopic        = "test/alive"
+	upnpShutdownTimeout   = 5 * time.Second
 	mqttPrefix            = "mqttdevice"
 )
 
@@ -31,6 +43,15 @@ type Args struct {
 	MqttBroker string `arg:"--mqtt-broker" default:" "  help:"MQTT broker"`
 	MqttQos    int    `arg:"--qos" default:"0" help:"Sets the MQTT Qos"`
 
+	Interfaces  []string `arg:"-i,--interface,separate" help:"Network interface used by SSDP, can be repeated (default: the interface of the local IP)"`
+	SsdpNetwork string   `arg:"--ssdp-network" default:"ipv4" help:"IP version used by SSDP: ipv4, ipv6 or dual"`
+
+	MulticastEvents bool `arg:"--multicast-events" default:"false" help:"Multicast the changes of actualState with GENA multicast eventing"`
+
+	SubscriptionsDir string `arg:"--subscriptions-dir" help:"Directory keeping the GENA subscriptions across restarts (default: in memory)"`
+
+	PresentationActions bool `arg:"--presentation-actions" default:"false" help:"Let the presentation page invoke the actions, without authentication"`
+
 	DebugEnabled bool `arg:"-d,--debug" default:"false" help:"Enable debug logging"`
 }
 
@@ -78,31 +99,89 @@ func main() {
 	}
 
 	if args.NumUpnpDevices > 0 {
-		for range args.NumUpnpDevices {
+		var upnpDevicesMutex sync.Mutex
+		upnpDevices := []upnpDevice{}
+
+		for i := range args.NumUpnpDevices {
 			go func() {
-				gena := upnp.NewGenaListener(ctx)
-				ctx = context.WithValue(ctx, "gena", gena)
+				var store upnp.SubscriptionStore = upnp.NewMemorySubscriptionStore()
+				if len(args.SubscriptionsDir) > 0 {
+					fileStore, err := upnp.NewFileSubscriptionStore(filepath.Join(args.SubscriptionsDir, "device-"+strconv.Itoa(i)+".json"))
+					if err != nil {
+						log.Error("[main-device] Error while opening the subscription store: " + err.Error())
+						return
+					}
+					store = fileStore
+				}
+
+				ssdpConfig := upnp.SsdpConfig{Interfaces: args.Interfaces, Network: upnp.SsdpNetwork(args.SsdpNetwork)}
+				gena := upnp.NewGenaListenerWithConfig(ctx, store, ssdpConfig)
+				gena.Start()
+				ctx := context.WithValue(ctx, "gena", gena)
 
-				httpServer, err := upnp.NewHttpServer(ctx)
+				httpServer, err := upnp.NewHttpServerWithConfig(ctx, upnp.HttpConfig{PresentationActions: args.PresentationActions})
 				if err != nil {
+					gena.Shutdown(ctx)
 					return
 				}
 
-				rootDevice, err := CreateUpnpRootDevice(ctx, httpServer.Port)
+				rootDevice, err := CreateUpnpRootDevice(ctx, httpServer.Port, args.MulticastEvents)
 				if err != nil {
+					httpServer.Shutdown(ctx)
+					gena.Shutdown(ctx)
 					return
 				}
 
-				httpServer.ServeRootDevice(rootDevice, devicePresentationUrl)
-				upnp.SsdpDevice(ctx, rootDevice)
+				httpServer.ServeRootDevice(rootDevice)
+				httpServer.Start()
+				ssdpDevice, err := upnp.SsdpDeviceWithConfig(ctx, rootDevice, ssdpConfig)
+				if err != nil {
+					httpServer.Shutdown(ctx)
+					gena.Shutdown(ctx)
+					return
+				}
+
+				upnpDevicesMutex.Lock()
+				upnpDevices = append(upnpDevices, upnpDevice{
+					ssdp:       ssdpDevice,
+					httpServer: httpServer,
+					gena:       gena,
+				})
+				upnpDevicesMutex.Unlock()
 			}()
 		}
 
-		time.Sleep(time.Hour)
+		signalCtx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+		select {
+		case <-time.After(time.Hour):
+		case <-signalCtx.Done():
+			log.Info("[main-device] Received termination signal")
+		}
+		stop()
+
+		// Devices leave the network before terminating (see 1.2.3), after completing the in-flight
+		// requests and sending the final events
+		shutdownCtx, cancelShutdown := context.WithTimeout(ctx, upnpShutdownTimeout)
+		upnpDevicesMutex.Lock()
+		for _, upnpDevice := range upnpDevices {
+			upnpDevice.httpServer.Shutdown(shutdownCtx)
+			upnpDevice.gena.Shutdown(shutdownCtx)
+			upnp.StopSsdpDevice(upnpDevice.ssdp)
+		}
+		upnpDevicesMutex.Unlock()
+		cancelShutdown()
+
 		cancel()
 	}
 }
 
+// Components of a deployed UPnP device, stopped in order at termination
+type upnpDevice struct {
+	ssdp       *upnp.SsdpState
+	httpServer upnp.HttpServer
+	gena       *upnp.GenaState
+}
+
 func CreateMqttSwitchDevice(ctx context.Context) (mqtt.Device, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
@@ -128,9 +207,8 @@ func CreateMqttSwitchDevice(ctx context.Context) (mqtt.Device, error) {
 	}, nil
 }
 
-func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, error) {
+func CreateUpnpRootDevice(ctx context.Context, upnpPort int, multicastEvents bool) (upnp.RootDevice, error) {
 	log := ctx.Value("logger").(logging.Logger)
-	gena := ctx.Value("gena").(*upnp.GenaState)
 
 	uuid, err := upnp.GenerateRandomUUID()
 	if err != nil {
@@ -138,11 +216,14 @@ func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, e
 		return upnp.RootDevice{}, err
 	}
 
+	deviceUrl := "http://" + utils.GetLocalIP() + ":" + strconv.Itoa(upnpPort)
+
 	result := upnp.RootDevice{
 		SpecVersion: upnp.SpecVersion{
-			Major: "0",
-			Minor: "1",
+			Major: "2",
+			Minor: "0",
 		},
+		DescriptionURL: deviceUrl + deviceDescriptionUrl,
 		Device: upnp.Device{
 			DeviceType:       "urn:schemas-upnp-org:device:BinaryLight:1",
 			UDN:              uuid,
@@ -154,8 +235,8 @@ func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, e
 			ModelDescription: "The best smart light",
 			ModelNumber:      "422",
 			SerialNumber:     "123-456-789-0",
-			UPC:              "12345678900987654321",
-			PresentationURL:  "http://" + utils.GetLocalIP() + ":" + strconv.Itoa(upnpPort) + devicePresentationUrl,
+			UPC:              "123456789012",
+			PresentationURL:  deviceUrl + devicePresentationUrl,
 			IconList: []upnp.Icon{
 				{
 					Mimetype: "image/jpeg",
@@ -163,6 +244,7 @@ func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, e
 					Width:    "48",
 					Depth:    "24",
 					Url:      "/images/icon-48x48.jpg",
+					Data:     iconImage(48),
 				},
 				{
 					Mimetype: "image/jpeg",
@@ -170,6 +252,7 @@ func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, e
 					Width:    "120",
 					Depth:    "24",
 					Url:      "/images/icon-120x120.jpg",
+					Data:     iconImage(120),
 				},
 			},
 			ServiceList: []upnp.Service{
@@ -190,13 +273,15 @@ func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, e
 			},
 			EmbeddedDevices: []upnp.Device{},
 		},
+		BootId:   int(time.Now().Unix()),
+		ConfigId: 1,
 	}
 
 	stateValueVariable := upnp.StateVariable{
 		SendEvents:        true,
 		Multicast:         false,
 		Name:              "state",
-		DataType:          "string",
+		DataType:          "boolean",
 		DefaultValue:      "0",
 		AllowedValueRange: nil,
 		AllowedValueList:  nil,
@@ -204,9 +289,9 @@ func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, e
 
 	actualValueVariable := upnp.StateVariable{
 		SendEvents:        true,
-		Multicast:         false,
+		Multicast:         multicastEvents,
 		Name:              "actualState",
-		DataType:          "string",
+		DataType:          "boolean",
 		DefaultValue:      "0",
 		AllowedValueRange: nil,
 		AllowedValueList:  nil,
@@ -257,27 +342,40 @@ func CreateUpnpRootDevice(ctx context.Context, upnpPort int) (upnp.RootDevice, e
 	*/
 
 	result.Device.ServiceList[0].SCPD = scpd
-	result.Device.ServiceList[0].Handler = func(arguments ...device.Argument) device.Response {
+	result.Device.ServiceList[1].SCPD = upnp.Scpd{
+		SpecVersion: scpd.SpecVersion,
+	}
+	for i := range result.Device.ServiceList {
+		result.Device.ServiceList[i].State = upnp.NewStateStore(ctx, result.Device.ServiceList[i])
+	}
+	result.Device.ServiceList[0].HandleAction("Turn", func(arguments ...device.Argument) device.Response {
 		log.Info("[service] Execute service: urn:upnp-org:serviceId:SwitchPower action: Turn value: " + arguments[0].Value)
 
-		switch arguments[0].Value {
-		case "0", "1":
-			gena.GenaNotifySubscribers(result.Device.ServiceList[0], []device.Argument{
-				{
-					Name:  "actualState",
-					Value: arguments[0].Value,
-				},
-			})
-			return device.Response{
-				Value: arguments[0].Value,
-			}
-		default:
+		err := result.Device.ServiceList[0].State.SetValues(
+			device.Argument{Name: "state", Value: arguments[0].Value},
+			device.Argument{Name: "actualState", Value: arguments[0].Value},
+		)
+		if err != nil {
 			return device.Response{
 				ErrorCode:    101,
-				ErrorMessage: "Test application error",
+				ErrorMessage: err.Error(),
 			}
 		}
-	}
+		return device.Response{
+			Value: arguments[0].Value,
+		}
+	})
 
 	return result, nil
 }
+
+// Generates a size x size JPEG icon of a light bulb yellow square
+func iconImage(size int) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, size, size))
+	draw.Draw(img, img.Bounds(), &image.Uniform{color.RGBA{R: 255, G: 214, B: 0, A: 255}}, image.Point{}, draw.Src)
+
+	var result bytes.Buffer
+	jpeg.Encode(&result, img, nil)
+
+	return result.Bytes()
+}
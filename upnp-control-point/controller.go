@@ -4,12 +4,32 @@ import (
 	"context"
 	"net/url"
 
+	device "github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/upnp"
 
 	"github.com/huin/goupnp"
 )
 
+type DeviceRegistry = upnp.DeviceRegistry
+type SsdpConfig = upnp.SsdpConfig
+type SsdpNetwork = upnp.SsdpNetwork
+type UPnPError = upnp.UPnPError
+type Event = upnp.Event
+type MulticastEvent = upnp.MulticastEvent
+type GenaMulticastEventLevels = upnp.GenaMulticastEventLevels
+type ManagedSubscription = upnp.ManagedSubscription
+
+// Creates a registry of the devices advertised via SSDP, see upnp.NewDeviceRegistry
+func NewDeviceRegistry(ctx context.Context) (*DeviceRegistry, error) {
+	return upnp.NewDeviceRegistry(ctx)
+}
+
+// Same as NewDeviceRegistry, listens on the interfaces of config
+func NewDeviceRegistryWithConfig(ctx context.Context, config SsdpConfig) (*DeviceRegistry, error) {
+	return upnp.NewDeviceRegistryWithConfig(ctx, config)
+}
+
 func Search(ctx context.Context, st string) (map[string]goupnp.RootDevice, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
@@ -34,6 +54,49 @@ func SearchMx(ctx context.Context, st string, mx int) (map[string]goupnp.RootDev
 	return search(ctx, maybeDevices)
 }
 
+// Same as SearchMx, the M-SEARCH is sent on the interfaces of config
+func SearchMxWithConfig(ctx context.Context, st string, mx int, config SsdpConfig) (map[string]goupnp.RootDevice, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	maybeDevices, err := upnp.SearchMxWithConfig(ctx, st, mx, config)
+	if err != nil {
+		log.Error("[upnp-controller] Error while searching for maybeDevices")
+		return nil, err
+	}
+
+	return search(ctx, maybeDevices)
+}
+
+// Searches st directly at host ("ip" or "ip:port") with a unicast M-SEARCH
+func SearchUnicast(ctx context.Context, host string, st string) (map[string]goupnp.RootDevice, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	maybeDevices, err := upnp.SearchUnicast(ctx, host, st)
+	if err != nil {
+		log.Error("[upnp-controller] Error while searching for maybeDevices at " + host)
+		return nil, err
+	}
+
+	return search(ctx, maybeDevices)
+}
+
+// Searches st answering from the registry cache, an M-SEARCH is sent only if no device is cached
+func SearchRegistry(ctx context.Context, registry *DeviceRegistry, st string, mx int) (map[string]goupnp.RootDevice, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	maybeDevices := registry.Lookup(st)
+	if len(maybeDevices) == 0 {
+		var err error
+		maybeDevices, err = registry.SearchMx(ctx, st, mx)
+		if err != nil {
+			log.Error("[upnp-controller] Error while searching for maybeDevices")
+			return nil, err
+		}
+	}
+
+	return search(ctx, maybeDevices)
+}
+
 func search(ctx context.Context, maybeDevices []upnp.MSearchResult) (map[string]goupnp.RootDevice, error) {
 	devices := make(map[string]goupnp.RootDevice)
 	for _, maybeDevice := range maybeDevices {
@@ -50,21 +113,90 @@ func search(ctx context.Context, maybeDevices []upnp.MSearchResult) (map[string]
 	return devices, nil
 }
 
-var subscriptions = make(map[string]string)
+// Subscribes to service through manager, which keeps the SID: handler receives the events until Unsubscribe
+func Subscribe(ctx context.Context, manager *SubscriptionManager, rootDevice goupnp.RootDevice, service goupnp.Service, handler func(Event)) (*ManagedSubscription, error) {
+	return SubscribeWithInitialEvent(ctx, manager, rootDevice, service, nil, handler)
+}
 
-func Subscribe(ctx context.Context, rootDevice goupnp.RootDevice, service goupnp.Service, handler func(string)) (*context.CancelFunc, error) {
+// Same as Subscribe, initialHandler receives the initial events (SEQ 0) holding the current state of the service,
+// also those of the subscriptions made again by manager
+func SubscribeWithInitialEvent(ctx context.Context, manager *SubscriptionManager, rootDevice goupnp.RootDevice, service goupnp.Service, initialHandler func(Event), handler func(Event)) (*ManagedSubscription, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
-	cancelFunc, sid, err := upnp.GenaSubscribeToService(ctx, ConvertRootDevice(rootDevice), ConvertService(service), handler)
+	subscription, err := manager.Subscribe(rootDevice, service)
+	if err != nil {
+		return nil, err
+	}
+	log.Info("[upnp-controller] Subscribed successfully. Obtained SID: " + subscription.SID())
+
+	go func() {
+		for event := range subscription.Events() {
+			if event.Seq == 0 {
+				if initialHandler != nil {
+					initialHandler(event)
+				}
+				continue
+			}
+			handler(event)
+		}
+	}()
+
+	return subscription, nil
+}
 
-	if err == nil {
-		subscriptions[rootDevice.Device.UDN+service.ServiceId] = sid
-		log.Info("[upnp-controller] Subscribed successfully. Obtained SID: " + sid)
+// Listens for the multicast events of service until ctx is done, handler receives those with one of levels,
+// all of them if levels is empty
+func ListenMulticastEvents(ctx context.Context, rootDevice goupnp.RootDevice, service goupnp.Service, handler func(MulticastEvent), levels ...GenaMulticastEventLevels) error {
+	return ListenMulticastEventsWithConfig(ctx, rootDevice, service, handler, SsdpConfig{}, levels...)
+}
+
+// Same as ListenMulticastEvents, listens on the interfaces of config
+func ListenMulticastEventsWithConfig(ctx context.Context, rootDevice goupnp.RootDevice, service goupnp.Service, handler func(MulticastEvent), config SsdpConfig, levels ...GenaMulticastEventLevels) error {
+	return upnp.GenaListenMulticastEventsWithConfig(ctx, ConvertRootDevice(rootDevice), ConvertService(service), handler, config, levels...)
+}
+
+// Ends a subscription made by Subscribe, its manager removes the SID
+func Unsubscribe(subscription *ManagedSubscription) error {
+	return subscription.Unsubscribe()
+}
+
+// GENA subscriptions sharing one callback server, renewed and subscribed again until Shutdown,
+// see upnp.SubscriptionManager
+type SubscriptionManager struct {
+	manager *upnp.SubscriptionManager
+}
+
+func NewSubscriptionManager(ctx context.Context) (*SubscriptionManager, error) {
+	return NewSubscriptionManagerWithRegistry(ctx, nil)
+}
+
+// Same as NewSubscriptionManager, the devices advertised again in registry are subscribed again at once
+func NewSubscriptionManagerWithRegistry(ctx context.Context, registry *DeviceRegistry) (*SubscriptionManager, error) {
+	manager, err := upnp.NewSubscriptionManagerWithRegistry(ctx, registry)
+	if err != nil {
+		return nil, err
 	}
 
-	return cancelFunc, err
+	return &SubscriptionManager{manager: manager}, nil
+}
+
+// Subscribes to the events of service, received from the Events channel of the subscription until Unsubscribe
+func (manager *SubscriptionManager) Subscribe(rootDevice goupnp.RootDevice, service goupnp.Service, stateVars ...string) (*ManagedSubscription, error) {
+	return manager.manager.Subscribe(ConvertRootDevice(rootDevice), ConvertService(service), stateVars...)
+}
+
+// Unsubscribes from all the subscriptions and stops the callback server
+func (manager *SubscriptionManager) Shutdown(ctx context.Context) error {
+	return manager.manager.Shutdown(ctx)
 }
 
-func Unsubscribe(ctx context.Context, rootDevice goupnp.RootDevice, service goupnp.Service) error {
-	return upnp.GenaUnsubscribeFromService(ctx, ConvertRootDevice(rootDevice), ConvertService(service), subscriptions[rootDevice.Device.UDN+service.ServiceId])
+// Invokes actionName on service, the out-arguments are returned in the order sent by the device.
+// Errors of the device are returned as UPnPError
+func InvokeAction(ctx context.Context, service goupnp.Service, actionName string, arguments []device.Argument) ([]device.Argument, error) {
+	// The SCPD is not needed to invoke an action: avoid ConvertService requesting it
+	return upnp.InvokeAction(ctx, upnp.Service{
+		ServiceType: service.ServiceType,
+		ServiceId:   service.ServiceId,
+		ControlURL:  service.ControlURL.URL.String(),
+	}, actionName, arguments)
 }
@@ -22,9 +22,10 @@ func ConvertRootDevices(goupnpRootDevices []goupnp.RootDevice) []upnp.RootDevice
 
 func ConvertRootDevice(goupnpRootDevice goupnp.RootDevice) upnp.RootDevice {
 	return upnp.RootDevice{
-		SpecVersion: ConvertSpecVersion(goupnpRootDevice.SpecVersion),
-		URLBase:     goupnpRootDevice.URLBaseStr,
-		Device:      ConvertDevice(goupnpRootDevice.Device),
+		SpecVersion:    ConvertSpecVersion(goupnpRootDevice.SpecVersion),
+		URLBase:        goupnpRootDevice.URLBaseStr,
+		DescriptionURL: goupnpRootDevice.URLBase.String(), // goupnp sets it to the LOCATION when URLBase is not present
+		Device:         ConvertDevice(goupnpRootDevice.Device),
 	}
 }
 
@@ -89,10 +90,17 @@ func ConvertService(goupnpService goupnp.Service) upnp.Service {
 		SCPDURL:     goupnpService.SCPDURL.Str,
 		EventSubURL: goupnpService.EventSubURL.Str,
 		ControlURL:  goupnpService.ControlURL.Str,
+		BaseURL:     serviceBaseURL(goupnpService),
 		SCPD:        ConvertSCPD(scpd),
 	}
 }
 
+// Returns scheme and host of the (already resolved) control URL of goupnpService
+func serviceBaseURL(goupnpService goupnp.Service) string {
+	controlUrl := goupnpService.ControlURL.URL
+	return controlUrl.Scheme + "://" + controlUrl.Host
+}
+
 func ConvertSCPD(s *scpd.SCPD) upnp.Scpd {
 	serviceStateTable := []*upnp.StateVariable{}
 
@@ -132,9 +140,9 @@ func ConvertSCPDStateVariable(stateVariable scpd.StateVariable) *upnp.StateVaria
 }
 
 func ConvertAllowedValueRange(allowedRange scpd.AllowedValueRange) upnp.ValueRange {
-	max, _ := strconv.Atoi(allowedRange.Maximum)
-	min, _ := strconv.Atoi(allowedRange.Minimum)
-	step, _ := strconv.Atoi(allowedRange.Step)
+	max, _ := strconv.ParseFloat(allowedRange.Maximum, 64)
+	min, _ := strconv.ParseFloat(allowedRange.Minimum, 64)
+	step, _ := strconv.ParseFloat(allowedRange.Step, 64)
 	return upnp.ValueRange{
 		Maximum: max,
 		Minimum: min,
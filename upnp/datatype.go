@@ -0,0 +1,221 @@
+package upnp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"math"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Error codes of the UPnPError for actions and arguments not valid (see 3.2.2)
+const (
+	errorCodeInvalidArgs                  = 402
+	errorCodeInvalidVar                   = 404
+	errorCodeActionFailed                 = 501
+	errorCodeOptionalActionNotImplemented = 602
+	errorCodeArgumentValueInvalid         = 600
+	errorCodeArgumentValueOutRange        = 601
+	errorCodeStringArgumentTooLong        = 605
+	maxStringArgumentLength               = 8192 // Longest string or uri accepted as argument
+	fixedIntegerDigits                    = 14   // Digits to the left of the decimal point of fixed.14.4
+	fixedFractionDigits                   = 4    // Digits to the right of the decimal point of fixed.14.4
+	valueRangeStepTolerance               = 1e-9 // Largest difference from a multiple of step accepted
+)
+
+var uuidRegexp = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// Layouts accepted for the date and time data types, the first one is used to normalize the value
+var timeLayouts = map[string][]string{
+	"date":        {"2006-01-02"},
+	"dateTime":    {"2006-01-02T15:04:05", "2006-01-02"},
+	"dateTime.tz": {"2006-01-02T15:04:05Z07:00", "2006-01-02T15:04:05", "2006-01-02"},
+	"time":        {"15:04:05"},
+	"time.tz":     {"15:04:05Z07:00", "15:04:05"},
+}
+
+// Checks value against the dataType, allowedValueList and allowedValueRange of stateVariable (see 2.5),
+// returns the value in the canonical form of the data type.
+// The error is an UPnPError with the code to send to the control point (see 3.2.2).
+func coerceValue(stateVariable *StateVariable, value string) (string, error) {
+	result, err := coerceDataType(stateVariable.DataType, value)
+	if err != nil {
+		return "", err
+	}
+
+	if len(stateVariable.AllowedValueList) > 0 && !slices.Contains(stateVariable.AllowedValueList, result) {
+		return "", UPnPError{
+			ErrorCode:        errorCodeArgumentValueInvalid,
+			ErrorDescription: "Argument Value Invalid: " + result + " not in allowedValueList of " + stateVariable.Name,
+		}
+	}
+
+	if stateVariable.AllowedValueRange != nil && slices.Contains(numericDataTypes, stateVariable.DataType) {
+		number, _ := strconv.ParseFloat(result, 64)
+		valueRange := stateVariable.AllowedValueRange
+
+		if number < valueRange.Minimum || number > valueRange.Maximum {
+			return "", UPnPError{
+				ErrorCode:        errorCodeArgumentValueOutRange,
+				ErrorDescription: "Argument Value Out of Range: " + result + " not in [" + formatValueRangeBound(valueRange.Minimum) + ", " + formatValueRangeBound(valueRange.Maximum) + "]",
+			}
+		}
+		// Tolerant of the rounding of decimal steps (e.g. 0.1)
+		steps := (number - valueRange.Minimum) / valueRange.Step
+		if valueRange.Step > 0 && math.Abs(steps-math.Round(steps)) > valueRangeStepTolerance {
+			return "", UPnPError{
+				ErrorCode:        errorCodeArgumentValueOutRange,
+				ErrorDescription: "Argument Value Out of Range: " + result + " not a step of " + formatValueRangeBound(valueRange.Step),
+			}
+		}
+	}
+
+	return result, nil
+}
+
+// Parses value as dataType (see 2.5), returns its canonical form
+func coerceDataType(dataType string, value string) (string, error) {
+	invalid := UPnPError{
+		ErrorCode:        errorCodeArgumentValueInvalid,
+		ErrorDescription: "Argument Value Invalid: " + value + " is not " + dataType,
+	}
+	outOfRange := UPnPError{
+		ErrorCode:        errorCodeArgumentValueOutRange,
+		ErrorDescription: "Argument Value Out of Range: " + value + " out of " + dataType,
+	}
+
+	switch dataType {
+	case "ui1", "ui2", "ui4", "ui8":
+		bitSize, _ := strconv.Atoi(dataType[2:])
+		number, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(value), "+"), 10, bitSize*8)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return "", outOfRange
+			}
+			return "", invalid
+		}
+		return strconv.FormatUint(number, 10), nil
+
+	case "i1", "i2", "i4", "i8", "int":
+		bitSize := 32
+		if dataType != "int" {
+			bitSize, _ = strconv.Atoi(dataType[1:])
+			bitSize *= 8
+		}
+		number, err := strconv.ParseInt(strings.TrimSpace(value), 10, bitSize)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return "", outOfRange
+			}
+			return "", invalid
+		}
+		return strconv.FormatInt(number, 10), nil
+
+	case "r4", "r8", "number", "float":
+		bitSize := 64
+		if dataType == "r4" {
+			bitSize = 32
+		}
+		number, err := strconv.ParseFloat(strings.TrimSpace(value), bitSize)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return "", outOfRange
+			}
+			return "", invalid
+		}
+		if math.IsNaN(number) || math.IsInf(number, 0) {
+			return "", invalid
+		}
+		return strconv.FormatFloat(number, 'g', -1, bitSize), nil
+
+	case "fixed.14.4":
+		trimmed := strings.TrimSpace(value)
+		number, err := strconv.ParseFloat(trimmed, 64)
+		if err != nil || strings.ContainsAny(trimmed, "eEnNiI") {
+			return "", invalid
+		}
+		integerPart, fractionPart, _ := strings.Cut(strings.TrimLeft(trimmed, "+-"), ".")
+		if len(strings.TrimLeft(integerPart, "0")) > fixedIntegerDigits || len(fractionPart) > fixedFractionDigits {
+			return "", outOfRange
+		}
+		return strconv.FormatFloat(number, 'f', -1, 64), nil
+
+	case "char":
+		if utf8.RuneCountInString(value) != 1 {
+			return "", invalid
+		}
+		return value, nil
+
+	case "string":
+		if len(value) > maxStringArgumentLength {
+			return "", UPnPError{
+				ErrorCode:        errorCodeStringArgumentTooLong,
+				ErrorDescription: "String Argument Too Long",
+			}
+		}
+		return value, nil
+
+	case "date", "dateTime", "dateTime.tz", "time", "time.tz":
+		layouts := timeLayouts[dataType]
+		for _, layout := range layouts {
+			parsed, err := time.Parse(layout, strings.TrimSpace(value))
+			if err == nil {
+				return parsed.Format(layouts[0]), nil
+			}
+		}
+		return "", invalid
+
+	case "boolean":
+		switch strings.ToLower(strings.TrimSpace(value)) {
+		case "1", "true", "yes":
+			return "1", nil
+		case "0", "false", "no":
+			return "0", nil
+		default:
+			return "", invalid
+		}
+
+	case "bin.base64":
+		data, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(value), ""))
+		if err != nil {
+			return "", invalid
+		}
+		return base64.StdEncoding.EncodeToString(data), nil
+
+	case "bin.hex":
+		data, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil {
+			return "", invalid
+		}
+		return hex.EncodeToString(data), nil
+
+	case "uri":
+		if len(value) > maxStringArgumentLength {
+			return "", UPnPError{
+				ErrorCode:        errorCodeStringArgumentTooLong,
+				ErrorDescription: "String Argument Too Long",
+			}
+		}
+		parsed, err := url.Parse(strings.TrimSpace(value))
+		if err != nil {
+			return "", invalid
+		}
+		return parsed.String(), nil
+
+	case "uuid":
+		trimmed := strings.TrimSpace(value)
+		if !uuidRegexp.MatchString(trimmed) {
+			return "", invalid
+		}
+		return strings.ToLower(trimmed), nil
+
+	default:
+		return value, nil
+	}
+}
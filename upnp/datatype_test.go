@@ -0,0 +1,118 @@
+package upnp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCoerceDataType(t *testing.T) {
+	const accepted = 0
+
+	tests := []struct {
+		dataType  string
+		value     string
+		expected  string // Canonical form when accepted
+		errorCode int
+	}{
+		{"ui1", "255", "255", accepted},
+		{"ui1", " +7 ", "7", accepted},
+		{"ui1", "256", "", errorCodeArgumentValueOutRange},
+		{"ui1", "-1", "", errorCodeArgumentValueInvalid},
+		{"ui1", "abc", "", errorCodeArgumentValueInvalid},
+		{"ui2", "65535", "65535", accepted},
+		{"ui2", "65536", "", errorCodeArgumentValueOutRange},
+		{"ui4", "4294967295", "4294967295", accepted},
+		{"ui4", "4294967296", "", errorCodeArgumentValueOutRange},
+		{"ui8", "18446744073709551616", "", errorCodeArgumentValueOutRange},
+
+		{"i1", "-128", "-128", accepted},
+		{"i1", "+127", "127", accepted},
+		{"i1", "128", "", errorCodeArgumentValueOutRange},
+		{"i1", "-129", "", errorCodeArgumentValueOutRange},
+		{"i1", "1.5", "", errorCodeArgumentValueInvalid},
+		{"i2", "32768", "", errorCodeArgumentValueOutRange},
+		{"i4", "-2147483648", "-2147483648", accepted},
+		{"i4", "-2147483649", "", errorCodeArgumentValueOutRange},
+		{"int", "2147483648", "", errorCodeArgumentValueOutRange},
+		{"i8", "9223372036854775808", "", errorCodeArgumentValueOutRange},
+
+		{"r4", "1.5", "1.5", accepted},
+		{"r4", "3.5e38", "", errorCodeArgumentValueOutRange},
+		{"r8", "1e3", "1000", accepted},
+		{"r8", "1e309", "", errorCodeArgumentValueOutRange},
+		{"r8", "NaN", "", errorCodeArgumentValueInvalid},
+		{"r8", "Inf", "", errorCodeArgumentValueInvalid},
+		{"float", " 2.50 ", "2.5", accepted},
+		{"number", "x", "", errorCodeArgumentValueInvalid},
+		{"fixed.14.4", "12.3400", "12.34", accepted},
+		{"fixed.14.4", "12.34567", "", errorCodeArgumentValueOutRange},
+		{"fixed.14.4", "123456789012345", "", errorCodeArgumentValueOutRange},
+		{"fixed.14.4", "1e3", "", errorCodeArgumentValueInvalid},
+
+		{"char", "é", "é", accepted},
+		{"char", "ab", "", errorCodeArgumentValueInvalid},
+		{"string", strings.Repeat("a", maxStringArgumentLength), strings.Repeat("a", maxStringArgumentLength), accepted},
+		{"string", strings.Repeat("a", maxStringArgumentLength+1), "", errorCodeStringArgumentTooLong},
+
+		{"boolean", "true", "1", accepted},
+		{"boolean", "YES", "1", accepted},
+		{"boolean", " no ", "0", accepted},
+		{"boolean", "0", "0", accepted},
+		{"boolean", "on", "", errorCodeArgumentValueInvalid},
+
+		{"date", "2024-02-29", "2024-02-29", accepted},
+		{"date", "2024-02-30", "", errorCodeArgumentValueInvalid},
+		{"dateTime", "2024-01-02T03:04:05", "2024-01-02T03:04:05", accepted},
+		{"dateTime", "2024-01-02", "2024-01-02T00:00:00", accepted},
+		{"dateTime", "2024-01-02T25:00:00", "", errorCodeArgumentValueInvalid},
+		{"dateTime.tz", "2024-01-02T03:04:05+02:00", "2024-01-02T03:04:05+02:00", accepted},
+		{"dateTime.tz", "2024-01-02T03:04:05", "2024-01-02T03:04:05Z", accepted},
+		{"time", "23:59:59", "23:59:59", accepted},
+		{"time", "24:00:00", "", errorCodeArgumentValueInvalid},
+		{"time.tz", "10:00:00-05:00", "10:00:00-05:00", accepted},
+
+		{"bin.base64", "aGVs\nbG8=", "aGVsbG8=", accepted},
+		{"bin.base64", "!!", "", errorCodeArgumentValueInvalid},
+		{"bin.hex", "0A0b", "0a0b", accepted},
+		{"bin.hex", "0g", "", errorCodeArgumentValueInvalid},
+
+		{"uri", "http://example.com/path?q=1", "http://example.com/path?q=1", accepted},
+		{"uri", "http://example.com/a b", "http://example.com/a%20b", accepted},
+		{"uri", "http://[::1", "", errorCodeArgumentValueInvalid},
+		{"uri", "http://example.com/" + strings.Repeat("a", maxStringArgumentLength), "", errorCodeStringArgumentTooLong},
+
+		{"uuid", "6F1C5B0E-8A3D-4C7E-9B21-0D4E5F6A7B8C", "6f1c5b0e-8a3d-4c7e-9b21-0d4e5f6a7b8c", accepted},
+		{"uuid", "uuid:6f1c5b0e-8a3d-4c7e-9b21-0d4e5f6a7b8c", "", errorCodeArgumentValueInvalid},
+		{"uuid", "6f1c5b0e", "", errorCodeArgumentValueInvalid},
+	}
+
+	for _, test := range tests {
+		result, err := coerceDataType(test.dataType, test.value)
+
+		if test.errorCode == accepted {
+			if err != nil || result != test.expected {
+				t.Errorf("%s %q: got %q %v, expected %q", test.dataType, test.value, result, err, test.expected)
+			}
+			continue
+		}
+
+		var upnpError UPnPError
+		if !errors.As(err, &upnpError) || upnpError.ErrorCode != test.errorCode {
+			t.Errorf("%s %q: got %q %v, expected error %d", test.dataType, test.value, result, err, test.errorCode)
+		}
+	}
+}
+
+func TestCoerceValueAllowedValueList(t *testing.T) {
+	stateVariable := &StateVariable{Name: "mode", DataType: "string", AllowedValueList: []string{"On", "Off"}}
+
+	if result, err := coerceValue(stateVariable, "On"); err != nil || result != "On" {
+		t.Errorf("Allowed value: got %q %v", result, err)
+	}
+
+	var upnpError UPnPError
+	if _, err := coerceValue(stateVariable, "on"); !errors.As(err, &upnpError) || upnpError.ErrorCode != errorCodeArgumentValueInvalid {
+		t.Errorf("Value not in allowedValueList: got %v", err)
+	}
+}
@@ -0,0 +1,216 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+const (
+	genaDeliveryTimeoutSeconds = 5   // Timeout of a NOTIFY
+	genaDeliveryAttempts       = 3   // Attempts to deliver an event message before skipping it
+	genaDeliveryBackoffMillis  = 500 // Wait before the first retry, doubled at each retry
+	genaMaxFailedDeliveries    = 3   // Consecutive event messages not delivered before dropping the subscriber
+	genaMaxQueuedEvents        = 128 // Event messages waiting for delivery, the oldest are dropped beyond this
+)
+
+// Event message waiting for delivery
+type queuedEvent struct {
+	seq              int
+	variableValueMap map[string]string
+}
+
+// Event messages of a subscription, delivered one at a time in SEQ order.
+// The SEQ is assigned when the message is queued: the messages dropped or not delivered leave a gap
+// the subscriber can detect (see 4.3.2).
+type deliveryQueue struct {
+	mutex     sync.Mutex
+	nextSeq   int
+	pending   []queuedEvent
+	wakeUp    chan struct{}
+	draining  chan struct{} // Closed by drain: the delivery ends when the queue is empty
+	drainOnce sync.Once
+	done      chan struct{}
+	stopOnce  sync.Once
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	return &deliveryQueue{
+		pending:  []queuedEvent{},
+		wakeUp:   make(chan struct{}, 1),
+		draining: make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+}
+
+// Queues an event message with the next SEQ, wrapping from genaMaxSeq to 1
+func (queue *deliveryQueue) push(variableValueMap map[string]string) {
+	queue.mutex.Lock()
+	queue.pending = append(queue.pending, queuedEvent{
+		seq:              queue.nextSeq,
+		variableValueMap: variableValueMap,
+	})
+	if len(queue.pending) > genaMaxQueuedEvents {
+		queue.pending = queue.pending[1:]
+	}
+
+	queue.nextSeq++
+	if queue.nextSeq > genaMaxSeq {
+		queue.nextSeq = 1
+	}
+	queue.mutex.Unlock()
+
+	select {
+	case queue.wakeUp <- struct{}{}:
+	default:
+	}
+}
+
+func (queue *deliveryQueue) pop() (queuedEvent, bool) {
+	queue.mutex.Lock()
+	defer queue.mutex.Unlock()
+
+	if len(queue.pending) == 0 {
+		return queuedEvent{}, false
+	}
+
+	result := queue.pending[0]
+	queue.pending = queue.pending[1:]
+
+	return result, true
+}
+
+// Ends the delivery once the queued event messages have been delivered
+func (queue *deliveryQueue) drain() {
+	queue.drainOnce.Do(func() {
+		close(queue.draining)
+	})
+}
+
+// Stops the delivery, the queued event messages are discarded
+func (queue *deliveryQueue) stop() {
+	queue.stopOnce.Do(func() {
+		close(queue.done)
+	})
+}
+
+// Delivers the queued event messages of subscription until the queue is stopped, drained or ctx is done.
+// After genaMaxFailedDeliveries consecutive messages not delivered the subscription is removed from state.
+func (queue *deliveryQueue) run(ctx context.Context, state *GenaState, subscription subscription) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	deliveryCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-queue.done:
+			cancel()
+		case <-deliveryCtx.Done():
+		}
+	}()
+
+	failedDeliveries := 0
+	for {
+		event, found := queue.pop()
+		if !found {
+			select {
+			case <-queue.wakeUp:
+				continue
+			case <-queue.draining:
+				return
+			case <-deliveryCtx.Done():
+				return
+			}
+		}
+
+		err := deliverEvent(deliveryCtx, subscription, event)
+		if deliveryCtx.Err() != nil {
+			return
+		}
+		if err == nil {
+			failedDeliveries = 0
+			continue
+		}
+
+		failedDeliveries++
+		log.Warn("[gena] Event SEQ " + strconv.Itoa(event.seq) + " not delivered to " + subscription.sid + ": " + err.Error())
+
+		if failedDeliveries >= genaMaxFailedDeliveries || errors.Is(err, errUnknownSubscription) {
+			log.Warn("[gena] Dropping subscriber " + subscription.sid + " at " + subscription.callback.String())
+			select {
+			case state.deleteSubscription <- subscription.sid:
+			case <-deliveryCtx.Done():
+			}
+			return
+		}
+	}
+}
+
+// Returned when the subscriber does not recognize the SID: it will not accept further event messages
+var errUnknownSubscription = errors.New("Subscription unknown to the subscriber")
+
+// Sends event to subscription, retrying with exponential backoff up to genaDeliveryAttempts times
+func deliverEvent(ctx context.Context, subscription subscription, event queuedEvent) error {
+	log := ctx.Value("logger").(logging.Logger)
+
+	backoff := genaDeliveryBackoffMillis * time.Millisecond
+	var err error
+	for attempt := 1; attempt <= genaDeliveryAttempts; attempt++ {
+		err = sendNotification(ctx, subscription.callback, subscription.sid, event)
+		if err == nil || errors.Is(err, errUnknownSubscription) {
+			return err
+		}
+
+		if attempt < genaDeliveryAttempts {
+			log.Debug("[gena] Retrying event SEQ " + strconv.Itoa(event.seq) + " to " + subscription.sid + " in " + backoff.String() + ": " + err.Error())
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(backoff):
+			}
+			backoff *= 2
+		}
+	}
+
+	return err
+}
+
+// Sends an event message to callback (see 4.3.2)
+func sendNotification(ctx context.Context, callback *url.URL, sid string, event queuedEvent) error {
+	log := ctx.Value("logger").(logging.Logger)
+
+	request, err := http.NewRequestWithContext(ctx, "NOTIFY", callback.String(), strings.NewReader(generatePropertySet(event.variableValueMap)))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("CONTENT-TYPE", "text/xml; charset=\"utf-8\"")
+	request.Header.Set("NT", "upnp:event")
+	request.Header.Set("NTS", "upnp:propchange")
+	request.Header.Set("SID", sid)
+	request.Header.Set("SEQ", strconv.Itoa(event.seq))
+
+	response, err := newHttpClient(ctx, genaDeliveryTimeoutSeconds*time.Second).Do(request)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+
+	switch {
+	case response.StatusCode == http.StatusPreconditionFailed:
+		return errUnknownSubscription
+	case response.StatusCode < 200 || response.StatusCode > 299:
+		return errors.New(response.Status)
+	}
+
+	log.Debug("[gena] Event SEQ " + strconv.Itoa(event.seq) + " delivered to " + sid + ": " + response.Status)
+
+	return nil
+}
@@ -0,0 +1,880 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+const (
+	deviceNamespace  = "urn:schemas-upnp-org:device-1-0"
+	serviceNamespace = "urn:schemas-upnp-org:service-1-0"
+)
+
+// Device description document (see 2.3)
+type xmlRoot struct {
+	XMLName     xml.Name       `xml:"root"`
+	Xmlns       string         `xml:"xmlns,attr"`
+	ConfigId    string         `xml:"configId,attr"`
+	SpecVersion xmlSpecVersion `xml:"specVersion"`
+	URLBase     string         `xml:"URLBase,omitempty"`
+	Device      xmlDevice      `xml:"device"`
+}
+
+type xmlSpecVersion struct {
+	XMLName xml.Name `xml:"specVersion"`
+	Major   string   `xml:"major"`
+	Minor   string   `xml:"minor"`
+}
+
+type xmlDevice struct {
+	XMLName          xml.Name             `xml:"device"`
+	DeviceType       string               `xml:"deviceType"`
+	FriendlyName     string               `xml:"friendlyName"`
+	Manufacturer     string               `xml:"manufacturer"`
+	ManufacturerURL  string               `xml:"manufacturerURL,omitempty"`
+	ModelDescription string               `xml:"modelDescription,omitempty"`
+	ModelName        string               `xml:"modelName"`
+	ModelNumber      string               `xml:"modelNumber,omitempty"`
+	ModelURL         string               `xml:"modelURL,omitempty"`
+	SerialNumber     string               `xml:"serialNumber,omitempty"`
+	UDN              string               `xml:"UDN"`
+	UPC              string               `xml:"UPC,omitempty"`
+	IconList         *xmlList[xmlIcon]    `xml:"iconList"`
+	ServiceList      *xmlList[xmlService] `xml:"serviceList"`
+	DeviceList       *xmlList[xmlDevice]  `xml:"deviceList"`
+	PresentationURL  string               `xml:"presentationURL,omitempty"`
+}
+
+type xmlIcon struct {
+	XMLName  xml.Name `xml:"icon"`
+	Mimetype string   `xml:"mimetype"`
+	Width    string   `xml:"width"`
+	Height   string   `xml:"height"`
+	Depth    string   `xml:"depth"`
+	Url      string   `xml:"url"`
+}
+
+type xmlService struct {
+	XMLName     xml.Name `xml:"service"`
+	ServiceType string   `xml:"serviceType"`
+	ServiceId   string   `xml:"serviceId"`
+	SCPDURL     string   `xml:"SCPDURL"`
+	ControlURL  string   `xml:"controlURL"`
+	EventSubURL string   `xml:"eventSubURL"`
+}
+
+// Service description document (see 2.5)
+type xmlScpd struct {
+	XMLName           xml.Name                   `xml:"scpd"`
+	Xmlns             string                     `xml:"xmlns,attr"`
+	ConfigId          string                     `xml:"configId,attr,omitempty"`
+	SpecVersion       xmlSpecVersion             `xml:"specVersion"`
+	ActionList        *xmlList[xmlAction]        `xml:"actionList"`
+	ServiceStateTable *xmlList[xmlStateVariable] `xml:"serviceStateTable"`
+}
+
+type xmlAction struct {
+	XMLName      xml.Name              `xml:"action"`
+	Name         string                `xml:"name"`
+	ArgumentList *xmlList[xmlArgument] `xml:"argumentList"`
+}
+
+type xmlArgument struct {
+	XMLName              xml.Name  `xml:"argument"`
+	Name                 string    `xml:"name"`
+	Direction            string    `xml:"direction"`
+	Retval               *struct{} `xml:"retval"`
+	RelatedStateVariable string    `xml:"relatedStateVariable"`
+}
+
+type xmlStateVariable struct {
+	XMLName           xml.Name                  `xml:"stateVariable"`
+	SendEvents        string                    `xml:"sendEvents,attr"`
+	Multicast         string                    `xml:"multicast,attr"`
+	Name              string                    `xml:"name"`
+	DataType          string                    `xml:"dataType"`
+	DefaultValue      string                    `xml:"defaultValue,omitempty"`
+	AllowedValueList  *xmlList[xmlAllowedValue] `xml:"allowedValueList"`
+	AllowedValueRange *xmlAllowedValueRange     `xml:"allowedValueRange"`
+	MaximumRate       string                    `xml:"maximumRate,omitempty"`
+	MinimumDelta      string                    `xml:"minimumDelta,omitempty"`
+}
+
+type xmlAllowedValue struct {
+	XMLName xml.Name `xml:"allowedValue"`
+	Value   string   `xml:",chardata"`
+}
+
+type xmlAllowedValueRange struct {
+	XMLName xml.Name `xml:"allowedValueRange"`
+	Minimum string   `xml:"minimum"`
+	Maximum string   `xml:"maximum"`
+	Step    string   `xml:"step,omitempty"`
+}
+
+// List element of a description, omitted when empty.
+// The items are named by their XMLName
+type xmlList[T any] struct {
+	Items []T `xml:",any"`
+}
+
+func newXmlList[T any](items []T) *xmlList[T] {
+	if len(items) == 0 {
+		return nil
+	}
+	return &xmlList[T]{Items: items}
+}
+
+func (list *xmlList[T]) items() []T {
+	if list == nil {
+		return []T{}
+	}
+	return list.Items
+}
+
+// Marshals value as indented XML, the <?xml?> prologue is added to whole documents
+func marshalXML(value any, document bool) string {
+	data, _ := xml.MarshalIndent(value, "", "\t") // Only fails on unsupported types, not used by the xml structs
+
+	if document {
+		return xml.Header + string(data) + "\n"
+	}
+	return string(data) + "\n"
+}
+
+func xmlRootOf(rootDevice RootDevice) xmlRoot {
+	return xmlRoot{
+		Xmlns:       deviceNamespace,
+		ConfigId:    strconv.Itoa(rootDevice.ConfigId),
+		SpecVersion: xmlSpecVersionOf(rootDevice.SpecVersion),
+		URLBase:     rootDevice.URLBase,
+		Device:      xmlDeviceOf(rootDevice.Device),
+	}
+}
+
+func xmlSpecVersionOf(specVersion SpecVersion) xmlSpecVersion {
+	return xmlSpecVersion{
+		Major: specVersion.Major,
+		Minor: specVersion.Minor,
+	}
+}
+
+func xmlDeviceOf(device Device) xmlDevice {
+	icons := []xmlIcon{}
+	for _, icon := range device.IconList {
+		icons = append(icons, xmlIconOf(icon))
+	}
+
+	services := []xmlService{}
+	for _, service := range device.ServiceList {
+		services = append(services, xmlServiceOf(service))
+	}
+
+	embeddedDevices := []xmlDevice{}
+	for _, embeddedDevice := range device.EmbeddedDevices {
+		embeddedDevices = append(embeddedDevices, xmlDeviceOf(embeddedDevice))
+	}
+
+	return xmlDevice{
+		DeviceType:       device.DeviceType,
+		FriendlyName:     device.FriendlyName,
+		Manufacturer:     device.Manufacturer,
+		ManufacturerURL:  device.ManufacturerURL,
+		ModelDescription: device.ModelDescription,
+		ModelName:        device.ModelName,
+		ModelNumber:      device.ModelNumber,
+		ModelURL:         device.ModelURL,
+		SerialNumber:     device.SerialNumber,
+		UDN:              device.UDN,
+		UPC:              device.UPC,
+		IconList:         newXmlList(icons),
+		ServiceList:      newXmlList(services),
+		DeviceList:       newXmlList(embeddedDevices),
+		PresentationURL:  device.PresentationURL,
+	}
+}
+
+func xmlIconOf(icon Icon) xmlIcon {
+	return xmlIcon{
+		Mimetype: icon.Mimetype,
+		Width:    icon.Width,
+		Height:   icon.Height,
+		Depth:    icon.Depth,
+		Url:      icon.Url,
+	}
+}
+
+func xmlServiceOf(service Service) xmlService {
+	return xmlService{
+		ServiceType: service.ServiceType,
+		ServiceId:   service.ServiceId,
+		SCPDURL:     service.SCPDURL,
+		ControlURL:  service.ControlURL,
+		EventSubURL: service.EventSubURL,
+	}
+}
+
+func xmlScpdOf(scpd Scpd, configId int) xmlScpd {
+	actions := []xmlAction{}
+	for _, action := range scpd.actionList {
+		actions = append(actions, xmlActionOf(action))
+	}
+
+	stateVariables := []xmlStateVariable{}
+	for _, stateVariable := range scpd.ServiceStateTable {
+		stateVariables = append(stateVariables, xmlStateVariableOf(*stateVariable))
+	}
+
+	return xmlScpd{
+		Xmlns:             serviceNamespace,
+		ConfigId:          strconv.Itoa(configId),
+		SpecVersion:       xmlSpecVersionOf(scpd.SpecVersion),
+		ActionList:        newXmlList(actions),
+		ServiceStateTable: newXmlList(stateVariables),
+	}
+}
+
+func xmlActionOf(action FormalAction) xmlAction {
+	arguments := []xmlArgument{}
+	for _, argument := range action.ArgumentList {
+		arguments = append(arguments, xmlArgumentOf(argument))
+	}
+
+	return xmlAction{
+		Name:         action.Name,
+		ArgumentList: newXmlList(arguments),
+	}
+}
+
+func xmlArgumentOf(argument FormalArgument) xmlArgument {
+	relatedStateVariable := ""
+	if argument.RelatedStateVariable != nil {
+		relatedStateVariable = argument.RelatedStateVariable.Name
+	}
+
+	var retval *struct{}
+	if argument.Retval {
+		retval = &struct{}{}
+	}
+
+	return xmlArgument{
+		Name:                 argument.Name,
+		Direction:            argument.Direction.String(),
+		Retval:               retval,
+		RelatedStateVariable: relatedStateVariable,
+	}
+}
+
+func xmlStateVariableOf(stateVariable StateVariable) xmlStateVariable {
+	result := xmlStateVariable{
+		SendEvents:   yesNo(stateVariable.SendEvents),
+		Multicast:    yesNo(stateVariable.Multicast),
+		Name:         stateVariable.Name,
+		DataType:     stateVariable.DataType,
+		DefaultValue: stateVariable.DefaultValue,
+	}
+
+	allowedValues := []xmlAllowedValue{}
+	for _, allowedValue := range stateVariable.AllowedValueList {
+		allowedValues = append(allowedValues, xmlAllowedValue{Value: allowedValue})
+	}
+	result.AllowedValueList = newXmlList(allowedValues)
+
+	if stateVariable.AllowedValueRange != nil {
+		valueRange := xmlAllowedValueRangeOf(*stateVariable.AllowedValueRange)
+		result.AllowedValueRange = &valueRange
+	}
+
+	// Emitted in seconds, only for the moderated variables
+	if stateVariable.MaximumRate > 0 {
+		result.MaximumRate = strconv.FormatFloat(stateVariable.MaximumRate.Seconds(), 'f', -1, 64)
+	}
+	if stateVariable.MinimumDelta > 0 {
+		result.MinimumDelta = strconv.FormatFloat(stateVariable.MinimumDelta, 'f', -1, 64)
+	}
+
+	return result
+}
+
+func xmlAllowedValueRangeOf(valueRange ValueRange) xmlAllowedValueRange {
+	result := xmlAllowedValueRange{
+		Minimum: formatValueRangeBound(valueRange.Minimum),
+		Maximum: formatValueRangeBound(valueRange.Maximum),
+	}
+	if valueRange.Step != 0 {
+		result.Step = formatValueRangeBound(valueRange.Step)
+	}
+
+	return result
+}
+
+func formatValueRangeBound(value float64) string {
+	return strconv.FormatFloat(value, 'f', -1, 64)
+}
+
+func yesNo(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
+
+// Data types of the state variables (see 2.5)
+var dataTypes = []string{
+	"ui1", "ui2", "ui4", "ui8", "i1", "i2", "i4", "i8", "int",
+	"r4", "r8", "number", "fixed.14.4", "float",
+	"char", "string", "date", "dateTime", "dateTime.tz", "time", "time.tz",
+	"boolean", "bin.base64", "bin.hex", "uri", "uuid",
+}
+
+// Data types accepting an allowedValueRange (see 2.5)
+var numericDataTypes = []string{
+	"ui1", "ui2", "ui4", "ui8", "i1", "i2", "i4", "i8", "int",
+	"r4", "r8", "number", "fixed.14.4", "float",
+}
+
+// Checks the description documents of rootDevice, SCPDs included, against the constraints of the UDA
+// schemas (see 2.3 and 2.5)
+func (rootDevice RootDevice) Validate() error {
+	if !isDecimal(rootDevice.SpecVersion.Major) || !isDecimal(rootDevice.SpecVersion.Minor) {
+		return errors.New("specVersion not valid: " + rootDevice.SpecVersion.Major + "." + rootDevice.SpecVersion.Minor)
+	}
+
+	if rootDevice.ConfigId < 0 || rootDevice.ConfigId > 16777215 {
+		return errors.New("configId not valid: " + strconv.Itoa(rootDevice.ConfigId))
+	}
+
+	return rootDevice.Device.validate()
+}
+
+func (device Device) validate() error {
+	if !strings.HasPrefix(device.DeviceType, "urn:") || !strings.Contains(device.DeviceType, ":device:") {
+		return errors.New("deviceType not valid: " + device.DeviceType)
+	}
+	if !strings.HasPrefix(device.UDN, "uuid:") {
+		return errors.New("UDN not valid: " + device.UDN)
+	}
+
+	// Presence and length limit (exclusive) of the human readable fields
+	fields := []struct {
+		name      string
+		value     string
+		required  bool
+		maxLength int
+	}{
+		{"friendlyName", device.FriendlyName, true, 64},
+		{"manufacturer", device.Manufacturer, true, 64},
+		{"modelDescription", device.ModelDescription, false, 128},
+		{"modelName", device.ModelName, true, 32},
+		{"modelNumber", device.ModelNumber, false, 32},
+		{"serialNumber", device.SerialNumber, false, 64},
+	}
+	for _, field := range fields {
+		if field.required && len(field.value) == 0 {
+			return errors.New(field.name + " not present in " + device.UDN)
+		}
+		if utf8.RuneCountInString(field.value) >= field.maxLength {
+			return errors.New(field.name + " of " + device.UDN + " not shorter than " + strconv.Itoa(field.maxLength) + " characters")
+		}
+	}
+
+	if len(device.UPC) > 0 && (len(device.UPC) != 12 || !isDecimal(device.UPC)) {
+		return errors.New("UPC of " + device.UDN + " not a 12-digit code: " + device.UPC)
+	}
+
+	for _, icon := range device.IconList {
+		if len(icon.Mimetype) == 0 || len(icon.Url) == 0 || !isDecimal(icon.Width) || !isDecimal(icon.Height) || !isDecimal(icon.Depth) {
+			return errors.New("Icon of " + device.UDN + " not valid: " + icon.String())
+		}
+	}
+
+	serviceIds := []string{}
+	for _, service := range device.ServiceList {
+		if !strings.HasPrefix(service.ServiceType, "urn:") || !strings.Contains(service.ServiceType, ":service:") {
+			return errors.New("serviceType not valid: " + service.ServiceType)
+		}
+		if !strings.HasPrefix(service.ServiceId, "urn:") || !strings.Contains(service.ServiceId, ":serviceId:") {
+			return errors.New("serviceId not valid: " + service.ServiceId)
+		}
+		if slices.Contains(serviceIds, service.ServiceId) {
+			return errors.New("serviceId not unique in " + device.UDN + ": " + service.ServiceId)
+		}
+		serviceIds = append(serviceIds, service.ServiceId)
+
+		if len(service.SCPDURL) == 0 || len(service.ControlURL) == 0 || len(service.EventSubURL) == 0 {
+			return errors.New("SCPDURL, controlURL or eventSubURL not present in " + service.ServiceId)
+		}
+
+		err := service.SCPD.Validate()
+		if err != nil {
+			return errors.New("SCPD of " + service.ServiceId + ": " + err.Error())
+		}
+	}
+
+	for _, embeddedDevice := range device.EmbeddedDevices {
+		err := embeddedDevice.validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Checks the service description document against the constraints of the UDA schema (see 2.5)
+func (scpd Scpd) Validate() error {
+	if !isDecimal(scpd.SpecVersion.Major) || !isDecimal(scpd.SpecVersion.Minor) {
+		return errors.New("specVersion not valid: " + scpd.SpecVersion.Major + "." + scpd.SpecVersion.Minor)
+	}
+
+	stateVariableNames := []string{}
+	for _, stateVariable := range scpd.ServiceStateTable {
+		if len(stateVariable.Name) == 0 || utf8.RuneCountInString(stateVariable.Name) >= 32 {
+			return errors.New("State variable name not valid: " + stateVariable.Name)
+		}
+		if slices.Contains(stateVariableNames, stateVariable.Name) {
+			return errors.New("State variable name not unique: " + stateVariable.Name)
+		}
+		stateVariableNames = append(stateVariableNames, stateVariable.Name)
+
+		if !slices.Contains(dataTypes, stateVariable.DataType) {
+			return errors.New("dataType of " + stateVariable.Name + " not valid: " + stateVariable.DataType)
+		}
+		if len(stateVariable.AllowedValueList) > 0 && stateVariable.DataType != "string" {
+			return errors.New("allowedValueList of " + stateVariable.Name + " only valid for string")
+		}
+		if stateVariable.AllowedValueRange != nil {
+			if len(stateVariable.AllowedValueList) > 0 {
+				return errors.New("Both allowedValueList and allowedValueRange in " + stateVariable.Name)
+			}
+			if !slices.Contains(numericDataTypes, stateVariable.DataType) {
+				return errors.New("allowedValueRange of " + stateVariable.Name + " only valid for numeric data types")
+			}
+			if stateVariable.AllowedValueRange.Minimum > stateVariable.AllowedValueRange.Maximum || stateVariable.AllowedValueRange.Step < 0 {
+				return errors.New("allowedValueRange of " + stateVariable.Name + " not valid")
+			}
+		}
+		if stateVariable.MaximumRate < 0 {
+			return errors.New("maximumRate of " + stateVariable.Name + " not valid")
+		}
+		if stateVariable.MinimumDelta < 0 || (stateVariable.MinimumDelta > 0 && !slices.Contains(numericDataTypes, stateVariable.DataType)) {
+			return errors.New("minimumDelta of " + stateVariable.Name + " only valid for numeric data types")
+		}
+	}
+
+	actionNames := []string{}
+	for _, action := range scpd.actionList {
+		if len(action.Name) == 0 || utf8.RuneCountInString(action.Name) >= 32 {
+			return errors.New("Action name not valid: " + action.Name)
+		}
+		if slices.Contains(actionNames, action.Name) {
+			return errors.New("Action name not unique: " + action.Name)
+		}
+		actionNames = append(actionNames, action.Name)
+
+		// The in-arguments are listed before the out-arguments
+		flagOutArgument := false
+		for _, argument := range action.ArgumentList {
+			if len(argument.Name) == 0 {
+				return errors.New("Argument without name in " + action.Name)
+			}
+			if argument.Direction != In && argument.Direction != Out {
+				return errors.New("Direction of " + action.Name + "." + argument.Name + " not valid")
+			}
+			if argument.Direction == In && flagOutArgument {
+				return errors.New("In-argument " + action.Name + "." + argument.Name + " after out-arguments")
+			}
+			// Only the first out-argument can be the return value
+			if argument.Retval && (argument.Direction != Out || flagOutArgument) {
+				return errors.New("retval of " + action.Name + "." + argument.Name + " not valid")
+			}
+			flagOutArgument = flagOutArgument || argument.Direction == Out
+
+			if argument.RelatedStateVariable == nil || !slices.Contains(stateVariableNames, argument.RelatedStateVariable.Name) {
+				return errors.New("relatedStateVariable of " + action.Name + "." + argument.Name + " not in the serviceStateTable")
+			}
+		}
+	}
+
+	return nil
+}
+
+func isDecimal(value string) bool {
+	_, err := strconv.ParseUint(value, 10, 64)
+	return err == nil
+}
+
+// Parses a device description document (see 2.3).
+// The SCPD of the services is not part of the document: see FetchRootDevice
+func ParseRootDevice(reader io.Reader) (RootDevice, error) {
+	root := xmlRoot{}
+	err := xml.NewDecoder(reader).Decode(&root)
+	if err != nil {
+		return RootDevice{}, err
+	}
+
+	if len(root.SpecVersion.Major) == 0 {
+		return RootDevice{}, errors.New("specVersion not present")
+	}
+
+	configId := 0
+	if len(root.ConfigId) > 0 {
+		configId, err = strconv.Atoi(strings.TrimSpace(root.ConfigId))
+		if err != nil {
+			return RootDevice{}, errors.New("configId not valid: " + root.ConfigId)
+		}
+	}
+
+	device, err := parseDevice(root.Device)
+	if err != nil {
+		return RootDevice{}, err
+	}
+
+	return RootDevice{
+		SpecVersion: parseSpecVersion(root.SpecVersion),
+		URLBase:     strings.TrimSpace(root.URLBase),
+		Device:      device,
+		ConfigId:    configId,
+	}, nil
+}
+
+func parseSpecVersion(xmlSpecVersion xmlSpecVersion) SpecVersion {
+	return SpecVersion{
+		Major: strings.TrimSpace(xmlSpecVersion.Major),
+		Minor: strings.TrimSpace(xmlSpecVersion.Minor),
+	}
+}
+
+func parseDevice(xmlDevice xmlDevice) (Device, error) {
+	if len(xmlDevice.DeviceType) == 0 {
+		return Device{}, errors.New("deviceType not present")
+	}
+	if len(xmlDevice.UDN) == 0 {
+		return Device{}, errors.New("UDN not present in " + xmlDevice.DeviceType)
+	}
+
+	icons := []Icon{}
+	for _, icon := range xmlDevice.IconList.items() {
+		icons = append(icons, Icon{
+			Mimetype: strings.TrimSpace(icon.Mimetype),
+			Height:   strings.TrimSpace(icon.Height),
+			Width:    strings.TrimSpace(icon.Width),
+			Depth:    strings.TrimSpace(icon.Depth),
+			Url:      strings.TrimSpace(icon.Url),
+		})
+	}
+
+	services := []Service{}
+	for _, service := range xmlDevice.ServiceList.items() {
+		if len(service.ServiceType) == 0 || len(service.ServiceId) == 0 {
+			return Device{}, errors.New("serviceType or serviceId not present in " + xmlDevice.UDN)
+		}
+		if len(service.SCPDURL) == 0 || len(service.ControlURL) == 0 || len(service.EventSubURL) == 0 {
+			return Device{}, errors.New("SCPDURL, controlURL or eventSubURL not present in " + service.ServiceId)
+		}
+
+		services = append(services, Service{
+			ServiceType: strings.TrimSpace(service.ServiceType),
+			ServiceId:   strings.TrimSpace(service.ServiceId),
+			SCPDURL:     strings.TrimSpace(service.SCPDURL),
+			EventSubURL: strings.TrimSpace(service.EventSubURL),
+			ControlURL:  strings.TrimSpace(service.ControlURL),
+		})
+	}
+
+	embeddedDevices := []Device{}
+	for _, embeddedDevice := range xmlDevice.DeviceList.items() {
+		device, err := parseDevice(embeddedDevice)
+		if err != nil {
+			return Device{}, err
+		}
+		embeddedDevices = append(embeddedDevices, device)
+	}
+
+	return Device{
+		DeviceType:       strings.TrimSpace(xmlDevice.DeviceType),
+		UDN:              strings.TrimSpace(xmlDevice.UDN),
+		FriendlyName:     xmlDevice.FriendlyName,
+		Manufacturer:     xmlDevice.Manufacturer,
+		ManufacturerURL:  xmlDevice.ManufacturerURL,
+		ModelName:        xmlDevice.ModelName,
+		ModelURL:         xmlDevice.ModelURL,
+		ModelDescription: xmlDevice.ModelDescription,
+		ModelNumber:      xmlDevice.ModelNumber,
+		SerialNumber:     xmlDevice.SerialNumber,
+		UPC:              xmlDevice.UPC,
+		PresentationURL:  strings.TrimSpace(xmlDevice.PresentationURL),
+		IconList:         icons,
+		ServiceList:      services,
+		EmbeddedDevices:  embeddedDevices,
+	}, nil
+}
+
+// Parses a service description document (see 2.5)
+func ParseScpd(reader io.Reader) (Scpd, error) {
+	xmlScpd := xmlScpd{}
+	err := xml.NewDecoder(reader).Decode(&xmlScpd)
+	if err != nil {
+		return Scpd{}, err
+	}
+
+	result := Scpd{
+		SpecVersion:       parseSpecVersion(xmlScpd.SpecVersion),
+		ServiceStateTable: []*StateVariable{},
+	}
+
+	for _, xmlStateVariable := range xmlScpd.ServiceStateTable.items() {
+		stateVariable, err := parseStateVariable(xmlStateVariable)
+		if err != nil {
+			return Scpd{}, err
+		}
+		result.ServiceStateTable = append(result.ServiceStateTable, stateVariable)
+	}
+
+	for _, xmlAction := range xmlScpd.ActionList.items() {
+		action, err := parseAction(xmlAction, result.ServiceStateTable)
+		if err != nil {
+			return Scpd{}, err
+		}
+		result.AddAction(action)
+	}
+
+	return result, nil
+}
+
+// sendEvents defaults to "yes", multicast to "no" (see 2.5)
+func parseStateVariable(xmlStateVariable xmlStateVariable) (*StateVariable, error) {
+	if len(xmlStateVariable.Name) == 0 {
+		return nil, errors.New("State variable without name")
+	}
+	if len(xmlStateVariable.DataType) == 0 {
+		return nil, errors.New("dataType not present in " + xmlStateVariable.Name)
+	}
+
+	result := &StateVariable{
+		SendEvents:       strings.TrimSpace(xmlStateVariable.SendEvents) != "no",
+		Multicast:        strings.TrimSpace(xmlStateVariable.Multicast) == "yes",
+		Name:             strings.TrimSpace(xmlStateVariable.Name),
+		DataType:         strings.TrimSpace(xmlStateVariable.DataType),
+		DefaultValue:     xmlStateVariable.DefaultValue,
+		AllowedValueList: []string{},
+	}
+
+	for _, allowedValue := range xmlStateVariable.AllowedValueList.items() {
+		result.AllowedValueList = append(result.AllowedValueList, allowedValue.Value)
+	}
+
+	if xmlStateVariable.AllowedValueRange != nil {
+		valueRange, err := parseValueRange(*xmlStateVariable.AllowedValueRange)
+		if err != nil {
+			return nil, errors.New("allowedValueRange of " + result.Name + " not valid: " + err.Error())
+		}
+		result.AllowedValueRange = &valueRange
+	}
+
+	if len(strings.TrimSpace(xmlStateVariable.MaximumRate)) > 0 {
+		seconds, err := strconv.ParseFloat(strings.TrimSpace(xmlStateVariable.MaximumRate), 64)
+		if err != nil || seconds < 0 {
+			return nil, errors.New("maximumRate of " + result.Name + " not valid: " + xmlStateVariable.MaximumRate)
+		}
+		result.MaximumRate = time.Duration(seconds * float64(time.Second))
+	}
+
+	if len(strings.TrimSpace(xmlStateVariable.MinimumDelta)) > 0 {
+		delta, err := strconv.ParseFloat(strings.TrimSpace(xmlStateVariable.MinimumDelta), 64)
+		if err != nil || delta < 0 {
+			return nil, errors.New("minimumDelta of " + result.Name + " not valid: " + xmlStateVariable.MinimumDelta)
+		}
+		result.MinimumDelta = delta
+	}
+
+	return result, nil
+}
+
+// The bounds are kept as written, also for the floating point data types (see 2.5)
+func parseValueRange(xmlValueRange xmlAllowedValueRange) (ValueRange, error) {
+	minimum, err := parseValueRangeBound(xmlValueRange.Minimum)
+	if err != nil {
+		return ValueRange{}, err
+	}
+
+	maximum, err := parseValueRangeBound(xmlValueRange.Maximum)
+	if err != nil {
+		return ValueRange{}, err
+	}
+
+	step := 0.0
+	if len(strings.TrimSpace(xmlValueRange.Step)) > 0 {
+		step, err = parseValueRangeBound(xmlValueRange.Step)
+		if err != nil {
+			return ValueRange{}, err
+		}
+	}
+
+	if minimum > maximum {
+		return ValueRange{}, errors.New("minimum greater than maximum")
+	}
+	if step < 0 {
+		return ValueRange{}, errors.New("step negative")
+	}
+
+	return ValueRange{
+		Minimum: minimum,
+		Maximum: maximum,
+		Step:    step,
+	}, nil
+}
+
+func parseValueRangeBound(value string) (float64, error) {
+	result, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil || math.IsNaN(result) || math.IsInf(result, 0) {
+		return 0, errors.New("not a number: " + value)
+	}
+
+	return result, nil
+}
+
+func parseAction(xmlAction xmlAction, serviceStateTable []*StateVariable) (FormalAction, error) {
+	if len(xmlAction.Name) == 0 {
+		return FormalAction{}, errors.New("Action without name")
+	}
+
+	argumentList := []FormalArgument{}
+	for _, xmlArgument := range xmlAction.ArgumentList.items() {
+		var direction FormalArgumentDirection
+		switch strings.TrimSpace(xmlArgument.Direction) {
+		case "in":
+			direction = In
+		case "out":
+			direction = Out
+		default:
+			return FormalAction{}, errors.New("Direction of " + xmlAction.Name + "." + xmlArgument.Name + " not valid: " + xmlArgument.Direction)
+		}
+
+		relatedStateVariableName := strings.TrimSpace(xmlArgument.RelatedStateVariable)
+		var relatedStateVariable *StateVariable
+		for _, stateVariable := range serviceStateTable {
+			if stateVariable.Name == relatedStateVariableName {
+				relatedStateVariable = stateVariable
+				break
+			}
+		}
+		if relatedStateVariable == nil {
+			return FormalAction{}, errors.New("StateVariable not found: " + relatedStateVariableName)
+		}
+
+		argumentList = append(argumentList, FormalArgument{
+			Name:                 strings.TrimSpace(xmlArgument.Name),
+			Direction:            direction,
+			Retval:               xmlArgument.Retval != nil,
+			RelatedStateVariable: relatedStateVariable,
+		})
+	}
+
+	return FormalAction{
+		Name:         strings.TrimSpace(xmlAction.Name),
+		ArgumentList: argumentList,
+	}, nil
+}
+
+// Retrieves the description of the root device at location and the SCPD of all its services.
+// The URLs of the services are resolved against URLBase, if present, otherwise against location (see 2.3)
+// and stored as BaseURL of each service. location is kept as DescriptionURL.
+func FetchRootDevice(ctx context.Context, location string) (RootDevice, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	description, err := retrieve(ctx, location)
+	if err != nil {
+		log.Error("[http] Error while retrieving the description at " + location + ": " + err.Error())
+		return RootDevice{}, err
+	}
+
+	rootDevice, err := ParseRootDevice(strings.NewReader(description))
+	if err != nil {
+		log.Error("[http] Error while parsing the description at " + location + ": " + err.Error())
+		return RootDevice{}, err
+	}
+
+	baseURL := location
+	if len(rootDevice.URLBase) > 0 {
+		baseURL = rootDevice.URLBase
+	}
+
+	rootDevice.Device, err = fetchDeviceScpds(ctx, rootDevice.Device, baseURL)
+	if err != nil {
+		return RootDevice{}, err
+	}
+	rootDevice.DescriptionURL = location
+
+	return rootDevice, nil
+}
+
+func fetchDeviceScpds(ctx context.Context, device Device, baseURL string) (Device, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	for i := range device.ServiceList {
+		service := &device.ServiceList[i]
+		service.BaseURL = baseURL
+
+		scpdURL, err := resolveServiceURL(*service, service.SCPDURL)
+		if err != nil {
+			log.Error("[http] Error while resolving SCPDURL of " + service.ServiceId + ": " + err.Error())
+			return Device{}, err
+		}
+
+		scpd, err := retrieve(ctx, scpdURL.String())
+		if err != nil {
+			log.Error("[http] Error while retrieving the SCPD at " + scpdURL.String() + ": " + err.Error())
+			return Device{}, err
+		}
+
+		service.SCPD, err = ParseScpd(strings.NewReader(scpd))
+		if err != nil {
+			log.Error("[http] Error while parsing the SCPD at " + scpdURL.String() + ": " + err.Error())
+			return Device{}, err
+		}
+	}
+
+	for i := range device.EmbeddedDevices {
+		embeddedDevice, err := fetchDeviceScpds(ctx, device.EmbeddedDevices[i], baseURL)
+		if err != nil {
+			return Device{}, err
+		}
+		device.EmbeddedDevices[i] = embeddedDevice
+	}
+
+	return device, nil
+}
+
+// GETs rawURL through the Transport of ctx
+func retrieve(ctx context.Context, rawURL string) (string, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("USER-AGENT", ClientUserAgent)
+
+	response, err := newHttpClient(ctx, 0).Do(request)
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return "", errors.New("Request failed with status " + response.Status)
+	}
+
+	data, err := io.ReadAll(response.Body)
+	return string(data), err
+}
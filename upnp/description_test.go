@@ -0,0 +1,69 @@
+package upnp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValueRangeRoundTrip(t *testing.T) {
+	scpd := Scpd{
+		SpecVersion: SpecVersion{Major: "1", Minor: "1"},
+		ServiceStateTable: []*StateVariable{
+			{Name: "level", DataType: "ui4", DefaultValue: "0", AllowedValueRange: &ValueRange{Minimum: 0, Maximum: 100}},
+			{Name: "gain", DataType: "r8", DefaultValue: "1", AllowedValueRange: &ValueRange{Minimum: 0.5, Maximum: 1.5, Step: 0.1}},
+		},
+	}
+
+	description := scpd.StringXML(1)
+	if strings.Contains(description, "<step>0</step>") {
+		t.Error("Range without step serialized with step 0")
+	}
+	if !strings.Contains(description, "<minimum>0.5</minimum>") || !strings.Contains(description, "<step>0.1</step>") {
+		t.Error("Fractional bounds not serialized:\n" + description)
+	}
+
+	parsed, err := ParseScpd(strings.NewReader(description))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, stateVariable := range parsed.ServiceStateTable {
+		expected := scpd.ServiceStateTable[i].AllowedValueRange
+		if stateVariable.AllowedValueRange == nil || *stateVariable.AllowedValueRange != *expected {
+			t.Errorf("%s: parsed %v, expected %v", stateVariable.Name, stateVariable.AllowedValueRange, *expected)
+		}
+	}
+}
+
+func TestCoerceValueRange(t *testing.T) {
+	level := &StateVariable{Name: "level", DataType: "ui4", AllowedValueRange: &ValueRange{Minimum: 0, Maximum: 100}}
+	gain := &StateVariable{Name: "gain", DataType: "r8", AllowedValueRange: &ValueRange{Minimum: 0.5, Maximum: 1.5, Step: 0.1}}
+
+	tests := []struct {
+		stateVariable *StateVariable
+		value         string
+		valid         bool
+	}{
+		{level, "0", true},
+		{level, "57", true},
+		{level, "101", false},
+		{gain, "0.5", true},
+		{gain, "0.7", true},
+		{gain, "1.5", true},
+		{gain, "0.75", false},
+		{gain, "0.4", false},
+		{gain, "1.6", false},
+	}
+
+	for _, test := range tests {
+		_, err := coerceValue(test.stateVariable, test.value)
+
+		var upnpError UPnPError
+		switch {
+		case test.valid && err != nil:
+			t.Errorf("%s=%s refused: %s", test.stateVariable.Name, test.value, err)
+		case !test.valid && (!errors.As(err, &upnpError) || upnpError.ErrorCode != errorCodeArgumentValueOutRange):
+			t.Errorf("%s=%s expected out of range, got %v", test.stateVariable.Name, test.value, err)
+		}
+	}
+}
@@ -3,8 +3,8 @@ package upnp
 import (
 	"errors"
 	"slices"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
 )
@@ -127,9 +127,12 @@ import (
 */
 
 type RootDevice struct {
-	SpecVersion SpecVersion
-	URLBase     string // See 2.3: "Use of URLBase is deprecated from UPnP 1.1 onwards; UPnP 2.0 devices shall NOT include URLBase in their description documents."
-	Device      Device
+	SpecVersion    SpecVersion
+	URLBase        string // See 2.3: "Use of URLBase is deprecated from UPnP 1.1 onwards; UPnP 2.0 devices shall NOT include URLBase in their description documents."
+	DescriptionURL string // URL of the description document, advertised as LOCATION (see 1.2.2)
+	Device         Device
+	BootId         int // See 1.2.2 BOOTID.UPNP.ORG: increased each time the device (re)joins the network
+	ConfigId       int // See 1.2.2 CONFIGID.UPNP.ORG: identifies the version of the description documents (0 to 16777215)
 
 	SetStateFunc func(value string) error
 	GetStateFunc func() (string, error)
@@ -168,6 +171,8 @@ type Icon struct {
 	Width    string
 	Depth    string
 	Url      string
+
+	Data []byte // Image served at Url by the device, not part of the description
 }
 
 type Service struct {
@@ -176,10 +181,35 @@ type Service struct {
 	SCPDURL     string
 	EventSubURL string
 	ControlURL  string
+	BaseURL     string // On the control point, the URL the relative URLs of the service are resolved against
+
+	Handler        ActionHandler            // Invoked for the actions without a handler in actionHandlers
+	actionHandlers map[string]ActionHandler // Handlers registered with HandleAction, keyed by action name
+
+	SCPD  Scpd
+	State *StateStore // Current values of the state variables, nil if the device does not keep them
+}
+
+// Executes an action receiving the in-arguments in SCPD order
+type ActionHandler func(...device.Argument) device.Response
 
-	Handler func(...device.Argument) device.Response
+// Registers handler for the action actionName, replacing the Handler of the service for that action
+func (service *Service) HandleAction(actionName string, handler ActionHandler) {
+	if service.actionHandlers == nil {
+		service.actionHandlers = make(map[string]ActionHandler)
+	}
 
-	SCPD Scpd
+	service.actionHandlers[actionName] = handler
+}
+
+// Returns the handler of the action actionName, nil if the service cannot execute it
+func (service Service) actionHandler(actionName string) ActionHandler {
+	handler, isSet := service.actionHandlers[actionName]
+	if isSet {
+		return handler
+	}
+
+	return service.Handler
 }
 
 type Scpd struct {
@@ -225,6 +255,7 @@ type FormalAction struct {
 type FormalArgument struct {
 	Name                 string
 	Direction            FormalArgumentDirection
+	Retval               bool // The out-argument is the return value of the action, only the first out-argument (see 2.5)
 	RelatedStateVariable *StateVariable
 }
 
@@ -254,12 +285,16 @@ type StateVariable struct {
 	DefaultValue      string
 	AllowedValueRange *ValueRange
 	AllowedValueList  []string
+	MaximumRate       time.Duration // Minimum time between two events of the variable, 0 if not moderated (see 4.3)
+	MinimumDelta      float64       // Smallest change of a numeric variable evented, 0 if not moderated (see 4.3)
+
+	MulticastLevel GenaMulticastEventLevels // Level of the multicast event messages, not part of the description (General if empty)
 }
 
 type ValueRange struct {
-	Minimum int
-	Maximum int
-	Step    int
+	Minimum float64
+	Maximum float64
+	Step    float64 // 0 if not specified
 }
 
 type SerializableXML interface {
@@ -268,203 +303,53 @@ type SerializableXML interface {
 
 // Generates a string compatible with the specifications (see 2.3)
 func (rootDevice RootDevice) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<root xmlns=\"urn:schemas-upnp-org:device-1-0\" configId=\"1\">\n")
-	result.WriteString(rootDevice.SpecVersion.StringXML())
-
-	result.WriteString(rootDevice.Device.StringXML())
-
-	result.WriteString("</root>\n")
-
-	return result.String()
+	return marshalXML(xmlRootOf(rootDevice), true)
 }
 
 // Generates a string compatible with the specifications (see 2.3)
 func (specVersion SpecVersion) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<specVersion>\n")
-	result.WriteString("<major>" + specVersion.Major + "</major>\n")
-	result.WriteString("<minor>" + specVersion.Minor + "</minor>\n")
-	result.WriteString("</specVersion>\n")
-
-	return result.String()
+	return marshalXML(xmlSpecVersionOf(specVersion), false)
 }
 
 // Generates a string compatible with the specifications (see 2.3)
 func (device Device) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<device>\n")
-	result.WriteString("<deviceType>" + device.DeviceType + "</deviceType>\n")
-	result.WriteString("<UDN>" + device.UDN + "</UDN>\n")
-	result.WriteString("<friendlyName>" + device.FriendlyName + "</friendlyName>\n")
-	result.WriteString("<manufacturer>" + device.Manufacturer + "</manufacturer>\n")
-	result.WriteString("<manufacturerURL>" + device.ManufacturerURL + "</manufacturerURL>\n")
-	result.WriteString("<modelName>" + device.ModelName + "</modelName>\n")
-	result.WriteString("<modelURL>" + device.ModelURL + "</modelURL>\n")
-	result.WriteString("<modelDescription>" + device.ModelDescription + "</modelDescription>\n")
-	result.WriteString("<modelNumber>" + device.ModelNumber + "</modelNumber>\n")
-	result.WriteString("<serialNumber>" + device.SerialNumber + "</serialNumber>\n")
-	result.WriteString("<UPC>" + device.UPC + "</UPC>\n")
-	result.WriteString("<presentationURL>" + device.PresentationURL + "</presentationURL>\n")
-
-	result.WriteString("<iconList>\n")
-	for _, icon := range device.IconList {
-		result.WriteString(icon.StringXML())
-	}
-	result.WriteString("</iconList>\n")
-
-	result.WriteString("<serviceList>\n")
-	for _, service := range device.ServiceList {
-		result.WriteString(service.StringXML())
-	}
-	result.WriteString("</serviceList>\n")
-
-	if len(device.EmbeddedDevices) > 0 {
-		result.WriteString("<deviceList>\n")
-		for _, embeddedDevice := range device.EmbeddedDevices {
-			result.WriteString(embeddedDevice.StringXML())
-		}
-		result.WriteString("</deviceList>\n")
-	}
-
-	result.WriteString("</device>\n")
-
-	return result.String()
+	return marshalXML(xmlDeviceOf(device), false)
 }
 
 // Generates a string compatible with the specifications (see 2.3)
 func (icon Icon) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<icon>\n")
-	result.WriteString("<mimetype>" + icon.Mimetype + "</mimetype>\n")
-	result.WriteString("<height>" + icon.Height + "</height>\n")
-	result.WriteString("<width>" + icon.Width + "</width>\n")
-	result.WriteString("<depth>" + icon.Depth + "</depth>\n")
-	result.WriteString("<url>" + icon.Url + "</url>\n")
-	result.WriteString("</icon>\n")
-
-	return result.String()
+	return marshalXML(xmlIconOf(icon), false)
 }
 
 // Generates a string compatible with the specifications (see 2.3)
 func (service Service) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<service>\n")
-	result.WriteString("<serviceType>" + service.ServiceType + "</serviceType>\n")
-	result.WriteString("<serviceId>" + service.ServiceId + "</serviceId>\n")
-	result.WriteString("<SCPDURL>" + service.SCPDURL + "</SCPDURL>\n")
-	result.WriteString("<eventSubURL>" + service.EventSubURL + "</eventSubURL>\n")
-	result.WriteString("<controlURL>" + service.ControlURL + "</controlURL>\n")
-	result.WriteString("</service>\n")
-
-	return result.String()
+	return marshalXML(xmlServiceOf(service), false)
 }
 
-func (scpd Scpd) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<?xml version=\"1.0\"?>\n")
-	result.WriteString("<scpd xmlns=\"urn:schemas-upnp-org:service-1-0\" configId=\"1\">\n")
-
-	result.WriteString(scpd.SpecVersion.StringXML())
-
-	result.WriteString("<actionList>\n")
-
-	for _, action := range scpd.actionList {
-		result.WriteString(action.StringXML())
-	}
-	result.WriteString("</actionList>\n")
-
-	result.WriteString("<serviceStateTable>\n")
-	for _, stateVariable := range scpd.ServiceStateTable {
-		result.WriteString(stateVariable.StringXML())
-	}
-	result.WriteString("</serviceStateTable>\n")
-
-	result.WriteString("</scpd>\n")
-
-	return result.String()
+// Generates a string compatible with the specifications (see 2.5), configId is
+// the CONFIGID.UPNP.ORG of the root device the service belongs to
+func (scpd Scpd) StringXML(configId int) string {
+	return marshalXML(xmlScpdOf(scpd, configId), true)
 }
 
+// Generates a string compatible with the specifications (see 2.5)
 func (action FormalAction) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<action>\n")
-	result.WriteString("<name>" + action.Name + "</name>\n")
-
-	result.WriteString("<argumentList>\n")
-	for _, argument := range action.ArgumentList {
-		result.WriteString(argument.StringXML())
-	}
-	result.WriteString("</argumentList>\n")
-
-	result.WriteString("</action>\n")
-
-	return result.String()
+	return marshalXML(xmlActionOf(action), false)
 }
 
+// Generates a string compatible with the specifications (see 2.5)
 func (argument FormalArgument) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<argument>\n")
-	result.WriteString("<name>" + argument.Name + "</name>\n")
-	result.WriteString("<direction>" + argument.Direction.String() + "</direction>\n")
-	result.WriteString("<relatedStateVariable>" + argument.RelatedStateVariable.Name + "</relatedStateVariable>\n")
-	result.WriteString("</argument>\n")
-
-	return result.String()
+	return marshalXML(xmlArgumentOf(argument), false)
 }
 
+// Generates a string compatible with the specifications (see 2.5)
 func (stateVariable StateVariable) StringXML() string {
-	var result strings.Builder
-
-	sendEvents := ""
-	if stateVariable.SendEvents {
-		sendEvents = "yes"
-	} else {
-		sendEvents = "no"
-	}
-	multicast := ""
-	if stateVariable.Multicast {
-		multicast = "yes"
-	} else {
-		multicast = "no"
-	}
-	result.WriteString("<stateVariable sendEvents=\"" + sendEvents + "\" multicast=\"" + multicast + "\">\n")
-	result.WriteString("<name>" + stateVariable.Name + "</name>\n")
-	result.WriteString("<dataType>" + stateVariable.DataType + "</dataType>\n")
-
-	if stateVariable.AllowedValueRange != nil {
-		result.WriteString(stateVariable.AllowedValueRange.StringXML())
-	}
-	if len(stateVariable.AllowedValueList) > 0 {
-		result.WriteString("<allowedValueList>\n")
-		for _, value := range stateVariable.AllowedValueList {
-			result.WriteString(value)
-		}
-		result.WriteString("</allowedValueList>\n")
-	}
-
-	result.WriteString("</stateVariable>\n")
-
-	return result.String()
+	return marshalXML(xmlStateVariableOf(stateVariable), false)
 }
 
+// Generates a string compatible with the specifications (see 2.5)
 func (valueRange ValueRange) StringXML() string {
-	var result strings.Builder
-
-	result.WriteString("<allowedValueRange>\n")
-	result.WriteString("<minimum>" + strconv.Itoa(valueRange.Minimum) + "</minimum>\n")
-	result.WriteString("<maximum>" + strconv.Itoa(valueRange.Maximum) + "</maximum>\n")
-	result.WriteString("<step>" + strconv.Itoa(valueRange.Step) + "</step>\n")
-	result.WriteString("</allowedValueRange>\n")
-
-	return result.String()
+	return marshalXML(xmlAllowedValueRangeOf(valueRange), false)
 }
 
 func (rootDevice RootDevice) String() string {
@@ -479,6 +364,10 @@ func (rootDevice RootDevice) String() string {
 		result.WriteString("\n")
 	}
 
+	if len(rootDevice.DescriptionURL) > 0 {
+		result.WriteString("\tDescriptionURL: " + rootDevice.DescriptionURL + "\n")
+	}
+
 	result.WriteString("\t" + strings.ReplaceAll(rootDevice.Device.String(), "\n", "\n\t"))
 
 	return result.String()
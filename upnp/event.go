@@ -0,0 +1,437 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"io"
+	"maps"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+const (
+	genaMaxSeq                   = 4294967295 // After this value SEQ wraps to 1 (see 4.3.2)
+	genaSidWaitSeconds           = 3          // Maximum wait for the SID of an event received before the SUBSCRIBE response
+	genaMaxEventMessageBytes     = 1 << 20    // Longest event message accepted
+	genaMaxMulticastMessageBytes = 65507      // Longest multicast event message received, the payload of a UDP datagram
+)
+
+// Event message received by a subscriber (see 4.3.2)
+type Event struct {
+	SID        string
+	Seq        int
+	Properties map[string]string // New value of each state variable, by name
+	ReceivedAt time.Time
+}
+
+func (event Event) String() string {
+	var result strings.Builder
+
+	result.WriteString("SID: " + event.SID + " SEQ: " + strconv.Itoa(event.Seq))
+	for _, name := range slices.Sorted(maps.Keys(event.Properties)) {
+		result.WriteString(" " + name + "=" + event.Properties[name])
+	}
+
+	return result.String()
+}
+
+// Body of an event message as received, the namespace is not checked
+type xmlEventPropertySet struct {
+	XMLName    xml.Name `xml:"propertyset"`
+	Properties []struct {
+		Variables []ActualArgumentName `xml:",any"`
+	} `xml:"property"`
+}
+
+// HTTP server receiving the event messages of a subscription at its CALLBACK URL
+type genaEventListener struct {
+	ctx      context.Context
+	handler  func(Event)
+	sid      string
+	sidReady chan struct{}
+	sequence eventSequence
+}
+
+// Starts the HTTP server receiving the event messages until ctx is done, handler receives them in SEQ order
+func newGenaEventListener(ctx context.Context, handler func(Event)) (*genaEventListener, *net.TCPAddr, error) {
+	result := &genaEventListener{
+		ctx:      ctx,
+		handler:  handler,
+		sidReady: make(chan struct{}),
+	}
+
+	addr, err := serveEventMessages(ctx, http.HandlerFunc(result.notifyHandler))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return result, addr, nil
+}
+
+// Serves the event messages with handler until ctx is done
+func serveEventMessages(ctx context.Context, handler http.Handler) (*net.TCPAddr, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	listener, err := getTransport(ctx).Listen("tcp", ":0") // Both IPv4 and IPv6
+	if err != nil {
+		log.Error("[gena] Error while listening for events: " + err.Error())
+		return nil, err
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+	go func() {
+		err := server.Serve(listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("[gena] Error while serving events: " + err.Error())
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr), nil
+}
+
+// Sets the SID of the subscription, the event messages received before are held until then
+func (listener *genaEventListener) setSid(sid string) {
+	listener.sid = sid
+	close(listener.sidReady)
+}
+
+// Handles a NOTIFY, the response codes follow 4.3.2
+func (listener *genaEventListener) notifyHandler(response http.ResponseWriter, request *http.Request) {
+	log := listener.ctx.Value("logger").(logging.Logger)
+
+	event, status := readEventMessage(listener.ctx, request)
+	if status != http.StatusOK {
+		response.WriteHeader(status)
+		return
+	}
+
+	select {
+	case <-listener.sidReady:
+	case <-listener.ctx.Done():
+		response.WriteHeader(http.StatusPreconditionFailed)
+		return
+	case <-time.After(genaSidWaitSeconds * time.Second):
+		log.Warn("[gena] Received event from " + request.RemoteAddr + " for a subscription without SID")
+		response.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	if event.SID != listener.sid {
+		log.Warn("[gena] Received event from " + request.RemoteAddr + " with unknown SID: " + event.SID)
+		response.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	acceptEventMessage(response)
+
+	log.Debug("[gena] Received event from " + request.RemoteAddr + " " + event.String())
+
+	listener.sequence.deliver(listener.ctx, event, listener.handler)
+}
+
+// Reads the event message of a NOTIFY, returns the response code for the ones not valid (see 4.3.2)
+func readEventMessage(ctx context.Context, request *http.Request) (Event, int) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	if request.Method != "NOTIFY" {
+		return Event{}, http.StatusMethodNotAllowed
+	}
+
+	nt := request.Header.Get("NT")
+	nts := request.Header.Get("NTS")
+	if len(nt) == 0 || len(nts) == 0 {
+		log.Warn("[gena] Received event from " + request.RemoteAddr + " without NT or NTS")
+		return Event{}, http.StatusBadRequest
+	}
+	if nt != "upnp:event" || nts != "upnp:propchange" {
+		log.Warn("[gena] Received event from " + request.RemoteAddr + " with NT or NTS not valid: " + nt + " " + nts)
+		return Event{}, http.StatusPreconditionFailed
+	}
+
+	seq, err := strconv.Atoi(request.Header.Get("SEQ"))
+	if err != nil || seq < 0 || seq > genaMaxSeq {
+		log.Warn("[gena] Received event from " + request.RemoteAddr + " with SEQ not valid: " + request.Header.Get("SEQ"))
+		return Event{}, http.StatusBadRequest
+	}
+
+	event, err := parseEvent(io.LimitReader(request.Body, genaMaxEventMessageBytes))
+	if err != nil {
+		log.Warn("[gena] Received event from " + request.RemoteAddr + " with body not valid: " + err.Error())
+		return Event{}, http.StatusBadRequest
+	}
+	event.SID = request.Header.Get("SID")
+	event.Seq = seq
+	event.ReceivedAt = time.Now()
+
+	return event, http.StatusOK
+}
+
+// Answers 200 OK before the event message is handled: the device is not held by a slow handler
+func acceptEventMessage(response http.ResponseWriter) {
+	response.WriteHeader(http.StatusOK)
+	if flusher, isFlusher := response.(http.Flusher); isFlusher {
+		flusher.Flush()
+	}
+}
+
+// SEQ expected for the next event message of a subscription
+type eventSequence struct {
+	mutex   sync.Mutex
+	sid     string // If set, the event messages of other SIDs are discarded (e.g. the ones of a subscription lost)
+	nextSeq int
+}
+
+// Passes event to handler unless it is a duplicate, the gaps in SEQ are reported as lost events.
+// The handlers of the event messages of a subscription are called one at a time in SEQ order.
+func (sequence *eventSequence) deliver(ctx context.Context, event Event, handler func(Event)) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	sequence.mutex.Lock()
+	defer sequence.mutex.Unlock()
+
+	if len(sequence.sid) > 0 && event.SID != sequence.sid {
+		log.Debug("[gena] Discarded event of a previous subscription, SID: " + event.SID)
+		return
+	}
+
+	// SEQ 0 is only used by the initial event: after the wrap SEQ restarts from 1.
+	// A new initial event after other events means the device restored the subscription with a new event key.
+	if event.Seq == 0 && sequence.nextSeq > 1 {
+		log.Info("[gena] Event key reset by the device, SID: " + event.SID)
+		sequence.nextSeq = 0
+	}
+	if event.Seq < sequence.nextSeq || (event.Seq == 0 && sequence.nextSeq != 0) {
+		log.Warn("[gena] Discarded duplicate event, SID: " + event.SID + " SEQ: " + strconv.Itoa(event.Seq))
+		return
+	}
+	if event.Seq > sequence.nextSeq {
+		log.Warn("[gena] Lost " + strconv.Itoa(event.Seq-sequence.nextSeq) + " events, SID: " + event.SID + " SEQ: " + strconv.Itoa(event.Seq))
+	}
+
+	sequence.nextSeq = event.Seq + 1
+	if event.Seq == genaMaxSeq {
+		sequence.nextSeq = 1
+	}
+
+	handler(event)
+}
+
+// Expects the initial event of the new subscription sid
+func (sequence *eventSequence) restart(sid string) {
+	sequence.mutex.Lock()
+	sequence.sid = sid
+	sequence.nextSeq = 0
+	sequence.mutex.Unlock()
+}
+
+// Parses the propertyset body of an event message (see 4.3.2)
+func parseEvent(reader io.Reader) (Event, error) {
+	propertySet := xmlEventPropertySet{}
+	err := xml.NewDecoder(reader).Decode(&propertySet)
+	if err != nil {
+		return Event{}, err
+	}
+
+	result := Event{
+		Properties: make(map[string]string),
+	}
+	for _, property := range propertySet.Properties {
+		for _, variable := range property.Variables {
+			result.Properties[variable.XMLName.Local] = variable.Value
+		}
+	}
+
+	return result, nil
+}
+
+// Multicast event message received by a control point (see 4.3.3)
+type MulticastEvent struct {
+	USN        string
+	SVCID      string
+	BootId     int // Value of BOOTID.UPNP.ORG, -1 if not present
+	Level      GenaMulticastEventLevels
+	Seq        int
+	Properties map[string]string // New value of each state variable, by name
+	ReceivedAt time.Time
+}
+
+func (event MulticastEvent) String() string {
+	var result strings.Builder
+
+	result.WriteString("USN: " + event.USN + " SVCID: " + event.SVCID + " BOOTID: " + strconv.Itoa(event.BootId) + " LVL: " + event.Level.String() + " SEQ: " + strconv.Itoa(event.Seq))
+	for _, name := range slices.Sorted(maps.Keys(event.Properties)) {
+		result.WriteString(" " + name + "=" + event.Properties[name])
+	}
+
+	return result.String()
+}
+
+// Receives the multicast event messages of a service at the GENA multicast address
+type genaMulticastListener struct {
+	ctx       context.Context
+	usn       string
+	serviceId string
+	levels    []GenaMulticastEventLevels
+	handler   func(MulticastEvent)
+
+	mutex   sync.Mutex // The event messages are received on each interface
+	bootId  int
+	nextSeq int
+	started bool // A control point may join at any SEQ: the first event message received sets nextSeq
+}
+
+func newGenaMulticastListener(ctx context.Context, usn string, serviceId string, levels []GenaMulticastEventLevels, handler func(MulticastEvent)) *genaMulticastListener {
+	return &genaMulticastListener{
+		ctx:       ctx,
+		usn:       usn,
+		serviceId: serviceId,
+		levels:    levels,
+		handler:   handler,
+	}
+}
+
+func (listener *genaMulticastListener) listenDaemon(conn UDPConn) {
+	go func() {
+		<-listener.ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		log := listener.ctx.Value("logger").(logging.Logger)
+
+		defer conn.Close()
+
+		messageBuffer := make([]byte, genaMaxMulticastMessageBytes)
+		for {
+			n, source, _, err := conn.ReadFrom(messageBuffer)
+			if err != nil {
+				if listener.ctx.Err() != nil {
+					log.Info("[gena] Stop listening for multicast events of " + listener.usn)
+					return
+				}
+				log.Error("[gena] Error while receiving a multicast event")
+				continue
+			}
+
+			event, err := parseMulticastEvent(string(messageBuffer[:n]))
+			if err != nil {
+				log.Warn("[gena] Received malformed multicast event from " + source.String() + ": " + err.Error())
+				continue
+			}
+			if event.USN != listener.usn || event.SVCID != listener.serviceId {
+				continue
+			}
+			event.ReceivedAt = time.Now()
+
+			log.Debug("[gena] Received multicast event from " + source.String() + " " + event.String())
+
+			listener.deliver(event)
+		}
+	}()
+}
+
+// Passes event to the handler unless it is a duplicate or its level is filtered out.
+// The SEQ is shared by all the levels of the service: the gaps are reported before filtering.
+// After the device rebooted, with a new BOOTID.UPNP.ORG, its SEQ restarts.
+func (listener *genaMulticastListener) deliver(event MulticastEvent) {
+	log := listener.ctx.Value("logger").(logging.Logger)
+
+	listener.mutex.Lock()
+	defer listener.mutex.Unlock()
+
+	if listener.started && event.BootId != listener.bootId {
+		log.Info("[gena] Multicast events of " + event.USN + " with new BOOTID.UPNP.ORG: " + strconv.Itoa(event.BootId))
+		listener.started = false
+	}
+	if listener.started {
+		if event.Seq < listener.nextSeq || (event.Seq == 0 && listener.nextSeq != 0) {
+			log.Debug("[gena] Discarded duplicate multicast event, USN: " + event.USN + " SEQ: " + strconv.Itoa(event.Seq))
+			return
+		}
+		if event.Seq > listener.nextSeq {
+			log.Warn("[gena] Lost " + strconv.Itoa(event.Seq-listener.nextSeq) + " multicast events, USN: " + event.USN + " SEQ: " + strconv.Itoa(event.Seq))
+		}
+	}
+
+	listener.started = true
+	listener.bootId = event.BootId
+	listener.nextSeq = event.Seq + 1
+	if event.Seq == genaMaxSeq {
+		listener.nextSeq = 1
+	}
+
+	if len(listener.levels) > 0 && !slices.Contains(listener.levels, event.Level) {
+		return
+	}
+
+	listener.handler(event)
+}
+
+// Parses a multicast event message, the propertyset body follows the headers (see 4.3.3)
+func parseMulticastEvent(message string) (MulticastEvent, error) {
+	header, body, found := strings.Cut(message, "\r\n\r\n")
+	if !found || !strings.HasPrefix(header, "NOTIFY") {
+		return MulticastEvent{}, errors.New("NOTIFY not valid")
+	}
+
+	nt, _ := FindHeader(header, "NT")
+	nts, _ := FindHeader(header, "NTS")
+	if nt != "upnp:event" || nts != "upnp:propchange" {
+		return MulticastEvent{}, errors.New("NT or NTS not valid: " + nt + " " + nts)
+	}
+
+	usn, find := FindHeader(header, "USN")
+	if !find {
+		return MulticastEvent{}, errors.New("USN not present")
+	}
+
+	serviceId, find := FindHeader(header, "SVCID")
+	if !find {
+		return MulticastEvent{}, errors.New("SVCID not present")
+	}
+
+	level, find := FindHeader(header, "LVL")
+	if !find {
+		return MulticastEvent{}, errors.New("LVL not present")
+	}
+
+	rawSeq, _ := FindHeader(header, "SEQ")
+	seq, err := strconv.Atoi(rawSeq)
+	if err != nil || seq < 0 || seq > genaMaxSeq {
+		return MulticastEvent{}, errors.New("SEQ not valid: " + rawSeq)
+	}
+
+	bootId := -1
+	if rawBootId, find := FindHeader(header, "BOOTID.UPNP.ORG"); find {
+		bootId, err = strconv.Atoi(rawBootId)
+		if err != nil || bootId < 0 {
+			return MulticastEvent{}, errors.New("BOOTID.UPNP.ORG not valid: " + rawBootId)
+		}
+	}
+
+	event, err := parseEvent(strings.NewReader(body))
+	if err != nil {
+		return MulticastEvent{}, err
+	}
+
+	return MulticastEvent{
+		USN:        usn,
+		SVCID:      serviceId,
+		BootId:     bootId,
+		Level:      GenaMulticastEventLevels(level),
+		Seq:        seq,
+		Properties: event.Properties,
+	}, nil
+}
@@ -2,8 +2,9 @@ package upnp
 
 import (
 	"context"
+	"encoding/xml"
 	"errors"
-	"fmt"
+	"maps"
 	"net"
 	"net/http"
 	"net/url"
@@ -19,11 +20,20 @@ import (
 )
 
 const (
-	genaSubscriptionTimeoutSeconds   = 1800
+	genaSubscriptionTimeoutSeconds   = 1800 // Duration requested by the control point and granted at most by the device (see 4.1.1)
+	genaExpirationCheckSeconds       = 1    // Seconds between two checks of the expired subscriptions
+	genaRenewalMarginSeconds         = 60   // Seconds before the expiration the control point renews a subscription
+	genaInfiniteTimeout              = -1   // Duration of a subscription requested as Second-infinite
 	genaMulticastNotificationAddress = "239.255.255.246"
 	genaMulticastNotificationPort    = 7900
+
+	genaMulticastNotificationAddressIPv6LinkLocal = "FF02::130"
+	genaMulticastNotificationAddressIPv6SiteLocal = "FF05::130"
 )
 
+// Returned while the GenaState shuts down: the subscription messages are refused
+var errShuttingDown = errors.New("Shutting down")
+
 type GenaMulticastEventLevels string
 
 const (
@@ -66,8 +76,13 @@ type subscriptionRequest struct {
 func (request subscriptionRequest) String() string {
 	var result strings.Builder
 
+	if len(request.sid) > 0 {
+		result.WriteString("SID: " + request.sid + "\n")
+	}
 	result.WriteString("USER-AGENT: " + request.userAgent + "\n")
-	result.WriteString("CALLBACK: " + request.callback.String() + "\n")
+	if request.callback != nil {
+		result.WriteString("CALLBACK: " + request.callback.String() + "\n")
+	}
 	result.WriteString("NT: " + request.nt + "\n")
 	result.WriteString("TIMEOUT: " + strconv.Itoa(request.timeout) + "\n")
 	result.WriteString("STATEVAR: [" + utils.StringToCSV(request.statevar) + "]")
@@ -77,19 +92,20 @@ func (request subscriptionRequest) String() string {
 
 // See 4.1.1
 type subscriber struct {
-	eventKey             int
 	httpSuppertedVersion string
 	userAgent            string
 }
 
 type subscription struct {
-	sid        int64
+	sid        string // uuid: followed by a UUID (see 4.1.1)
 	subscriber subscriber
 	service    Service
 	stateVar   []string
 	creation   time.Time
+	expiration time.Time // Last renewal plus the granted timeout
 	timeout    int
 	callback   *url.URL
+	queue      *deliveryQueue // Shared by the copies of the subscription, it owns the event key (see 4.3.2)
 }
 
 func (subscription subscription) Equal(other subscription) bool {
@@ -110,12 +126,26 @@ type notification struct {
 // For upnp control point
 // --------------------------------------------------------------------------------------
 
-func GenaSubscribeToService(ctx context.Context, rootDevice RootDevice, service Service, handler func(string), stateVars ...string) (*context.CancelFunc, string, error) {
+// Subscribes to the events of service, handler receives the event messages following the initial one
+func GenaSubscribeToService(ctx context.Context, rootDevice RootDevice, service Service, handler func(Event), stateVars ...string) (*context.CancelFunc, string, error) {
+	return GenaSubscribeToServiceWithInitialEvent(ctx, rootDevice, service, nil, handler, stateVars...)
+}
+
+// Same as GenaSubscribeToService, initialHandler receives the initial event message (SEQ 0) holding the
+// current value of the evented state variables (see 4.3.2)
+func GenaSubscribeToServiceWithInitialEvent(ctx context.Context, rootDevice RootDevice, service Service, initialHandler func(Event), handler func(Event), stateVars ...string) (*context.CancelFunc, string, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
+	eventHandler := func(event Event) {
+		if event.Seq != 0 {
+			handler(event)
+		} else if initialHandler != nil {
+			initialHandler(event)
+		}
+	}
+
 	listenCtx, cancel := context.WithCancel(ctx)
-	//_, err := listenAtMulticast(listenCtx, genaMulticastNotificationAddress, genaMulticastNotificationPort, func(ctx context.Context, p UDPPacket) { genaSubscriptionEventHandler(ctx, p, handler) })
-	addr, err := listenAt(listenCtx, 0, func(ctx context.Context, p TCPPacket) { genaSubscriptionEventHandler(ctx, p, handler) })
+	eventListener, addr, err := newGenaEventListener(listenCtx, eventHandler)
 	if err != nil {
 		log.Error("[gena] An error occurred while listening for events: " + err.Error())
 		cancel()
@@ -123,15 +153,42 @@ func GenaSubscribeToService(ctx context.Context, rootDevice RootDevice, service
 	}
 	log.Info("[gena] Start listening for subscription messages at " + addr.String())
 
+	subscriptionUrl, err := genaEventSubURL(ctx, rootDevice, service)
+	if err != nil {
+		cancel()
+		return nil, "", err
+	}
+
+	callbackUrl, err := genaCallbackURL(ctx, subscriptionUrl, addr.Port)
+	if err != nil {
+		cancel()
+		return nil, "", err
+	}
+
+	sid, timeout, err := genaSendSubscription(ctx, subscriptionUrl, callbackUrl, stateVars)
+	if err != nil {
+		cancel()
+		return nil, "", err
+	}
+	eventListener.setSid(sid)
+
+	genaRenewalDaemon(listenCtx, subscriptionUrl, sid, timeout)
+
+	return &cancel, sid, nil
+}
+
+// Returns the eventing URL of service at the host of the description URL, of URLBase for devices without it
+func genaEventSubURL(ctx context.Context, rootDevice RootDevice, service Service) (*url.URL, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
 	var rootUrl *url.URL
-	if len(rootDevice.Device.PresentationURL) > 0 {
-		if rootDevice.Device.PresentationURL[len(rootDevice.Device.PresentationURL)-1] == '/' {
-			rootDevice.Device.PresentationURL = rootDevice.Device.PresentationURL[:len(rootDevice.Device.PresentationURL)-1]
-		}
-		rootUrl, err = url.Parse(rootDevice.Device.PresentationURL)
+	var err error
+	rootLocation := deviceLocation(rootDevice)
+	if len(rootLocation) > 0 {
+		rootUrl, err = url.Parse(rootLocation)
 
 		if err != nil {
-			log.Warn("[gena] An error occurred while parsing presetation url (upnp 1.1): " + err.Error())
+			log.Warn("[gena] An error occurred while parsing description url: " + err.Error())
 			rootUrl = nil
 		}
 	}
@@ -146,29 +203,47 @@ func GenaSubscribeToService(ctx context.Context, rootDevice RootDevice, service
 
 			if err != nil {
 				log.Error("[gena] An error occurred while parsing URLBase (upnp <1.1): " + err.Error())
-				cancel()
-				return nil, "", err
+				return nil, err
 			}
 		} else {
-			log.Error("[gena] Nor presentation url neither URLBase (upnp <= 1.1) are valid")
-			cancel()
-			return nil, "", errors.New("Device without valid url")
+			log.Error("[gena] Nor description url neither URLBase (upnp <= 1.1) are valid")
+			return nil, errors.New("Device without valid url")
 		}
 	}
 
-	subscriptionUrl, _ := url.Parse(rootUrl.Scheme + "://" + rootUrl.Host + service.EventSubURL)
+	return url.Parse(rootUrl.Scheme + "://" + rootUrl.Host + service.EventSubURL)
+}
+
+// Returns the CALLBACK URL for an event listener at port: the device must reach it, so the address is the one
+// of the interface routing to the device at subscriptionUrl
+func genaCallbackURL(ctx context.Context, subscriptionUrl *url.URL, port int) (string, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	deviceHost := subscriptionUrl.Host
+	if len(subscriptionUrl.Port()) == 0 {
+		deviceHost = net.JoinHostPort(subscriptionUrl.Hostname(), "80")
+	}
+	localIP, err := getTransport(ctx).LocalIPFor(deviceHost)
+	if err != nil {
+		log.Error("[gena] No route to the device: " + err.Error())
+		return "", err
+	}
+
+	return "http://" + net.JoinHostPort(localIP.String(), strconv.Itoa(port)) + "/", nil
+}
+
+// Sends a new subscription to subscriptionUrl, returns the SID and the timeout granted by the device (see 4.1.1)
+func genaSendSubscription(ctx context.Context, subscriptionUrl *url.URL, callbackUrl string, stateVars []string) (string, int, error) {
+	log := ctx.Value("logger").(logging.Logger)
 
 	log.Debug("[gena] Attempting subscription at: " + subscriptionUrl.String())
 
-	subscriptionRequest, err := http.NewRequest("SUBSCRIBE", subscriptionUrl.String(), nil)
+	subscriptionRequest, err := http.NewRequestWithContext(ctx, "SUBSCRIBE", subscriptionUrl.String(), nil)
 	if err != nil {
 		log.Error("[gena] An error occurred while creating a new request: " + err.Error())
-		cancel()
-		return nil, "", err
+		return "", 0, err
 	}
 
-	callbackUrl := "http://" + utils.GetLocalIP() + ":" + strconv.Itoa(addr.Port)
-
 	subscriptionRequest.Header.Set("HOST", subscriptionUrl.Host)
 	subscriptionRequest.Header.Set("USER-AGENT", ClientUserAgent)
 	subscriptionRequest.Header.Set("CALLBACK", "<"+callbackUrl+">")
@@ -177,168 +252,174 @@ func GenaSubscribeToService(ctx context.Context, rootDevice RootDevice, service
 
 	// STATEVARS is recommended not required (see 4.1.2)
 	if len(stateVars) > 0 {
-		var stateVarCSV strings.Builder
-		for i, stateVar := range stateVars {
-			if i != 0 {
-				stateVarCSV.WriteString(",")
-			}
-			stateVarCSV.WriteString(stateVar)
-		}
-		subscriptionRequest.Header.Set("STATEVAR", stateVarCSV.String())
+		subscriptionRequest.Header.Set("STATEVAR", strings.Join(stateVars, ","))
 	}
 
-	httpClient := &http.Client{
-		Timeout: 3 * time.Second,
-	}
+	httpClient := newHttpClient(ctx, 3*time.Second)
 
 	subscriptionResponse, err := httpClient.Do(subscriptionRequest)
 	if err != nil {
 		log.Error("[gena] Error while sending subscription request: " + err.Error())
-		cancel()
-		return nil, "", err
+		return "", 0, err
 	}
+	defer subscriptionResponse.Body.Close()
 
 	if subscriptionResponse.StatusCode != 200 {
 		log.Error("[gena] Subscription returned with code: " + subscriptionResponse.Status)
-		cancel()
-		return nil, "", errors.New(subscriptionResponse.Status)
+		return "", 0, errors.New(subscriptionResponse.Status)
 	}
 
 	sid := subscriptionResponse.Header.Get("SID")
 
 	log.Info("[gena] Subscription returned with code: " + subscriptionResponse.Status + " - sid: " + string(sid))
 
-	return &cancel, sid, nil
+	timeout, err := parseTimeout(subscriptionResponse.Header.Get("TIMEOUT"))
+	if err != nil {
+		log.Warn("[gena] Subscription without valid TIMEOUT, assumed the requested one: " + err.Error())
+		timeout = genaSubscriptionTimeoutSeconds
+	}
+
+	return sid, timeout, nil
 }
 
-func genaSubscriptionEventHandler(ctx context.Context, packet TCPPacket, handler func(string)) {
-	log := ctx.Value("logger").(logging.Logger)
+// Renews the subscription sid before it expires until ctx is done (see 4.1.2)
+func genaRenewalDaemon(ctx context.Context, subscriptionUrl *url.URL, sid string, timeout int) {
+	go func() {
+		log := ctx.Value("logger").(logging.Logger)
 
-	log.Debug("[gena] Received from " + packet.source.String() + " subscription message: " + packet.message)
+		for timeout != genaInfiniteTimeout {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(genaRenewalDelay(timeout)):
+			}
 
-	//TODO parse the message and give only the values
-	handler(packet.message)
+			renewedTimeout, err := genaRenewSubscription(ctx, subscriptionUrl, sid)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Error("[gena] Renewal of subscription " + sid + " failed: " + err.Error())
+				}
+				return
+			}
+			timeout = renewedTimeout
+
+			log.Debug("[gena] Subscription " + sid + " renewed for " + strconv.Itoa(timeout) + " seconds")
+		}
+	}()
 }
 
-// Listen to a specified port for UDP connection. When a client connects the handler function is invoked.
-// If port = 0 is selected a random port number.
-func listenAt(ctx context.Context, port int, handler func(context.Context, TCPPacket)) (*net.TCPAddr, error) {
-	log := ctx.Value("logger").(logging.Logger)
+// Returns the wait before renewing a subscription granted for timeout seconds: the renewal is sent
+// genaRenewalMarginSeconds before the expiration, at half of the timeout for short ones
+func genaRenewalDelay(timeout int) time.Duration {
+	if timeout <= 2*genaRenewalMarginSeconds {
+		return time.Duration(timeout) * time.Second / 2
+	}
+	return time.Duration(timeout-genaRenewalMarginSeconds) * time.Second
+}
 
-	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4zero, Port: port})
+// Sends a renewal of the subscription sid, returns the timeout granted by the device
+func genaRenewSubscription(ctx context.Context, subscriptionUrl *url.URL, sid string) (int, error) {
+	renewalRequest, err := http.NewRequestWithContext(ctx, "SUBSCRIBE", subscriptionUrl.String(), nil)
 	if err != nil {
-		log.Error("[gena] Error while listening TCP packet")
-		return nil, err
+		return 0, err
 	}
 
-	listenAtDaemon(ctx, listener, handler)
-
-	return listener.Addr().(*net.TCPAddr), nil
-}
+	renewalRequest.Header.Set("HOST", subscriptionUrl.Host)
+	renewalRequest.Header.Set("SID", sid)
+	renewalRequest.Header.Set("TIMEOUT", "Second-"+strconv.Itoa(genaSubscriptionTimeoutSeconds))
 
-//TODO It has to listen for udp
-/*func listenAtMulticast(ctx context.Context, multicastAddress string, port int, handler func(context.Context, UDPPacket)) (*net.UDPAddr, error) {
-	log := ctx.Value("logger").(logging.Logger)
-
-	addr, err := net.ResolveUDPAddr("udp4", multicastAddress+":"+strconv.Itoa(port))
+	renewalResponse, err := newHttpClient(ctx, 3*time.Second).Do(renewalRequest)
 	if err != nil {
-		log.Error("[gena] Error while resolving address: " + err.Error())
-		return nil, errors.New("Resolve error")
+		return 0, err
 	}
+	defer renewalResponse.Body.Close()
 
-	conn, err := net.ListenMulticastUDP("udp", nil, addr)
-	if err != nil {
-		log.Error("[gena] Error while listening UDP packet")
-		return nil, err
+	if renewalResponse.StatusCode != 200 {
+		return 0, errors.New(renewalResponse.Status)
 	}
 
-	listenAtDaemon(ctx, conn, handler)
+	timeout, err := parseTimeout(renewalResponse.Header.Get("TIMEOUT"))
+	if err != nil {
+		return genaSubscriptionTimeoutSeconds, nil
+	}
 
-	return addr, nil
+	return timeout, nil
 }
-*/
-
-func listenAtDaemon(ctx context.Context, listener *net.TCPListener, handler func(context.Context, TCPPacket)) {
-	go func() {
-		log := ctx.Value("logger").(logging.Logger)
-
-		defer listener.Close()
-
-		for {
-			conn, err := listener.Accept() //conn.ReadFromUDP(messageBuffer)
-			if err != nil {
-				log.Error("[gena] Error while receiving TCP packet")
-			}
 
-			go func() {
-				defer conn.Close()
-
-				messageBuffer := make([]byte, 1024)
-				n, err := conn.Read(messageBuffer)
-				if err != nil {
-					log.Error("[gena] Error while reading from connection: " + err.Error())
-					return
-				}
-
-				go func() {
-					handler(ctx, TCPPacket{
-						source:  *conn.RemoteAddr().(*net.TCPAddr),
-						message: string(messageBuffer[:n]),
-					})
-				}()
-
-				_, err = conn.Write([]byte("HTTP/1.1 200 OK\r\n"))
-				if err != nil {
-					log.Error("[gena] Error while writing the notification response: " + err.Error())
-					return
-				}
-			}()
+// Returns the URL the device is reached at: its description URL, the presentation URL for devices
+// converted without it
+func deviceLocation(rootDevice RootDevice) string {
+	if len(rootDevice.DescriptionURL) > 0 {
+		return rootDevice.DescriptionURL
+	}
+	return rootDevice.Device.PresentationURL
+}
 
-		}
-	}()
+// Listens for the multicast event messages of service of rootDevice until ctx is done (see 4.3.3),
+// handler receives those with one of levels, all of them if levels is empty
+func GenaListenMulticastEvents(ctx context.Context, rootDevice RootDevice, service Service, handler func(MulticastEvent), levels ...GenaMulticastEventLevels) error {
+	return GenaListenMulticastEventsWithConfig(ctx, rootDevice, service, handler, SsdpConfig{}, levels...)
 }
 
-func GenaUnsubscribeFromService(ctx context.Context, rootDevice RootDevice, service Service, sid string) error {
+// Same as GenaListenMulticastEvents, listens on each interface of config.
+// On IPv6 the event messages are received from each multicast scope of the interface (see Annex A).
+func GenaListenMulticastEventsWithConfig(ctx context.Context, rootDevice RootDevice, service Service, handler func(MulticastEvent), config SsdpConfig, levels ...GenaMulticastEventLevels) error {
 	log := ctx.Value("logger").(logging.Logger)
-
-	var rootUrl *url.URL
-	var err error
-	if len(rootDevice.Device.PresentationURL) > 0 {
-		if rootDevice.Device.PresentationURL[len(rootDevice.Device.PresentationURL)-1] == '/' {
-			rootDevice.Device.PresentationURL = rootDevice.Device.PresentationURL[:len(rootDevice.Device.PresentationURL)-1]
+	transport := getTransport(ctx)
+
+	usn := ""
+	for _, device := range flattenDevices(rootDevice.Device) {
+		if slices.ContainsFunc(device.ServiceList, func(s Service) bool {
+			return s.ServiceId == service.ServiceId && s.ServiceType == service.ServiceType
+		}) {
+			usn = device.UDN + "::" + service.ServiceType
+			break
 		}
+	}
+	if len(usn) == 0 {
+		return errors.New("Service not found: " + service.ServiceId)
+	}
 
-		rootUrl, err = url.Parse(rootDevice.Device.PresentationURL)
+	interfaces, err := resolveSsdpInterfaces(transport, config)
+	if err != nil {
+		log.Error("[gena] Error while resolving interfaces: " + err.Error())
+		return err
+	}
 
+	conns := []UDPConn{}
+	for _, ssdpInterface := range interfaces {
+		conn, err := transport.ListenMulticastUDP(ssdpInterface.network, ssdpInterface.iface, ssdpInterface.genaMulticastGroups())
 		if err != nil {
-			log.Warn("[gena] An error occurred while parsing presetation url (upnp 1.1): " + err.Error())
-			rootUrl = nil
+			log.Error("[gena] Error while listen multicast UDP on " + ssdpInterface.String() + ": " + err.Error())
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return err
 		}
+		conns = append(conns, conn)
 	}
 
-	// URLBase as fallback
-	if rootUrl == nil {
-		if len(rootDevice.URLBase) > 0 {
-			if rootDevice.URLBase[len(rootDevice.URLBase)-1] == '/' {
-				rootDevice.URLBase = rootDevice.URLBase[:len(rootDevice.URLBase)-1]
-			}
-			rootUrl, err = url.Parse(rootDevice.URLBase + service.EventSubURL)
-
-			if err != nil {
-				log.Error("[gena] An error occurred while parsing URLBase (upnp <1.1): " + err.Error())
-				return err
-			}
-		} else {
-			log.Error("[gena] Nor presentation url neither URLBase (upnp <= 1.1) are valid")
-			return errors.New("Device without valid url")
-		}
+	// The same event message may be received on more interfaces: the listener discards the duplicates
+	listener := newGenaMulticastListener(ctx, usn, service.ServiceId, levels, handler)
+	for i, conn := range conns {
+		listener.listenDaemon(conn)
+		log.Info("[gena] Listening for multicast events of " + usn + " on " + interfaces[i].String())
 	}
 
-	unsubscriptionUrl, _ := url.Parse(rootUrl.Scheme + "://" + rootUrl.Host + service.EventSubURL)
+	return nil
+}
+
+func GenaUnsubscribeFromService(ctx context.Context, rootDevice RootDevice, service Service, sid string) error {
+	log := ctx.Value("logger").(logging.Logger)
+
+	unsubscriptionUrl, err := genaEventSubURL(ctx, rootDevice, service)
+	if err != nil {
+		return err
+	}
 
 	log.Debug("[gena] Attempting unsubscription at: " + unsubscriptionUrl.String())
 
-	unsubscriptionRequest, err := http.NewRequest("UNSUBSCRIBE", unsubscriptionUrl.String(), nil)
+	unsubscriptionRequest, err := http.NewRequestWithContext(ctx, "UNSUBSCRIBE", unsubscriptionUrl.String(), nil)
 	if err != nil {
 		log.Error("[gena] An error occurred while creating a new request: " + err.Error())
 		return err
@@ -347,9 +428,7 @@ func GenaUnsubscribeFromService(ctx context.Context, rootDevice RootDevice, serv
 	unsubscriptionRequest.Header.Set("HOST", unsubscriptionUrl.Host)
 	unsubscriptionRequest.Header.Set("SID", sid)
 
-	httpClient := &http.Client{
-		Timeout: 3 * time.Second,
-	}
+	httpClient := newHttpClient(ctx, 3*time.Second)
 
 	unsubscriptionResponse, err := httpClient.Do(unsubscriptionRequest)
 	if err != nil {
@@ -374,27 +453,157 @@ func GenaUnsubscribeFromService(ctx context.Context, rootDevice RootDevice, serv
 
 type GenaState struct {
 	insertUpdateSubscription chan subscription
-	deleteSubscription       chan int64
+	deleteSubscription       chan string
 	notificationStateChange  chan notification
 	subscriptionsDB          sync.Map
 	serviceSubscriptionDB    sync.Map
+	serviceUsnDB             sync.Map                                 // USN of each served service, by serviceSubscriptionKey (see 4.3.3)
+	bootIdDB                 sync.Map                                 // BOOTID.UPNP.ORG of each served service, by serviceSubscriptionKey
+	multicastSeq             map[string]int                           // Next SEQ of the multicast event messages of each service, used by the daemon only
+	moderation               map[string]map[string]*moderatedVariable // Moderated variables of each service, used by the daemon only
+	moderationDue            chan Service
+	store                    SubscriptionStore
+	config                   SsdpConfig          // Interfaces the multicast event messages are sent on
+	multicastConns           []genaMulticastConn // Opened at the first multicast event message, used by the daemon only
+	restoreMutex             sync.Mutex
+	pendingRestores          []map[string]Service // Services whose stored subscriptions the daemon has still to restore
+	restoreDue               chan struct{}        // Signals the daemon that pendingRestores is not empty
+
+	ctx        context.Context // Done after Shutdown
+	cancel     context.CancelFunc
+	stopping   chan struct{} // Closed by Shutdown: the subscription daemon sends the final events and returns
+	stopOnce   sync.Once
+	daemon     sync.WaitGroup // Subscription daemon
+	deliveries sync.WaitGroup // Delivery queues
+
+	queuesMutex sync.Mutex
+	queues      map[*deliveryQueue]struct{} // Running delivery queues, also of the subscriptions not yet in the DBs
+	stopped     bool                        // Set by Shutdown: no delivery queue is started afterwards
 }
 
 func NewGenaListener(ctx context.Context) *GenaState {
+	return NewGenaListenerWithStore(ctx, NewMemorySubscriptionStore())
+}
+
+// Same as NewGenaListener, the subscriptions are kept in store. Those to the services served by
+// ServeRootDevice are restored once started.
+func NewGenaListenerWithStore(ctx context.Context, store SubscriptionStore) *GenaState {
+	return NewGenaListenerWithConfig(ctx, store, SsdpConfig{})
+}
+
+// Same as NewGenaListenerWithStore, the multicast event messages are sent on each interface of config
+func NewGenaListenerWithConfig(ctx context.Context, store SubscriptionStore, config SsdpConfig) *GenaState {
+	ctx, cancel := context.WithCancel(ctx)
 	result := &GenaState{
 		insertUpdateSubscription: make(chan subscription, 128),
-		deleteSubscription:       make(chan int64, 128),
+		deleteSubscription:       make(chan string, 128),
 		notificationStateChange:  make(chan notification, 128),
+		multicastSeq:             make(map[string]int),
+		moderation:               make(map[string]map[string]*moderatedVariable),
+		moderationDue:            make(chan Service, 128),
+		store:                    store,
+		config:                   config,
+		restoreDue:               make(chan struct{}, 1),
+		ctx:                      ctx,
+		cancel:                   cancel,
+		stopping:                 make(chan struct{}),
+		queues:                   make(map[*deliveryQueue]struct{}),
 	}
 
-	result.genaSubscriptionDaemon(ctx)
-
 	return result
 }
 
+// Starts the subscription daemon, until Shutdown
+func (state *GenaState) Start() {
+	state.daemon.Go(func() {
+		state.genaSubscriptionDaemon(state.ctx)
+	})
+}
+
+// Sends the final events and waits for the delivery queues to empty, the undelivered event messages are
+// dropped when ctx is done. The subscriptions are kept in the store.
+func (state *GenaState) Shutdown(ctx context.Context) error {
+	log := state.ctx.Value("logger").(logging.Logger)
+
+	state.stopOnce.Do(func() {
+		close(state.stopping)
+	})
+	state.daemon.Wait()
+
+	state.queuesMutex.Lock()
+	state.stopped = true
+	queues := slices.Collect(maps.Keys(state.queues))
+	state.queuesMutex.Unlock()
+
+	for _, queue := range queues {
+		queue.drain()
+	}
+
+	drained := make(chan struct{})
+	go func() {
+		state.deliveries.Wait()
+		close(drained)
+	}()
+
+	var err error
+	select {
+	case <-drained:
+	case <-ctx.Done():
+		log.Warn("[gena] Dropping the undelivered events at shutdown")
+		for _, queue := range queues {
+			queue.stop()
+		}
+		state.cancel() // Also aborts the event messages being sent
+		<-drained
+		err = ctx.Err()
+	}
+
+	state.cancel()
+	log.Info("[gena] Stopped subscription daemon")
+
+	return err
+}
+
+// Starts delivering the event messages queued for subscription, until it is removed or Shutdown.
+// After Shutdown the delivery is not started.
+func (state *GenaState) startDelivery(subscription subscription) {
+	state.queuesMutex.Lock()
+	defer state.queuesMutex.Unlock()
+
+	if state.stopped {
+		subscription.queue.stop()
+		return
+	}
+
+	state.queues[subscription.queue] = struct{}{}
+	state.deliveries.Go(func() {
+		subscription.queue.run(state.ctx, state, subscription)
+
+		state.queuesMutex.Lock()
+		delete(state.queues, subscription.queue)
+		state.queuesMutex.Unlock()
+	})
+}
+
+// Tells if Shutdown has been called
+func (state *GenaState) isStopping() bool {
+	select {
+	case <-state.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
 func (state *GenaState) GenaSubscriptionHandler(ctx context.Context, service Service, request *http.Request, response http.ResponseWriter) error {
 	log := ctx.Value("logger").(logging.Logger)
 
+	if state.isStopping() {
+		log.Warn("[gena] Refused subscription message during shutdown")
+		generateNegativeResponse(503, response)
+		return errShuttingDown
+	}
+
 	subscriptionRequest, err := parseSubscriptionRequest(ctx, request)
 	if err != nil {
 		switch { // See 4.1.2 table 4-4
@@ -407,12 +616,48 @@ func (state *GenaState) GenaSubscriptionHandler(ctx context.Context, service Ser
 		}
 	}
 
+	// The device grants at most genaSubscriptionTimeoutSeconds, also to Second-infinite requests
+	if subscriptionRequest.timeout == genaInfiniteTimeout || subscriptionRequest.timeout > genaSubscriptionTimeoutSeconds {
+		subscriptionRequest.timeout = genaSubscriptionTimeoutSeconds
+	}
+
 	var sid string
+	var newSubscription subscription
+	flagNewSubscription := false
 	if subscriptionRequest.sid != "" && subscriptionRequest.nt == "" && subscriptionRequest.callback == nil { // Subscription update
-		sid, err = state.createNewSubscription(subscriptionRequest, service)
+		sid, err = state.renewSubscription(subscriptionRequest, service)
+		if errors.Is(err, errShuttingDown) {
+			generateNegativeResponse(503, response)
+			return err
+		}
+		if err != nil {
+			log.Warn("[gena] Received renewal of unknown subscription, sid: " + subscriptionRequest.sid)
+			generateNegativeResponse(412, response)
+			return err
+		}
+		subscriptionRequest.statevar = []string{}
+
+	} else if subscriptionRequest.sid == "" && (subscriptionRequest.nt != "upnp:event" || subscriptionRequest.callback == nil) {
+		log.Warn("[gena] Received invalid subscription message: NT or CALLBACK not valid")
+		generateNegativeResponse(412, response)
+		return errors.New("NT or CALLBACK not valid")
 
-	} else if subscriptionRequest.sid == "" && subscriptionRequest.nt == "upnp:event" && subscriptionRequest.callback != nil { //New subscription
-		sid, err = state.createNewSubscription(subscriptionRequest, service)
+	} else if subscriptionRequest.sid == "" { //New subscription
+		if len(subscriptionRequest.statevar) > 0 {
+			subscriptionRequest.statevar = acceptedStateVariables(service, subscriptionRequest.statevar)
+		}
+		newSubscription, err = state.createNewSubscription(subscriptionRequest, service)
+		if errors.Is(err, errShuttingDown) {
+			generateNegativeResponse(503, response)
+			return err
+		}
+		if err != nil {
+			log.Error("[gena] Error while creating the subscription: " + err.Error())
+			generateNegativeResponse(500, response)
+			return err
+		}
+		sid = newSubscription.sid
+		flagNewSubscription = true
 
 	} else { // Error invalid combination
 		log.Warn("[gena] Received invalid subscription message: invalid combination of SID, NT, CALLBACK")
@@ -424,9 +669,59 @@ func (state *GenaState) GenaSubscriptionHandler(ctx context.Context, service Ser
 
 	generatePositiveResponse(subscriptionRequest, sid, response)
 
+	// The delivery starts after the response: the subscriber needs the SID to accept the initial event (see 4.3.2)
+	if flagNewSubscription {
+		response.WriteHeader(http.StatusOK)
+		if flusher, isFlusher := response.(http.Flusher); isFlusher {
+			flusher.Flush()
+		}
+		state.startDelivery(newSubscription)
+	}
+
 	return nil
 }
 
+// Keeps the requested state variables evented by service, all the evented ones if none of them is (see 4.1.2)
+func acceptedStateVariables(service Service, requested []string) []string {
+	result := []string{}
+	evented := []string{}
+	for _, stateVariable := range service.SCPD.ServiceStateTable {
+		if !stateVariable.SendEvents {
+			continue
+		}
+		evented = append(evented, stateVariable.Name)
+
+		if slices.ContainsFunc(requested, func(name string) bool { return strings.TrimSpace(name) == stateVariable.Name }) {
+			result = append(result, stateVariable.Name)
+		}
+	}
+
+	if len(result) == 0 {
+		return evented
+	}
+
+	return result
+}
+
+// Current value of all the evented state variables of service in stateVars, all of them if stateVars is empty:
+// the initial event message sent to a new subscriber (see 4.3.2)
+func initialValues(service Service, stateVars []string) map[string]string {
+	result := map[string]string{}
+	for _, stateVariable := range service.SCPD.ServiceStateTable {
+		if !stateVariable.SendEvents || (len(stateVars) > 0 && !slices.Contains(stateVars, stateVariable.Name)) {
+			continue
+		}
+
+		value := stateVariable.DefaultValue
+		if service.State != nil {
+			value, _ = service.State.Value(stateVariable.Name)
+		}
+		result[stateVariable.Name] = value
+	}
+
+	return result
+}
+
 func parseSubscriptionRequest(ctx context.Context, request *http.Request) (subscriptionRequest, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
@@ -449,8 +744,8 @@ func parseSubscriptionRequest(ctx context.Context, request *http.Request) (subsc
 		callback = strings.TrimPrefix(callback, "<")
 		callback = strings.TrimSuffix(callback, ">")
 		callbackUrl, err := url.Parse(callback)
-		if err != nil {
-			log.Warn("[gena] Error while parsing callback url: " + err.Error())
+		if err != nil || callbackUrl.Scheme != "http" {
+			log.Warn("[gena] Callback url not valid: " + callback)
 			return subscriptionRequest{}, errors.New("Callback paring error")
 		}
 		result.callback = callbackUrl
@@ -458,8 +753,7 @@ func parseSubscriptionRequest(ctx context.Context, request *http.Request) (subsc
 
 	timeout := request.Header.Get("TIMEOUT")
 	if len(timeout) > 0 {
-		timeout = strings.TrimPrefix(timeout, "Second-")
-		timeoutInt, err := strconv.Atoi(timeout)
+		timeoutInt, err := parseTimeout(timeout)
 		if err != nil {
 			log.Warn("[gena] Error while parsing timeout: " + err.Error())
 			return subscriptionRequest{}, err
@@ -470,42 +764,212 @@ func parseSubscriptionRequest(ctx context.Context, request *http.Request) (subsc
 	return result, nil
 }
 
-func (state *GenaState) createNewSubscription(subscriptionRequest subscriptionRequest, service Service) (string, error) {
+// Parses the value of a TIMEOUT header: Second- followed by the seconds or by infinite (see 4.1.1)
+func parseTimeout(timeout string) (int, error) {
+	seconds, found := strings.CutPrefix(strings.TrimSpace(timeout), "Second-")
+	if !found {
+		return 0, errors.New("TIMEOUT not valid: " + timeout)
+	}
+	if seconds == "infinite" {
+		return genaInfiniteTimeout, nil
+	}
+
+	result, err := strconv.Atoi(seconds)
+	if err != nil || result <= 0 {
+		return 0, errors.New("TIMEOUT not valid: " + timeout)
+	}
+
+	return result, nil
+}
+
+// Extends the subscription with the SID of subscriptionRequest by the requested timeout, the SID is kept
+func (state *GenaState) renewSubscription(subscriptionRequest subscriptionRequest, service Service) (string, error) {
+	renewed, found := state.serviceSubscription(subscriptionRequest.sid, service)
+	if !found {
+		return "", errors.New("Subscription not found: " + subscriptionRequest.sid)
+	}
+
+	renewed.timeout = subscriptionRequest.timeout
+	renewed.expiration = time.Now().Add(time.Duration(subscriptionRequest.timeout) * time.Second)
+
+	select {
+	case state.insertUpdateSubscription <- renewed:
+	case <-state.stopping:
+		return "", errShuttingDown
+	}
+
+	return subscriptionRequest.sid, nil
+}
+
+// Creates the subscription with a new SID, its delivery queue holds the initial event message
+func (state *GenaState) createNewSubscription(subscriptionRequest subscriptionRequest, service Service) (subscription, error) {
 	subscriber := subscriber{
-		eventKey:             0,
 		httpSuppertedVersion: "1.0",
 		userAgent:            subscriptionRequest.userAgent,
 	}
-	now := time.Now() //TODO "now" is the current implementation of sid (check 1.1.4)
+	sid, err := GenerateRandomUUID()
+	if err != nil {
+		return subscription{}, err
+	}
+
+	now := time.Now()
 	subscription := subscription{
-		sid:        now.UnixNano(),
+		sid:        sid,
 		subscriber: subscriber,
 		service:    service,
 		stateVar:   subscriptionRequest.statevar,
 		creation:   now,
+		expiration: now.Add(time.Duration(subscriptionRequest.timeout) * time.Second),
 		timeout:    subscriptionRequest.timeout,
 		callback:   subscriptionRequest.callback,
+		queue:      newDeliveryQueue(),
 	}
+	subscription.queue.push(initialValues(service, subscription.stateVar))
 
-	state.insertUpdateSubscription <- subscription //TODO Check if it is successful
+	// After Shutdown the daemon no longer stores the subscriptions
+	select {
+	case state.insertUpdateSubscription <- subscription:
+	case <-state.stopping:
+		return subscription, errShuttingDown
+	}
 
-	return fmt.Sprintf("%d", now.UnixNano()), nil
+	return subscription, nil
+}
+
+// Returns the subscription sid if it is a subscription to the events of service
+func (state *GenaState) serviceSubscription(sid string, service Service) (subscription, bool) {
+	s, found := state.subscriptionsDB.Load(sid)
+	if !found || s.(subscription).service.EventSubURL != service.EventSubURL {
+		return subscription{}, false
+	}
+
+	return s.(subscription), true
+}
+
+// Records the USN and the BOOTID.UPNP.ORG of each service of rootDevice: the multicast event messages
+// carry them (see 4.3.3). The unexpired subscriptions to the services kept in the store are restored
+// by the subscription daemon: registering does not wait for it to be started.
+func (state *GenaState) registerRootDevice(rootDevice RootDevice) {
+	services := map[string]Service{}
+	for _, device := range flattenDevices(rootDevice.Device) {
+		for _, service := range device.ServiceList {
+			state.serviceUsnDB.Store(serviceSubscriptionKey(service), device.UDN+"::"+service.ServiceType)
+			services[serviceSubscriptionKey(service)] = service
+		}
+	}
+	state.updateBootId(rootDevice)
+
+	state.restoreMutex.Lock()
+	state.pendingRestores = append(state.pendingRestores, services)
+	state.restoreMutex.Unlock()
+
+	select {
+	case state.restoreDue <- struct{}{}:
+	default: // Already signaled
+	}
+}
+
+// Restores the stored subscriptions to the services registered so far, used by the daemon only
+func (state *GenaState) restorePending(ctx context.Context) {
+	state.restoreMutex.Lock()
+	pending := state.pendingRestores
+	state.pendingRestores = nil
+	state.restoreMutex.Unlock()
+
+	for _, services := range pending {
+		state.restoreSubscriptions(ctx, services)
+	}
+}
+
+// Records the BOOTID.UPNP.ORG of rootDevice sent with the multicast event messages of its services
+func (state *GenaState) updateBootId(rootDevice RootDevice) {
+	for _, device := range flattenDevices(rootDevice.Device) {
+		for _, service := range device.ServiceList {
+			state.bootIdDB.Store(serviceSubscriptionKey(service), rootDevice.BootId)
+		}
+	}
+}
+
+// Restores the stored subscriptions to services, each restored subscriber receives a new initial event
+// message: the event key restarts from 0 (see 4.3.2). Used by the daemon only.
+func (state *GenaState) restoreSubscriptions(ctx context.Context, services map[string]Service) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	records, err := state.store.Load()
+	if err != nil {
+		log.Error("[gena] Error while loading the subscriptions: " + err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, record := range records {
+		service, found := services[record.EventSubURL]
+		if !found {
+			continue
+		}
+
+		callback, err := url.Parse(record.Callback)
+		if !record.Expiration.After(now) || err != nil || callback.Scheme != "http" {
+			log.Info("[gena] Discarding stored subscription, sid: " + record.SID)
+			state.removeSubscription(ctx, record.SID)
+			continue
+		}
+
+		restored := subscription{
+			sid: record.SID,
+			subscriber: subscriber{
+				httpSuppertedVersion: "1.0",
+				userAgent:            record.UserAgent,
+			},
+			service:    service,
+			stateVar:   record.StateVars,
+			creation:   record.Creation,
+			expiration: record.Expiration,
+			timeout:    record.Timeout,
+			callback:   callback,
+			queue:      newDeliveryQueue(),
+		}
+		restored.queue.push(initialValues(service, restored.stateVar))
+
+		log.Info("[gena] Restored subscription, sid: " + restored.sid + " callback: " + record.Callback)
+
+		state.storeSubscription(ctx, restored)
+		state.startDelivery(restored)
+	}
+}
+
+// Key of the subscriptions of service in serviceSubscriptionDB: the eventing URL identifies the service
+// also among embedded devices sharing the serviceId
+func serviceSubscriptionKey(service Service) string {
+	return service.EventSubURL
 }
 
 func (state *GenaState) GenaUnsubscriptionHandler(ctx context.Context, service Service, request *http.Request, response http.ResponseWriter) error {
 	log := ctx.Value("logger").(logging.Logger)
 
-	unsubscribeRequestSid := request.Header.Get("SID")
+	sid := strings.TrimSpace(request.Header.Get("SID"))
 
-	sid, err := strconv.ParseInt(unsubscribeRequestSid, 10, 64)
-	if err != nil {
+	// See 4.1.4
+	if len(request.Header.Get("NT")) > 0 || len(request.Header.Get("CALLBACK")) > 0 {
+		generateNegativeResponse(400, response)
+		return errors.New("Invalid combination of SID, NT, CALLBACK")
+	}
+
+	_, found := state.serviceSubscription(sid, service)
+	if !found {
+		log.Warn("[gena] Received unsubscribe of unknown subscription, sid: " + sid)
 		generateNegativeResponse(412, response)
-		return err
+		return errors.New("Subscription not found: " + sid)
 	}
 
-	log.Debug("[gena] Received unsubscribe message, sid: " + unsubscribeRequestSid)
+	log.Debug("[gena] Received unsubscribe message, sid: " + sid)
 
-	state.deleteSubscription <- sid
+	select {
+	case state.deleteSubscription <- sid:
+	case <-state.stopping:
+		generateNegativeResponse(503, response)
+		return errShuttingDown
+	}
 
 	response.WriteHeader(200)
 
@@ -517,7 +981,7 @@ func generatePositiveResponse(subscriptionRequest subscriptionRequest, sid strin
 	response.Header().Set("SERVER", ServerUserAgent)
 	response.Header().Set("SID", sid)
 	response.Header().Set("CONTENT-LENGTH", "0")
-	response.Header().Set("TIMEOUT", strconv.Itoa(subscriptionRequest.timeout))
+	response.Header().Set("TIMEOUT", "Second-"+strconv.Itoa(subscriptionRequest.timeout))
 	if len(subscriptionRequest.statevar) > 0 {
 		response.Header().Set("ACCEPTED-STATEVAR", utils.StringToCSV(subscriptionRequest.statevar))
 	}
@@ -527,199 +991,337 @@ func generateNegativeResponse(errorCode int, response http.ResponseWriter) {
 	response.WriteHeader(errorCode)
 }
 
+// Applies the changes to the subscriptions and dispatches the notifications until Shutdown or ctx is done
 func (state *GenaState) genaSubscriptionDaemon(ctx context.Context) {
-	go func() {
-		log := ctx.Value("logger").(logging.Logger)
+	log := ctx.Value("logger").(logging.Logger)
 
-		log.Info("[gena] Starting subscription daemon")
-		for {
-			select {
-			case sid := <-state.deleteSubscription:
-				go func() {
-					s, found := state.subscriptionsDB.Load(sid)
-					if found {
-						sub := s.(subscription)
-						service := sub.service
-
-						sSub, _ := state.serviceSubscriptionDB.Load(service.ServiceId)
-						serviceSubscriptions := sSub.([]subscription)
-						serviceSubscriptions = utils.DeleteElement(serviceSubscriptions, sub)
-
-						state.serviceSubscriptionDB.Store(service.ServiceId, serviceSubscriptions)
-						state.subscriptionsDB.Delete(sid)
-					}
-				}()
-			case newSubscription := <-state.insertUpdateSubscription:
-				go func() {
-					state.subscriptionsDB.Store(newSubscription.sid, newSubscription)
-
-					sSub, found := state.serviceSubscriptionDB.Load(newSubscription.service.ServiceId)
-					var serviceSubscriptions []subscription
-					if found {
-						serviceSubscriptions = sSub.([]subscription)
-					} else {
-						serviceSubscriptions = []subscription{}
-					}
-					serviceSubscriptions = append(serviceSubscriptions, newSubscription)
-					state.serviceSubscriptionDB.Store(newSubscription.service.ServiceId, serviceSubscriptions)
-				}()
-			case notification := <-state.notificationStateChange:
-				go func() {
-					sOriginal, found := state.serviceSubscriptionDB.Load(notification.service.ServiceId)
-
-					if found {
-						subscribersOriginal := sOriginal.([]subscription)
-						subscribers := make([]subscription, len(subscribersOriginal))
-						subscribers = slices.Clone(subscribersOriginal)
-
-						sendNotificationToSubscribers(ctx, notification, subscribers)
-					}
-				}()
-			case <-ctx.Done():
-				return
-			}
+	expirationTicker := time.NewTicker(genaExpirationCheckSeconds * time.Second)
+	defer expirationTicker.Stop()
+
+	defer func() {
+		for _, multicastConn := range state.multicastConns {
+			multicastConn.conn.Close()
 		}
 	}()
+
+	// Insertions and deletions are applied by this goroutine only: the DBs are never updated concurrently
+	log.Info("[gena] Starting subscription daemon")
+	state.restorePending(ctx)
+	for {
+		select {
+		case <-state.restoreDue:
+			state.restorePending(ctx)
+		case sid := <-state.deleteSubscription:
+			state.removeSubscription(ctx, sid)
+		case newSubscription := <-state.insertUpdateSubscription:
+			state.storeSubscription(ctx, newSubscription)
+		case notification := <-state.notificationStateChange:
+			state.dispatchNotification(ctx, state.moderate(ctx, notification, time.Now()))
+		case service := <-state.moderationDue:
+			state.dispatchNotification(ctx, state.moderationFlush(service, time.Now(), false))
+		case <-expirationTicker.C:
+			now := time.Now()
+			state.subscriptionsDB.Range(func(sid any, s any) bool {
+				if !s.(subscription).expiration.After(now) {
+					log.Info("[gena] Subscription expired, sid: " + sid.(string))
+					state.removeSubscription(ctx, sid.(string))
+				}
+				return true
+			})
+		case <-state.stopping:
+			// Final events: the notifications already received and the moderated values waiting for the end
+			// of their window are sent now
+			for len(state.notificationStateChange) > 0 {
+				state.dispatchNotification(ctx, state.moderate(ctx, <-state.notificationStateChange, time.Now()))
+			}
+			for _, service := range state.moderatedServices() {
+				state.dispatchNotification(ctx, state.moderationFlush(service, time.Now(), true))
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
 }
 
-func (state *GenaState) GenaNotifySubscribers(service Service, arguments []device.Argument) {
-	stateVariableValues := []stateVariableValue{}
+// Queues the event messages of notification to the subscribers of its service and multicasts those of the
+// Multicast variables, in the order of the changes: the delivery queues do not block.
+func (state *GenaState) dispatchNotification(ctx context.Context, notification notification) {
+	log := ctx.Value("logger").(logging.Logger)
 
-	for _, argument := range arguments {
-		for _, stateVariable := range service.SCPD.ServiceStateTable {
-			if argument.Name == stateVariable.Name {
-				stateVariableValues = append(stateVariableValues, stateVariableValue{
-					stateVar: stateVariable,
-					value:    argument.Value,
-				})
+	if len(notification.stateVariableValues) == 0 {
+		return
+	}
+
+	sOriginal, found := state.serviceSubscriptionDB.Load(serviceSubscriptionKey(notification.service))
+	if found {
+		now := time.Now()
+		subscribers := utils.Find(sOriginal.([]subscription), func(subscription subscription) bool {
+			return subscription.expiration.After(now)
+		})
+
+		queueNotificationToSubscribers(notification, subscribers)
+	}
+
+	generator := state.multicastNotification(ctx, notification)
+	if generator == nil {
+		return
+	}
+
+	if state.multicastConns == nil {
+		state.multicastConns = openGenaMulticastConns(ctx, state.config)
+	}
+	for _, multicastConn := range state.multicastConns {
+		for _, group := range multicastConn.ssdpInterface.genaMulticastGroups() {
+			for _, packet := range generator(*group) {
+				_, err := multicastConn.conn.WriteTo([]byte(packet.message), &packet.receiver)
+				if err != nil {
+					log.Error("[gena] Error while sending multicast event on " + multicastConn.ssdpInterface.String() + ": " + err.Error())
+				}
 			}
 		}
 	}
+}
 
-	state.notificationStateChange <- notification{
-		service:             service,
-		stateVariableValues: stateVariableValues,
-	}
+// Socket sending the multicast event messages on an interface
+type genaMulticastConn struct {
+	ssdpInterface ssdpInterface
+	conn          UDPConn
 }
 
-func sendNotificationToSubscribers(ctx context.Context, notification notification, subscriptions []subscription) {
+// Opens a socket for each interface of config, the interfaces that cannot be used are logged and skipped
+func openGenaMulticastConns(ctx context.Context, config SsdpConfig) []genaMulticastConn {
 	log := ctx.Value("logger").(logging.Logger)
+	transport := getTransport(ctx)
 
-	sendNotification := func(packet TCPPacket) {
-		addr, err := net.ResolveTCPAddr("tcp", packet.receiver.IP.String()+":"+strconv.Itoa(packet.receiver.Port))
-		if err != nil {
-			log.Error("[gena] Error while resolving address: " + err.Error())
-			return
-		}
+	result := []genaMulticastConn{}
 
-		conn, err := net.DialTCP("tcp", nil, addr)
+	interfaces, err := resolveSsdpInterfaces(transport, config)
+	if err != nil {
+		log.Error("[gena] Error while resolving interfaces for multicast events: " + err.Error())
+		return result
+	}
+
+	for _, ssdpInterface := range interfaces {
+		conn, err := transport.ListenUDP(ssdpInterface.network, nil)
 		if err != nil {
-			log.Error("[gena] Error while dial TCP address")
-			return
+			log.Error("[gena] Error while listen UDP for multicast events on " + ssdpInterface.String() + ": " + err.Error())
+			continue
 		}
-		defer conn.Close()
 
-		_, err = conn.Write([]byte(packet.message))
+		err = conn.SetMulticastInterface(ssdpInterface.iface)
 		if err != nil {
-			log.Error("[gena] Error while sending TCP packet")
-			return
+			log.Error("[gena] Error setting multicast interface " + ssdpInterface.String() + ": " + err.Error())
+			conn.Close()
+			continue
 		}
 
-		messageBuffer := make([]byte, 1024)
-		n, err := conn.Read(messageBuffer)
-		if err != nil {
-			log.Error("[gena] Error while receiving UDP packet")
-			return
+		result = append(result, genaMulticastConn{ssdpInterface: ssdpInterface, conn: conn})
+	}
+
+	return result
+}
+
+// Inserts newSubscription in the DBs and the store, a renewal replaces the subscription with the same SID
+func (state *GenaState) storeSubscription(ctx context.Context, newSubscription subscription) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	state.subscriptionsDB.Store(newSubscription.sid, newSubscription)
+
+	err := state.store.Save(subscriptionRecordOf(newSubscription))
+	if err != nil {
+		log.Warn("[gena] Error while storing the subscription " + newSubscription.sid + ": " + err.Error())
+	}
+
+	sSub, found := state.serviceSubscriptionDB.Load(serviceSubscriptionKey(newSubscription.service))
+	serviceSubscriptions := []subscription{}
+	if found {
+		serviceSubscriptions = slices.Clone(sSub.([]subscription))
+	}
+
+	index := slices.IndexFunc(serviceSubscriptions, newSubscription.Equal)
+	if index >= 0 {
+		serviceSubscriptions[index] = newSubscription
+	} else {
+		serviceSubscriptions = append(serviceSubscriptions, newSubscription)
+	}
+	state.serviceSubscriptionDB.Store(serviceSubscriptionKey(newSubscription.service), serviceSubscriptions)
+}
+
+// Removes the subscription sid from the DBs and the store and stops its delivery
+func (state *GenaState) removeSubscription(ctx context.Context, sid string) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	err := state.store.Delete(sid)
+	if err != nil {
+		log.Warn("[gena] Error while deleting the stored subscription " + sid + ": " + err.Error())
+	}
+
+	s, found := state.subscriptionsDB.Load(sid)
+	if !found {
+		return
+	}
+
+	sub := s.(subscription)
+	service := sub.service
+
+	sSub, _ := state.serviceSubscriptionDB.Load(serviceSubscriptionKey(service))
+	serviceSubscriptions := utils.DeleteElement(slices.Clone(sSub.([]subscription)), sub)
+
+	state.serviceSubscriptionDB.Store(serviceSubscriptionKey(service), serviceSubscriptions)
+	state.subscriptionsDB.Delete(sid)
+
+	sub.queue.stop()
+}
+
+// Notifies the new values of the state variables to the subscribers of service.
+// For services with a StateStore the values are set through the store, which notifies the changes.
+func (state *GenaState) GenaNotifySubscribers(service Service, arguments []device.Argument) {
+	stateVariableValues := []stateVariableValue{}
+
+	for _, argument := range arguments {
+		for _, stateVariable := range service.SCPD.ServiceStateTable {
+			if argument.Name == stateVariable.Name {
+				stateVariableValues = append(stateVariableValues, stateVariableValue{
+					stateVar: stateVariable,
+					value:    argument.Value,
+				})
+			}
 		}
+	}
 
-		log.Info("[gena] Subscription delivery received response: " + string(messageBuffer[:n]))
+	// After Shutdown the changes are no longer notified
+	select {
+	case state.notificationStateChange <- notification{
+		service:             service,
+		stateVariableValues: stateVariableValues,
+	}:
+	case <-state.stopping:
 	}
+}
 
+// Queues an event message with the subscribed evented variables of notification to each subscriber
+func queueNotificationToSubscribers(notification notification, subscriptions []subscription) {
 	for _, subscription := range subscriptions {
-		sid := fmt.Sprintf("%d", subscription.sid)
-		//usn := ""
-
 		variableValueMap := map[string]string{}
-		variableValueMapMulticast := map[string]string{}
 		for _, stateVariableValue := range notification.stateVariableValues {
 			if stateVariableValue.stateVar.SendEvents && (len(subscription.stateVar) == 0 || slices.Contains(subscription.stateVar, stateVariableValue.stateVar.Name)) {
 				variableValueMap[stateVariableValue.stateVar.Name] = stateVariableValue.value
-				subscription.subscriber.eventKey++
-
-			}
-			if stateVariableValue.stateVar.Multicast {
-				variableValueMapMulticast[stateVariableValue.stateVar.Name] = stateVariableValue.value
-
 			}
 		}
 
-		go sendNotification(generateNotifyMessage(subscription.callback, sid, subscription.subscriber.eventKey, variableValueMap))
-		//go sendNotification(generateNotifyMulticastMessage(subscription.callback, usn, subscription.service.ServiceId, subscription.subscriber.eventKey, Info, variableValueMap))
+		if len(variableValueMap) > 0 {
+			subscription.queue.push(variableValueMap)
+		}
 	}
 }
 
-func generateNotifyMessage(host *url.URL, sid string, sequenceNumber int, variableValueMap map[string]string) TCPPacket {
-	var result strings.Builder
+// Returns the generator of the multicast event messages of the Multicast variables of notification to a group,
+// one for each level, nil if there are none. The SEQ is assigned once for all the groups: it is shared by
+// the event messages of the service and wraps from genaMaxSeq to 1 (see 4.3.3).
+func (state *GenaState) multicastNotification(ctx context.Context, notification notification) func(group net.UDPAddr) []UDPPacket {
+	log := ctx.Value("logger").(logging.Logger)
 
-	// See 4.3.2
-	result.WriteString("NOTIFY " + host.Path + " HTTP/1.0\r\n")
-	result.WriteString("HOST: delivery " + host.Host + "\r\n")
-	result.WriteString("CONTENT-TYPE: text/xml; charset=\"utf-8\"\r\n")
-	result.WriteString("NT: upnp:event\r\n")
-	result.WriteString("NTS: upnp:propchange\r\n")
-	result.WriteString("SID: " + sid + "\r\n")
-	result.WriteString("SEQ: " + strconv.Itoa(sequenceNumber) + "\r\n")
-	//result.WriteString("CONTENT-LENGTH: 0\r\n")
-	result.WriteString("\r\n")
+	levelValueMaps := map[GenaMulticastEventLevels]map[string]string{}
+	for _, stateVariableValue := range notification.stateVariableValues {
+		if !stateVariableValue.stateVar.Multicast {
+			continue
+		}
 
-	result.WriteString("<?xml version=\"1.0\"?>\r\n")
-	result.WriteString("<e:propertyset xmlns:e=\"urn:schemas-upnp-org:event-1-0\">\r\n")
-	result.WriteString("<e:property>\r\n")
+		level := stateVariableValue.stateVar.MulticastLevel
+		if len(level) == 0 {
+			level = General
+		}
+		if levelValueMaps[level] == nil {
+			levelValueMaps[level] = map[string]string{}
+		}
+		levelValueMaps[level][stateVariableValue.stateVar.Name] = stateVariableValue.value
+	}
+	if len(levelValueMaps) == 0 {
+		return nil
+	}
 
-	for key, value := range variableValueMap {
-		result.WriteString("<" + key + ">" + value + "</" + key + ">\r\n")
+	key := serviceSubscriptionKey(notification.service)
+	usn, found := state.serviceUsnDB.Load(key)
+	if !found {
+		log.Warn("[gena] Multicast event not sent, USN unknown for service: " + notification.service.ServiceId)
+		return nil
 	}
 
-	result.WriteString("</e:property>\r\n")
-	result.WriteString("</e:propertyset>\r\n")
+	bootId, _ := state.bootIdDB.Load(key)
 
-	receiver, _ := net.ResolveTCPAddr("tcp", host.Host)
-	return TCPPacket{
-		message:  result.String(),
-		receiver: *receiver,
+	levels := slices.Sorted(maps.Keys(levelValueMaps))
+	seqs := []int{}
+	for range levels {
+		seqs = append(seqs, state.multicastSeq[key])
+
+		state.multicastSeq[key]++
+		if state.multicastSeq[key] > genaMaxSeq {
+			state.multicastSeq[key] = 1
+		}
+	}
+
+	return func(group net.UDPAddr) []UDPPacket {
+		result := []UDPPacket{}
+		for i, level := range levels {
+			result = append(result, generateNotifyMulticastMessage(usn.(string), bootId.(int), notification.service.ServiceId, seqs[i], level, levelValueMaps[level], group))
+		}
+		return result
 	}
 }
 
-func generateNotifyMulticastMessage(host *url.URL, usn string, serviceId string, sequenceNumber int, genaMulticastEventLevels GenaMulticastEventLevels, variableValueMap map[string]string) UDPPacket {
+func generateNotifyMulticastMessage(usn string, bootId int, serviceId string, sequenceNumber int, genaMulticastEventLevels GenaMulticastEventLevels, variableValueMap map[string]string, group net.UDPAddr) UDPPacket {
 	var result strings.Builder
 
+	propertySet := generatePropertySet(variableValueMap)
+
 	// See 4.3.3
 	result.WriteString("NOTIFY * HTTP/1.0\r\n")
-	result.WriteString("HOST: " + genaMulticastNotificationAddress + ":" + strconv.Itoa(genaMulticastNotificationPort) + "\r\n")
+	result.WriteString("HOST: " + ssdpHost(group) + "\r\n")
 	result.WriteString("CONTENT-TYPE: text/xml; charset=\"utf-8\"\r\n")
 	result.WriteString("USN: " + usn + "\r\n")
 	result.WriteString("SVCID: " + serviceId + "\r\n")
+	result.WriteString("BOOTID.UPNP.ORG: " + strconv.Itoa(bootId) + "\r\n")
 	result.WriteString("NT: upnp:event\r\n")
 	result.WriteString("NTS: upnp:propchange\r\n")
 	result.WriteString("SEQ: " + strconv.Itoa(sequenceNumber) + "\r\n")
 	result.WriteString("LVL: " + genaMulticastEventLevels.String() + "\r\n")
-	//result.WriteString("CONTENT-LENGTH: 0\r\n")
+	result.WriteString("CONTENT-LENGTH: " + strconv.Itoa(len(propertySet)) + "\r\n")
 	result.WriteString("\r\n")
 
-	result.WriteString("<?xml version=\"1.0\"?>\r\n")
-	result.WriteString("<e:propertyset xmlns:e=\"urn:schemas-upnp-org:event-1-0\">\r\n")
-	result.WriteString("<e:property>\r\n")
+	result.WriteString(propertySet)
 
-	for key, value := range variableValueMap {
-		result.WriteString("<" + key + ">" + value + "</" + key + ">\r\n")
+	return UDPPacket{
+		message:  result.String(),
+		receiver: group,
 	}
+}
 
-	result.WriteString("</e:property>\r\n")
-	result.WriteString("</e:propertyset>\r\n")
+// Body of an event message: a property for each variable (see 4.3.2)
+type xmlPropertySet struct {
+	XMLName    xml.Name      `xml:"e:propertyset"`
+	Xmlns      string        `xml:"xmlns:e,attr"`
+	Properties []xmlProperty `xml:"e:property"`
+}
 
-	receiver, _ := net.ResolveUDPAddr("udp", host.Host)
-	return UDPPacket{
-		message:  result.String(),
-		receiver: *receiver,
+type xmlProperty struct {
+	Variable ActualArgumentName
+}
+
+func generatePropertySet(variableValueMap map[string]string) string {
+	propertySet := xmlPropertySet{
+		Xmlns:      "urn:schemas-upnp-org:event-1-0",
+		Properties: []xmlProperty{},
 	}
+
+	for _, name := range slices.Sorted(maps.Keys(variableValueMap)) {
+		propertySet.Properties = append(propertySet.Properties, xmlProperty{
+			Variable: ActualArgumentName{
+				XMLName: xml.Name{Local: name},
+				Value:   variableValueMap[name],
+			},
+		})
+	}
+
+	return marshalXML(propertySet, true)
 }
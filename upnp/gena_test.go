@@ -0,0 +1,133 @@
+package upnp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// More stored subscriptions than the buffers of the daemon channels
+const testStoredSubscriptions = 200
+
+func TestRestoreSubscriptionsBeforeStart(t *testing.T) {
+	network := NewVirtualNetwork(7, LinkConfig{})
+	ctx := newTestContext(t, network, "10.0.0.1")
+
+	// Subscriber answering the initial event messages of the restored subscriptions
+	subscriberCtx := newTestContext(t, network, "10.0.0.2")
+	listener, err := getTransport(subscriberCtx).Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	initialEvents := atomic.Int32{}
+	subscriber := &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "NOTIFY" && request.Header.Get("SEQ") == "0" {
+			initialEvents.Add(1)
+		}
+	})}
+	go subscriber.Serve(listener)
+	defer subscriber.Close()
+
+	rootDevice, err := newTestRootDevice(ctx, "http://10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	eventSubURL := rootDevice.Device.ServiceList[0].EventSubURL
+
+	store := NewMemorySubscriptionStore()
+	now := time.Now()
+	for i := range testStoredSubscriptions {
+		store.Save(SubscriptionRecord{SID: "uuid:restored-" + strconv.Itoa(i), EventSubURL: eventSubURL, Callback: "http://10.0.0.2:80/", Timeout: 1800, Creation: now, Expiration: now.Add(time.Hour)})
+	}
+	store.Save(SubscriptionRecord{SID: "uuid:expired", EventSubURL: eventSubURL, Callback: "http://10.0.0.2:80/", Timeout: 1800, Creation: now.Add(-time.Hour), Expiration: now.Add(-time.Minute)})
+	store.Save(SubscriptionRecord{SID: "uuid:other", EventSubURL: "/Other/event", Callback: "http://10.0.0.2:80/", Timeout: 1800, Creation: now, Expiration: now.Add(time.Hour)})
+
+	gena := NewGenaListenerWithStore(ctx, store)
+	httpServer, err := NewHttpServer(context.WithValue(ctx, "gena", gena))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Serving the device does not wait for the daemon
+	served := make(chan struct{})
+	go func() {
+		httpServer.ServeRootDevice(rootDevice)
+		close(served)
+	}()
+	select {
+	case <-served:
+	case <-time.After(testEventWait):
+		t.Fatal("ServeRootDevice blocked before Start")
+	}
+
+	gena.Start()
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), testEventWait)
+		defer cancel()
+		httpServer.Shutdown(ctx)
+		gena.Shutdown(ctx)
+	}()
+
+	deadline := time.Now().Add(testEventWait)
+	for initialEvents.Load() < testStoredSubscriptions {
+		if time.Now().After(deadline) {
+			t.Fatalf("Received %d initial events of %d restored subscriptions", initialEvents.Load(), testStoredSubscriptions)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	restored := 0
+	gena.subscriptionsDB.Range(func(sid any, s any) bool {
+		restored++
+		return true
+	})
+	if restored != testStoredSubscriptions {
+		t.Errorf("Restored %d subscriptions", restored)
+	}
+
+	records, err := store.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sids := map[string]bool{}
+	for _, record := range records {
+		sids[record.SID] = true
+	}
+	if sids["uuid:expired"] || !sids["uuid:other"] || len(records) != testStoredSubscriptions+1 {
+		t.Errorf("Stored %d subscriptions, expired: %t other: %t", len(records), sids["uuid:expired"], sids["uuid:other"])
+	}
+}
+
+// The subscriptions of a device served after Start are restored as well
+func TestRestoreSubscriptionsAfterStart(t *testing.T) {
+	ctx := newTestContext(t, NewVirtualNetwork(7, LinkConfig{}), "10.0.0.1")
+
+	rootDevice, err := newTestRootDevice(ctx, "http://10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemorySubscriptionStore()
+	now := time.Now()
+	store.Save(SubscriptionRecord{SID: "uuid:restored", EventSubURL: rootDevice.Device.ServiceList[0].EventSubURL, Callback: "http://10.0.0.2:80/", Timeout: 1800, Creation: now, Expiration: now.Add(time.Hour)})
+
+	gena := NewGenaListenerWithStore(ctx, store)
+	gena.Start()
+	defer gena.Shutdown(context.Background())
+
+	gena.registerRootDevice(rootDevice)
+
+	deadline := time.Now().Add(testEventWait)
+	for {
+		if _, found := gena.subscriptionsDB.Load("uuid:restored"); found {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Subscription not restored")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,14 +2,15 @@ package upnp
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"io"
 	"net"
 	"net/http"
-	"strconv"
+	"net/url"
+	"strings"
+	"sync"
 
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
-	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/utils"
 )
 
 type UDPPacket struct {
@@ -35,130 +36,212 @@ func (m UDPPacket) String() string {
 func RetrieveDeviceDescriptor(ctx context.Context, maybeDevice MSearchResult) (string, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
-	responseHttp, err := http.Get(maybeDevice.Location)
+	response, err := retrieve(ctx, maybeDevice.Location)
 	if err != nil {
-		log.Error("Error while getting the device locator from: " + maybeDevice.Location)
+		log.Error("[http] Error while getting the device locator from: " + maybeDevice.Location)
 	}
-	defer responseHttp.Body.Close()
 
-	response, err := io.ReadAll(responseHttp.Body)
-
-	return string(response), err
+	return response, err
 }
 
-// Sends the specified request
+// Sends the specified request through the Transport of the request context
 func SendRequest(request *http.Request) (*http.Response, error) {
-	httpClient := http.Client{}
-	return httpClient.Do(request)
+	return newHttpClient(request.Context(), 0).Do(request)
 }
 
 // --------------------------------------------------------------------------------------
 // For upnp device
 // --------------------------------------------------------------------------------------
 
-var httpServerAddress = utils.GetLocalIP()
-
 type HttpServer struct {
 	ctx      context.Context
+	config   HttpConfig
 	listener net.Listener
+	server   *http.Server
+	mux      *http.ServeMux
+	serving  *sync.WaitGroup
 	Port     int
 }
 
+// Options of an HttpServer
+type HttpConfig struct {
+	// Lets the presentation page invoke the actions of the device. The forms are not authenticated: any client
+	// reaching the device can invoke its actions, only the POST sent from other sites are refused
+	PresentationActions bool
+}
+
 func NewHttpServer(ctx context.Context) (HttpServer, error) {
+	return NewHttpServerWithConfig(ctx, HttpConfig{})
+}
+
+// Same as NewHttpServer with the options of config
+func NewHttpServerWithConfig(ctx context.Context, config HttpConfig) (HttpServer, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
-	listener, err := net.Listen("tcp", ":0")
+	listener, err := getTransport(ctx).Listen("tcp", ":0")
 	if err != nil {
 		log.Error("[http] Error while starting listening: " + err.Error())
-		return HttpServer{}, nil
+		return HttpServer{}, err
 	}
 
+	mux := http.NewServeMux()
 	return HttpServer{
 		ctx:      ctx,
+		config:   config,
 		listener: listener,
+		server:   &http.Server{Handler: mux},
+		mux:      mux,
+		serving:  &sync.WaitGroup{},
 		Port:     listener.Addr().(*net.TCPAddr).Port,
 	}, nil
 }
 
-func (httpServer HttpServer) ServeRootDevice(rootDevice RootDevice, devicePresentationUrl string) {
-	go func() {
+// Starts serving the requests until Shutdown
+func (httpServer HttpServer) Start() {
+	httpServer.serving.Go(func() {
 		log := httpServer.ctx.Value("logger").(logging.Logger)
 
-		httpMux := http.NewServeMux()
+		log.Info("[http] Listening for request at " + httpServer.listener.Addr().String())
+		err := httpServer.server.Serve(httpServer.listener)
+		if !errors.Is(err, http.ErrServerClosed) {
+			log.Error("[http] Error occurred while listen and serve: " + err.Error())
+		}
+	})
+}
+
+// Stops accepting requests and waits for the in-flight ones (e.g. SOAP calls) to complete or ctx to be done
+func (httpServer HttpServer) Shutdown(ctx context.Context) error {
+	log := httpServer.ctx.Value("logger").(logging.Logger)
+
+	err := httpServer.server.Shutdown(ctx)
+	if err != nil {
+		log.Warn("[http] Requests still in progress at shutdown: " + err.Error())
+		httpServer.server.Close()
+	}
+	httpServer.listener.Close() // Not closed by Shutdown if Start was never called
+	httpServer.serving.Wait()
+
+	log.Info("[http] Stopped listening at " + httpServer.listener.Addr().String())
+
+	return err
+}
 
-		httpMux.HandleFunc(devicePresentationUrl, func(resp http.ResponseWriter, req *http.Request) {
-			deviceDescriptionHandler(httpServer.ctx, rootDevice, httpServer.Port, req, resp)
-		})
-		for _, embeddedDevice := range rootDevice.Device.EmbeddedDevices {
-			httpMux.HandleFunc(embeddedDevice.PresentationURL, func(resp http.ResponseWriter, req *http.Request) {
-				deviceDescriptionHandler(httpServer.ctx, rootDevice, httpServer.Port, req, resp)
+// Serves the description of rootDevice at its DescriptionURL, the presentation page and the icons of each
+// device and the SCPD, control and eventing URLs of each service, once the server is started.
+// The stored subscriptions to the services are restored by the GenaState of the context, if any, once started.
+func (httpServer HttpServer) ServeRootDevice(rootDevice RootDevice) {
+	log := httpServer.ctx.Value("logger").(logging.Logger)
+
+	gena, isGena := httpServer.ctx.Value("gena").(*GenaState)
+	if isGena {
+		gena.registerRootDevice(rootDevice)
+	}
+
+	err := rootDevice.Validate()
+	if err != nil {
+		log.Warn("[http] Description of " + rootDevice.Device.UDN + " not valid: " + err.Error())
+	}
+
+	patterns := map[string]bool{}
+	handle := func(rawURL string, handler http.HandlerFunc) {
+		pattern, err := servePattern(rootDevice.DescriptionURL, rawURL)
+		if err != nil {
+			log.Error("[http] URL not valid " + rawURL + ": " + err.Error())
+			return
+		}
+		if patterns[pattern] {
+			log.Warn("[http] URL served twice: " + rawURL)
+			return
+		}
+		patterns[pattern] = true
+		httpServer.mux.HandleFunc(pattern, handler)
+	}
+
+	handle(rootDevice.DescriptionURL, func(resp http.ResponseWriter, req *http.Request) {
+		deviceDescriptionHandler(httpServer.ctx, rootDevice, req, resp)
+	})
+
+	for _, device := range flattenDevices(rootDevice.Device) {
+		if len(device.PresentationURL) > 0 {
+			handle(device.PresentationURL, func(resp http.ResponseWriter, req *http.Request) {
+				presentationHandler(httpServer.ctx, device, httpServer.config.PresentationActions, req, resp)
 			})
 		}
 
-		for _, service := range rootDevice.Device.ServiceList {
-			httpMux.HandleFunc(service.SCPDURL, func(resp http.ResponseWriter, req *http.Request) {
+		for _, icon := range device.IconList {
+			if len(icon.Data) > 0 {
+				handle(icon.Url, func(resp http.ResponseWriter, req *http.Request) {
+					iconHandler(httpServer.ctx, icon, req, resp)
+				})
+			}
+		}
+
+		for _, service := range device.ServiceList {
+			handle(service.SCPDURL, func(resp http.ResponseWriter, req *http.Request) {
 				scpdURLHandler(httpServer.ctx, rootDevice, req, resp)
 			})
-			httpMux.HandleFunc(service.ControlURL, func(resp http.ResponseWriter, req *http.Request) {
+			handle(service.ControlURL, func(resp http.ResponseWriter, req *http.Request) {
 				serviceControlHandler(httpServer.ctx, rootDevice, req, resp)
 			})
-			httpMux.HandleFunc(service.EventSubURL, func(resp http.ResponseWriter, req *http.Request) {
+			handle(service.EventSubURL, func(resp http.ResponseWriter, req *http.Request) {
 				serviceEventHandler(httpServer.ctx, rootDevice, req, resp)
 			})
 		}
-		for _, embeddedDevice := range rootDevice.Device.EmbeddedDevices {
-			for _, service := range embeddedDevice.ServiceList {
-				httpMux.HandleFunc(service.SCPDURL, func(resp http.ResponseWriter, req *http.Request) {
-					scpdURLHandler(httpServer.ctx, rootDevice, req, resp)
-				})
-				httpMux.HandleFunc(service.ControlURL, func(resp http.ResponseWriter, req *http.Request) {
-					serviceControlHandler(httpServer.ctx, rootDevice, req, resp)
-				})
-			}
-		}
-
-		log.Info("[http] Listening for request at " + httpServer.listener.Addr().String())
-		err := http.Serve(httpServer.listener, httpMux)
-		log.Error("[http] Error occurred while listen and serve: " + err.Error())
-	}()
+	}
 }
 
-func deviceDescriptionHandler(ctx context.Context, rootDevice RootDevice, httpServerPort int, request *http.Request, response http.ResponseWriter) {
-	log := ctx.Value("logger").(logging.Logger)
+// Returns the ServeMux pattern matching exactly the path of rawURL, resolved against the description URL
+func servePattern(descriptionURL string, rawURL string) (string, error) {
+	path, err := servePath(descriptionURL, rawURL)
+	if err != nil {
+		return "", err
+	}
 
-	foundDeviceHandler := func(device SerializableXML) {
-		log.Info("[http] Request from " + request.RemoteAddr + " resource " + request.RequestURI + " -> OK - FOUND")
-		response.Header().Set("Content-Type", "application/xml")
-		response.WriteHeader(http.StatusOK)
-		fmt.Fprint(response, device.StringXML())
+	if strings.HasSuffix(path, "/") {
+		return path + "{$}", nil // Otherwise the pattern matches the whole subtree
 	}
+	return path, nil
+}
 
-	flagFoundDevice := false
-	if rootDevice.Device.PresentationURL == "http://"+httpServerAddress+":"+strconv.Itoa(httpServerPort)+request.RequestURI {
-		flagFoundDevice = true
-		foundDeviceHandler(rootDevice)
+// Returns the path rawURL is served at, resolved against the description URL
+func servePath(descriptionURL string, rawURL string) (string, error) {
+	baseURL, err := url.Parse(descriptionURL)
+	if err != nil {
+		return "", err
 	}
-	if !flagFoundDevice {
-		for _, embeddedDevice := range rootDevice.Device.EmbeddedDevices {
-			if embeddedDevice.PresentationURL == "http://"+httpServerAddress+":"+strconv.Itoa(httpServerPort)+request.RequestURI {
-				flagFoundDevice = true
-				foundDeviceHandler(embeddedDevice)
-			}
-		}
+
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
 	}
 
-	if !flagFoundDevice {
-		log.Warn("[http] Request from " + request.RemoteAddr + " resource " + request.RequestURI + " -> 404 - NOT FOUND")
-		response.Header().Set("Content-Type", "text/plain")
-		response.WriteHeader(http.StatusNotFound)
-		fmt.Fprint(response, "Sorry you requested some device descriptor that is not here. Are you sure you are talking with the right device?")
+	path := baseURL.ResolveReference(parsedURL).EscapedPath()
+	if len(path) == 0 {
+		path = "/"
 	}
+	return path, nil
+}
+
+func deviceDescriptionHandler(ctx context.Context, rootDevice RootDevice, request *http.Request, response http.ResponseWriter) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	// The URLs in the description point to the address the request was received at (e.g. IPv6, see Annex A)
+	var localIP net.IP
+	if localAddr, ok := request.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		localIP = localAddr.IP
+	}
+
+	log.Info("[http] Request from " + request.RemoteAddr + " resource " + request.RequestURI + " -> OK - FOUND")
+	response.Header().Set("CONTENT-TYPE", "text/xml; charset=\"utf-8\"")
+	response.WriteHeader(http.StatusOK)
+	fmt.Fprint(response, rootDeviceAt(rootDevice, localIP).StringXML())
 }
 
 func scpdURLHandler(ctx context.Context, rootDevice RootDevice, request *http.Request, response http.ResponseWriter) {
 	serviceFoundHandler := func(service Service) {
+		response.Header().Set("CONTENT-TYPE", "text/xml; charset=\"utf-8\"")
 		response.WriteHeader(http.StatusOK)
-		fmt.Fprint(response, service.SCPD.StringXML())
+		fmt.Fprint(response, service.SCPD.StringXML(rootDevice.ConfigId))
 	}
 
 	serviceNotFoundHandler := func() {
@@ -222,23 +305,16 @@ func serviceRequestHandler(ctx context.Context, rootDevice RootDevice, request *
 		response.Header().Set("Content-Type", "text/plain")
 	}
 
+	// The URLs of the services are matched as served, resolved against the description URL
+	requestPath := request.URL.EscapedPath()
 	flagFoundService := false
-	for _, service := range rootDevice.Device.ServiceList {
-		if extractor(service) == request.RequestURI {
-
-			flagFoundService = true
-			prepareOKresponse()
-			serviceFoundHandler(service)
-		}
-	}
-	if !flagFoundService {
-		for _, embeddedDevice := range rootDevice.Device.EmbeddedDevices {
-			for _, service := range embeddedDevice.ServiceList {
-				if extractor(service) == request.RequestURI {
-					flagFoundService = true
-					prepareOKresponse()
-					serviceFoundHandler(service)
-				}
+	for _, device := range flattenDevices(rootDevice.Device) {
+		for _, service := range device.ServiceList {
+			servicePath, err := servePath(rootDevice.DescriptionURL, extractor(service))
+			if !flagFoundService && err == nil && servicePath == requestPath {
+				flagFoundService = true
+				prepareOKresponse()
+				serviceFoundHandler(service)
 			}
 		}
 	}
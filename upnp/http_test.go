@@ -0,0 +1,134 @@
+package upnp
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+const testDeviceUrl = "http://10.0.0.1:8080"
+
+// Returns the handler of an HttpServer serving the test device, not listening on any network
+func newTestHandler(t *testing.T, config HttpConfig, customize func(*RootDevice)) (http.Handler, RootDevice) {
+	t.Helper()
+
+	ctx, _ := logging.Init(context.Background(), slog.LevelError)
+
+	host, err := NewVirtualNetwork(1, LinkConfig{}).NewHost([]byte{10, 0, 0, 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx = context.WithValue(ctx, "transport", host)
+
+	httpServer, err := NewHttpServerWithConfig(ctx, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		httpServer.Shutdown(context.Background())
+	})
+
+	rootDevice, err := newTestRootDevice(ctx, testDeviceUrl)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootDevice.Device.PresentationURL = "/"
+	if customize != nil {
+		customize(&rootDevice)
+	}
+	httpServer.ServeRootDevice(rootDevice)
+
+	return httpServer.mux, rootDevice
+}
+
+func TestServiceURLsResolved(t *testing.T) {
+	handler, _ := newTestHandler(t, HttpConfig{}, func(rootDevice *RootDevice) {
+		rootDevice.DescriptionURL = testDeviceUrl + "/light/description.xml"
+		service := &rootDevice.Device.ServiceList[0]
+		service.SCPDURL = "SwitchPower.xml"                         // Relative to the description
+		service.ControlURL = testDeviceUrl + "/control/SwitchPower" // Absolute
+	})
+
+	response := httptest.NewRecorder()
+	handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/light/SwitchPower.xml", nil))
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "<name>Turn</name>") {
+		t.Errorf("SCPD at a relative URL: %d %s", response.Code, response.Body.String())
+	}
+
+	body := soapEnvelope(`<u:Turn xmlns:u="` + testServiceType + `"><StateValue>1</StateValue></u:Turn>`)
+	request := httptest.NewRequest(http.MethodPost, "/control/SwitchPower", strings.NewReader(body))
+	request.Header.Set("CONTENT-TYPE", "text/xml; charset=\"utf-8\"")
+	request.Header.Set("SOAPACTION", "\""+testServiceType+"#Turn\"")
+	response = httptest.NewRecorder()
+	handler.ServeHTTP(response, request)
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "<ActualValue>1</ActualValue>") {
+		t.Errorf("Control at an absolute URL: %d %s", response.Code, response.Body.String())
+	}
+}
+
+func TestScpdConfigIdFollowsRootDevice(t *testing.T) {
+	handler, rootDevice := newTestHandler(t, HttpConfig{}, func(rootDevice *RootDevice) {
+		rootDevice.ConfigId = 7
+	})
+
+	for _, path := range []string{"/description.xml", rootDevice.Device.ServiceList[0].SCPDURL} {
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, httptest.NewRequest(http.MethodGet, path, nil))
+		if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), `configId="7"`) {
+			t.Errorf("%s without the configId of the root device: %d %s", path, response.Code, response.Body.String())
+		}
+	}
+}
+
+func TestPresentationActions(t *testing.T) {
+	form := url.Values{
+		"serviceId":  {"urn:upnp-org:serviceId:SwitchPower"},
+		"action":     {"Turn"},
+		"StateValue": {"1"},
+	}
+	post := func(handler http.Handler, origin string) *httptest.ResponseRecorder {
+		request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+		request.Header.Set("CONTENT-TYPE", "application/x-www-form-urlencoded")
+		if len(origin) > 0 {
+			request.Header.Set("Origin", origin)
+		}
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+		return response
+	}
+
+	handler, rootDevice := newTestHandler(t, HttpConfig{}, nil)
+	page := httptest.NewRecorder()
+	handler.ServeHTTP(page, httptest.NewRequest(http.MethodGet, "/", nil))
+	if page.Code != http.StatusOK || strings.Contains(page.Body.String(), "<form") {
+		t.Errorf("Forms shown without PresentationActions: %d", page.Code)
+	}
+	if response := post(handler, "http://example.com"); response.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST without PresentationActions answered %d", response.Code)
+	}
+
+	handler, rootDevice = newTestHandler(t, HttpConfig{PresentationActions: true}, nil)
+	if response := post(handler, ""); response.Code != http.StatusForbidden {
+		t.Errorf("POST without Origin answered %d", response.Code)
+	}
+	if response := post(handler, "http://attacker.example"); response.Code != http.StatusForbidden {
+		t.Errorf("POST from another origin answered %d", response.Code)
+	}
+	if value, _ := rootDevice.Device.ServiceList[0].State.Value("state"); value != "0" {
+		t.Fatalf("Action invoked by a refused POST, state is %s", value)
+	}
+
+	response := post(handler, "http://example.com") // Host of httptest.NewRequest
+	if response.Code != http.StatusOK || !strings.Contains(response.Body.String(), "ActualValue = 1") {
+		t.Errorf("POST from the page answered %d %s", response.Code, response.Body.String())
+	}
+	if value, _ := rootDevice.Device.ServiceList[0].State.Value("state"); value != "1" {
+		t.Errorf("state is %s after the POST", value)
+	}
+}
@@ -0,0 +1,266 @@
+package upnp
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
+)
+
+// Returns the stack of each running goroutine by its id line ("goroutine N")
+func goroutineStacks() map[string]string {
+	buffer := make([]byte, 1<<16)
+	for {
+		n := runtime.Stack(buffer, true)
+		if n < len(buffer) {
+			buffer = buffer[:n]
+			break
+		}
+		buffer = make([]byte, 2*len(buffer))
+	}
+
+	result := map[string]string{}
+	for _, stack := range bytes.Split(buffer, []byte("\n\n")) {
+		id, _, _ := strings.Cut(string(stack), " [")
+		result[id] = string(stack)
+	}
+
+	return result
+}
+
+// Fails t if goroutines not in baseline are still running after testEventWait
+func checkGoroutinesStopped(t *testing.T, baseline map[string]string) {
+	t.Helper()
+
+	deadline := time.Now().Add(testEventWait)
+	for {
+		leaked := []string{}
+		for id, stack := range goroutineStacks() {
+			_, found := baseline[id]
+			if !found && !strings.Contains(stack, "upnp.checkGoroutinesStopped") { // Not the goroutine running the check
+				leaked = append(leaked, stack)
+			}
+		}
+		if len(leaked) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines still running:\n\n%s", len(leaked), strings.Join(leaked, "\n\n"))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Every goroutine of a device and of a control point returns once they are shut down
+func TestLifecycleGoroutines(t *testing.T) {
+	baseline := goroutineStacks()
+
+	network := NewVirtualNetwork(7, LinkConfig{})
+	testDevice := startTestDevice(t, newTestContext(t, network, "10.0.0.1"))
+
+	ctx, cancelRegistry := context.WithCancel(newTestContext(t, network, "10.0.0.2"))
+	defer cancelRegistry()
+	registry, err := NewDeviceRegistry(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	manager, err := NewSubscriptionManagerWithRegistry(ctx, registry)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := registry.SearchMx(ctx, testDeviceType, 1); err != nil {
+		t.Fatal(err)
+	}
+	rootDevice := discoverTestDevice(t, ctx)
+	service := rootDevice.Device.ServiceList[0]
+
+	subscription, err := manager.Subscribe(rootDevice, service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = InvokeAction(ctx, service, "Turn", []device.Argument{{Name: "StateValue", Value: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for seq := range 2 {
+		select {
+		case event := <-subscription.Events():
+			if event.Seq != seq {
+				t.Fatalf("Expected SEQ %d, received %s", seq, event.String())
+			}
+		case <-time.After(testEventWait):
+			t.Fatalf("Event SEQ %d not received", seq)
+		}
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), testEventWait)
+	defer cancel()
+	if err := manager.Shutdown(shutdownCtx); err != nil {
+		t.Error(err)
+	}
+	testDevice.stop(t)
+	cancelRegistry() // The registry listens until its context is done
+
+	checkGoroutinesStopped(t, baseline)
+}
+
+// Subscriptions received while the GenaState shuts down are either delivered or refused, Shutdown returns
+// when its ctx is done also if the subscribers do not answer
+func TestLifecycleSubscribeDuringShutdown(t *testing.T) {
+	const subscribers = 4
+
+	baseline := goroutineStacks()
+
+	network := NewVirtualNetwork(7, LinkConfig{})
+	testDevice := startTestDevice(t, newTestContext(t, network, "10.0.0.1"))
+
+	// Subscriber never answering the event messages
+	ctx := newTestContext(t, network, "10.0.0.2")
+	eventSubURL, err := genaEventSubURL(ctx, testDevice.rootDevice, testDevice.rootDevice.Device.ServiceList[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := getTransport(ctx).Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	release := make(chan struct{})
+	subscriber := &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		<-release
+	})}
+	go subscriber.Serve(listener)
+
+	subscribe := func() (int, error) {
+		request, err := http.NewRequest("SUBSCRIBE", eventSubURL.String(), nil)
+		if err != nil {
+			return 0, err
+		}
+		request.Header.Set("CALLBACK", "<http://10.0.0.2:80/>")
+		request.Header.Set("NT", "upnp:event")
+		request.Header.Set("TIMEOUT", "Second-1800")
+
+		response, err := newHttpClient(ctx, testEventWait).Do(request)
+		if err != nil {
+			return 0, err
+		}
+		response.Body.Close()
+		return response.StatusCode, nil
+	}
+
+	accepted := atomic.Int32{}
+	stop := make(chan struct{})
+	var subscribing sync.WaitGroup
+	for range subscribers {
+		subscribing.Go(func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if status, err := subscribe(); err == nil && status == http.StatusOK {
+					accepted.Add(1)
+				}
+			}
+		})
+	}
+	for accepted.Load() < subscribers {
+		time.Sleep(time.Millisecond)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- testDevice.gena.Shutdown(shutdownCtx)
+	}()
+	select {
+	case err := <-shutdown:
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Shutdown with undelivered events returned %v", err)
+		}
+	case <-time.After(testEventWait):
+		t.Fatal("Shutdown blocked by the subscriptions received meanwhile")
+	}
+
+	if status, err := subscribe(); err != nil || status != http.StatusServiceUnavailable {
+		t.Errorf("Subscription after Shutdown answered %d %v", status, err)
+	}
+
+	close(stop)
+	subscribing.Wait()
+	close(release)
+	subscriber.Close()
+	testDevice.stop(t)
+
+	checkGoroutinesStopped(t, baseline)
+}
+
+// SubscriptionManager.Shutdown aborts the unsubscriptions still in flight when its ctx is done
+func TestLifecycleManagerShutdownAbortsUnsubscribe(t *testing.T) {
+	baseline := goroutineStacks()
+
+	network := NewVirtualNetwork(7, LinkConfig{})
+
+	// Device accepting the subscription and never answering the unsubscription
+	deviceCtx := newTestContext(t, network, "10.0.0.1")
+	listener, err := getTransport(deviceCtx).Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	aborted := make(chan struct{}, 1)
+	device := &http.Server{Handler: http.HandlerFunc(func(response http.ResponseWriter, request *http.Request) {
+		if request.Method == "SUBSCRIBE" {
+			response.Header().Set("SID", "uuid:stuck")
+			response.Header().Set("TIMEOUT", "Second-1800")
+			return
+		}
+		<-request.Context().Done()
+		aborted <- struct{}{}
+	})}
+	go device.Serve(listener)
+	defer device.Close()
+
+	rootDevice, err := newTestRootDevice(deviceCtx, "http://10.0.0.1:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := newTestContext(t, network, "10.0.0.2")
+	manager, err := NewSubscriptionManager(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Subscribe(rootDevice, rootDevice.Device.ServiceList[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := manager.Shutdown(shutdownCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown with the unsubscription in flight returned %v", err)
+	}
+	// Well before the timeout of the HTTP client
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Shutdown returned after %s", elapsed)
+	}
+
+	select {
+	case <-aborted:
+	case <-time.After(time.Second):
+		t.Fatal("Unsubscription not aborted by Shutdown")
+	}
+
+	device.Close()
+	checkGoroutinesStopped(t, baseline)
+}
@@ -0,0 +1,422 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+const (
+	genaResubscribeSeconds = 30 // Wait before subscribing again to a device that refused or missed the subscription
+	genaEventChannelSize   = 64 // Event messages of a managed subscription waiting to be received from its channel
+)
+
+// Subscriptions of a control point sharing one HTTP server for the event messages, dispatched by SID.
+// The subscriptions are renewed before they expire; the lost ones are subscribed again when the device is
+// advertised again via SSDP or after genaResubscribeSeconds.
+type SubscriptionManager struct {
+	ctx           context.Context
+	cancel        context.CancelFunc
+	port          int
+	mutex         sync.Mutex
+	subscriptions []*ManagedSubscription
+	bySid         map[string]*ManagedSubscription
+	sidAdded      chan struct{} // Closed and replaced when a SID is added: wakes up the event messages received before it
+	stopping      bool
+}
+
+// Subscription to a service kept by a SubscriptionManager. The SID changes when the subscription is lost and
+// subscribed again: the events of the new SID start from the initial event (SEQ 0).
+type ManagedSubscription struct {
+	manager         *SubscriptionManager
+	ctx             context.Context
+	cancel          context.CancelFunc
+	service         Service
+	stateVars       []string
+	events          chan Event
+	reappeared      chan struct{} // The device has been advertised again: it may have lost the subscription
+	maintained      chan struct{} // Closed when maintain returns
+	mutex           sync.Mutex
+	rootDevice      RootDevice
+	subscriptionUrl *url.URL
+	sid             string
+	sequence        eventSequence
+	unsubscribeOnce sync.Once
+	unsubscribeErr  error
+}
+
+// Starts the HTTP server receiving the event messages of the subscriptions until Shutdown
+func NewSubscriptionManager(ctx context.Context) (*SubscriptionManager, error) {
+	return NewSubscriptionManagerWithRegistry(ctx, nil)
+}
+
+// Same as NewSubscriptionManager, the subscriptions to the devices advertised again in registry (e.g. after
+// a reboot) are renewed at once, subscribed again if the device lost them
+func NewSubscriptionManagerWithRegistry(ctx context.Context, registry *DeviceRegistry) (*SubscriptionManager, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	managerCtx, cancel := context.WithCancel(ctx)
+	result := &SubscriptionManager{
+		ctx:           managerCtx,
+		cancel:        cancel,
+		subscriptions: []*ManagedSubscription{},
+		bySid:         make(map[string]*ManagedSubscription),
+		sidAdded:      make(chan struct{}),
+	}
+
+	addr, err := serveEventMessages(managerCtx, http.HandlerFunc(result.notifyHandler))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	result.port = addr.Port
+	log.Info("[gena] Start listening for subscription messages at " + addr.String())
+
+	if registry != nil {
+		registry.AddEventHandler(result.deviceAdvertised)
+	}
+
+	return result, nil
+}
+
+// Subscribes to the events of service, they are received from the Events channel of the subscription
+func (manager *SubscriptionManager) Subscribe(rootDevice RootDevice, service Service, stateVars ...string) (*ManagedSubscription, error) {
+	log := manager.ctx.Value("logger").(logging.Logger)
+
+	ctx, cancel := context.WithCancel(manager.ctx)
+	result := &ManagedSubscription{
+		manager:    manager,
+		ctx:        ctx,
+		cancel:     cancel,
+		service:    service,
+		stateVars:  stateVars,
+		events:     make(chan Event, genaEventChannelSize),
+		reappeared: make(chan struct{}, 1),
+		maintained: make(chan struct{}),
+		rootDevice: rootDevice,
+	}
+
+	timeout, err := result.subscribe()
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	manager.mutex.Lock()
+	stopping := manager.stopping
+	if !stopping {
+		manager.subscriptions = append(manager.subscriptions, result)
+	}
+	manager.mutex.Unlock()
+
+	go func() {
+		defer close(result.maintained)
+		if !stopping {
+			result.maintain(timeout)
+		}
+	}()
+
+	if stopping {
+		result.Unsubscribe()
+		return nil, errors.New("Subscription manager shut down")
+	}
+
+	log.Info("[gena] Managing subscription " + result.SID() + " to " + service.ServiceId + " of " + rootDevice.Device.UDN)
+
+	return result, nil
+}
+
+// Unsubscribes from all the subscriptions and stops receiving event messages.
+// The unsubscriptions not completed before ctx is done are aborted and left to expire.
+func (manager *SubscriptionManager) Shutdown(ctx context.Context) error {
+	log := manager.ctx.Value("logger").(logging.Logger)
+
+	manager.mutex.Lock()
+	manager.stopping = true
+	subscriptions := slices.Clone(manager.subscriptions)
+	manager.mutex.Unlock()
+
+	unsubscribing := sync.WaitGroup{}
+	errs := make([]error, len(subscriptions))
+	for i, subscription := range subscriptions {
+		unsubscribing.Go(func() {
+			errs[i] = subscription.Unsubscribe()
+		})
+	}
+
+	unsubscribed := make(chan struct{})
+	go func() {
+		unsubscribing.Wait()
+		close(unsubscribed)
+	}()
+
+	var err error
+	select {
+	case <-unsubscribed:
+		err = errors.Join(errs...)
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+	manager.cancel() // Aborts the unsubscriptions in flight
+	<-unsubscribed
+
+	log.Info("[gena] Stopped managing " + strconv.Itoa(len(subscriptions)) + " subscriptions")
+
+	return err
+}
+
+// Handles a NOTIFY dispatching it to the subscription with its SID, the response codes follow 4.3.2
+func (manager *SubscriptionManager) notifyHandler(response http.ResponseWriter, request *http.Request) {
+	log := manager.ctx.Value("logger").(logging.Logger)
+
+	event, status := readEventMessage(manager.ctx, request)
+	if status != http.StatusOK {
+		response.WriteHeader(status)
+		return
+	}
+
+	subscription, found := manager.lookup(event.SID)
+	if !found {
+		log.Warn("[gena] Received event from " + request.RemoteAddr + " with unknown SID: " + event.SID)
+		response.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+
+	acceptEventMessage(response)
+
+	log.Debug("[gena] Received event from " + request.RemoteAddr + " " + event.String())
+
+	subscription.sequence.deliver(manager.ctx, event, subscription.send)
+}
+
+// Returns the subscription with sid. An event message may be received before the SUBSCRIBE response:
+// the SID is waited for up to genaSidWaitSeconds.
+func (manager *SubscriptionManager) lookup(sid string) (*ManagedSubscription, bool) {
+	deadline := time.After(genaSidWaitSeconds * time.Second)
+	for {
+		manager.mutex.Lock()
+		subscription, found := manager.bySid[sid]
+		sidAdded := manager.sidAdded
+		manager.mutex.Unlock()
+
+		if found {
+			return subscription, true
+		}
+
+		select {
+		case <-sidAdded:
+		case <-deadline:
+			return nil, false
+		case <-manager.ctx.Done():
+			return nil, false
+		}
+	}
+}
+
+func (manager *SubscriptionManager) addSid(sid string, subscription *ManagedSubscription) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	manager.bySid[sid] = subscription
+	close(manager.sidAdded)
+	manager.sidAdded = make(chan struct{})
+}
+
+func (manager *SubscriptionManager) removeSid(sid string) {
+	manager.mutex.Lock()
+	defer manager.mutex.Unlock()
+
+	delete(manager.bySid, sid)
+}
+
+// Wakes up the subscriptions to the device of an advertisement added or updated in the registry,
+// following its new LOCATION
+func (manager *SubscriptionManager) deviceAdvertised(event DeviceRegistryEvent) {
+	if event.Type == DeviceRemoved || manager.ctx.Err() != nil {
+		return
+	}
+
+	udn, _, _ := strings.Cut(event.Device.USN, "::")
+
+	manager.mutex.Lock()
+	subscriptions := slices.Clone(manager.subscriptions)
+	manager.mutex.Unlock()
+
+	for _, subscription := range subscriptions {
+		subscription.mutex.Lock()
+		found := subscription.rootDevice.Device.UDN == udn
+		if found && len(event.Device.Location) > 0 {
+			subscription.rootDevice.DescriptionURL = event.Device.Location
+		}
+		subscription.mutex.Unlock()
+
+		if found {
+			select {
+			case subscription.reappeared <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// Returns the channel of the event messages, closed by Unsubscribe. A slow receiver delays the responses
+// to the device: the event messages not accepted in time are retried, then dropped by the device.
+func (subscription *ManagedSubscription) Events() <-chan Event {
+	return subscription.events
+}
+
+// Returns the current SID, empty while the subscription is lost
+func (subscription *ManagedSubscription) SID() string {
+	subscription.mutex.Lock()
+	defer subscription.mutex.Unlock()
+
+	return subscription.sid
+}
+
+// Ends the subscription: the device is asked to remove it and the Events channel is closed
+func (subscription *ManagedSubscription) Unsubscribe() error {
+	subscription.unsubscribeOnce.Do(func() {
+		manager := subscription.manager
+
+		subscription.cancel()
+		<-subscription.maintained
+
+		// No event is being sent: the delivery holds the sequence and gives up once the context is done
+		subscription.sequence.mutex.Lock()
+		close(subscription.events)
+		subscription.sequence.mutex.Unlock()
+
+		subscription.mutex.Lock()
+		sid := subscription.sid
+		rootDevice := subscription.rootDevice
+		subscription.mutex.Unlock()
+
+		manager.mutex.Lock()
+		manager.subscriptions = slices.DeleteFunc(manager.subscriptions, func(s *ManagedSubscription) bool {
+			return s == subscription
+		})
+		delete(manager.bySid, sid)
+		manager.mutex.Unlock()
+
+		if len(sid) > 0 {
+			subscription.unsubscribeErr = GenaUnsubscribeFromService(manager.ctx, rootDevice, subscription.service, sid)
+		}
+	})
+
+	return subscription.unsubscribeErr
+}
+
+// Sends event to the Events channel until the subscription is ended
+func (subscription *ManagedSubscription) send(event Event) {
+	if subscription.ctx.Err() != nil {
+		return
+	}
+
+	select {
+	case subscription.events <- event:
+	case <-subscription.ctx.Done():
+	}
+}
+
+// Sends a new subscription to the service at the current location of the device
+func (subscription *ManagedSubscription) subscribe() (int, error) {
+	subscription.mutex.Lock()
+	rootDevice := subscription.rootDevice
+	subscription.mutex.Unlock()
+
+	subscriptionUrl, err := genaEventSubURL(subscription.ctx, rootDevice, subscription.service)
+	if err != nil {
+		return 0, err
+	}
+
+	callbackUrl, err := genaCallbackURL(subscription.ctx, subscriptionUrl, subscription.manager.port)
+	if err != nil {
+		return 0, err
+	}
+
+	sid, timeout, err := genaSendSubscription(subscription.ctx, subscriptionUrl, callbackUrl, subscription.stateVars)
+	if err != nil {
+		return 0, err
+	}
+
+	subscription.sequence.restart(sid)
+
+	subscription.mutex.Lock()
+	subscription.sid = sid
+	subscription.subscriptionUrl = subscriptionUrl
+	subscription.mutex.Unlock()
+
+	subscription.manager.addSid(sid, subscription)
+
+	return timeout, nil
+}
+
+// Renews the subscription before it expires or when the device is advertised again until it is ended.
+// A subscription lost is subscribed again every genaResubscribeSeconds.
+func (subscription *ManagedSubscription) maintain(timeout int) {
+	lost := false
+	for {
+		var wait <-chan time.Time
+		switch {
+		case lost:
+			wait = time.After(genaResubscribeSeconds * time.Second)
+		case timeout != genaInfiniteTimeout:
+			wait = time.After(genaRenewalDelay(timeout))
+		}
+
+		select {
+		case <-subscription.ctx.Done():
+			return
+		case <-subscription.reappeared:
+		case <-wait:
+		}
+
+		timeout, lost = subscription.refresh()
+	}
+}
+
+// Renews the subscription, subscribes again if the renewal fails (e.g. the device rebooted or moved).
+// Reports whether the subscription is lost.
+func (subscription *ManagedSubscription) refresh() (int, bool) {
+	log := subscription.ctx.Value("logger").(logging.Logger)
+
+	subscription.mutex.Lock()
+	sid := subscription.sid
+	subscriptionUrl := subscription.subscriptionUrl
+	subscription.mutex.Unlock()
+
+	if len(sid) > 0 {
+		timeout, err := genaRenewSubscription(subscription.ctx, subscriptionUrl, sid)
+		if err == nil {
+			log.Debug("[gena] Subscription " + sid + " renewed for " + strconv.Itoa(timeout) + " seconds")
+			return timeout, false
+		}
+		if subscription.ctx.Err() != nil {
+			return 0, true
+		}
+		log.Warn("[gena] Renewal of subscription " + sid + " failed, subscribing again: " + err.Error())
+
+		subscription.manager.removeSid(sid)
+		subscription.mutex.Lock()
+		subscription.sid = ""
+		subscription.mutex.Unlock()
+	}
+
+	timeout, err := subscription.subscribe()
+	if err != nil {
+		if subscription.ctx.Err() == nil {
+			log.Warn("[gena] Subscription to " + subscription.service.ServiceId + " lost, retrying in " + strconv.Itoa(genaResubscribeSeconds) + " seconds: " + err.Error())
+		}
+		return 0, true
+	}
+
+	return timeout, false
+}
@@ -0,0 +1,149 @@
+package upnp
+
+import (
+	"context"
+	"math"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// Wait of a change within minimumDelta of a variable without maximumRate: it is evented if no other change
+// exceeds minimumDelta meanwhile, so that the final value is always delivered
+const genaMinimumDeltaWindow = time.Second
+
+// Eventing state of a state variable with maximumRate or minimumDelta (see 4.3)
+type moderatedVariable struct {
+	service      Service
+	stateVar     *StateVariable
+	evented      bool // A value has been evented: lastValue and lastEvent are set
+	lastValue    string
+	lastEvent    time.Time
+	pending      bool // A value is waiting for pendingDue to be evented
+	pendingValue string
+	pendingDue   time.Time
+}
+
+// Returns the changes of notification to event now. The changes of a variable within maximumRate of its last
+// event are coalesced: only the last one is evented when the window ends, through moderationDue.
+// The numeric changes within minimumDelta of the last evented value are held as well: the last one is evented
+// when its window ends unless a change exceeding minimumDelta is evented before.
+func (state *GenaState) moderate(ctx context.Context, notification notification, now time.Time) notification {
+	result := notification
+	result.stateVariableValues = []stateVariableValue{}
+
+	for _, value := range notification.stateVariableValues {
+		if value.stateVar.MaximumRate <= 0 && value.stateVar.MinimumDelta <= 0 {
+			result.stateVariableValues = append(result.stateVariableValues, value)
+			continue
+		}
+
+		variable := state.moderatedVariable(notification.service, value.stateVar)
+
+		windowEnd := variable.lastEvent.Add(value.stateVar.MaximumRate)
+		inWindow := variable.evented && now.Before(windowEnd)
+		if !variable.evented || !inWindow && !withinMinimumDelta(value.stateVar, variable.lastValue, value.value) {
+			variable.evented = true
+			variable.lastValue = value.value
+			variable.lastEvent = now
+			variable.pending = false // Superseded
+			result.stateVariableValues = append(result.stateVariableValues, value)
+			continue
+		}
+
+		// The last value wins when the window already scheduled ends
+		variable.pendingValue = value.value
+		if variable.pending {
+			continue
+		}
+
+		variable.pending = true
+		variable.pendingDue = windowEnd
+		if !inWindow {
+			variable.pendingDue = now.Add(max(value.stateVar.MaximumRate, genaMinimumDeltaWindow))
+		}
+
+		service := notification.service
+		time.AfterFunc(variable.pendingDue.Sub(now), func() {
+			select {
+			case state.moderationDue <- service:
+			case <-ctx.Done():
+			}
+		})
+	}
+
+	return result
+}
+
+// Returns the pending values of the variables of service whose window is ended, all of them if final.
+// They are evented also when within minimumDelta of the last evented value: they are the final ones.
+func (state *GenaState) moderationFlush(service Service, now time.Time, final bool) notification {
+	result := notification{
+		service:             service,
+		stateVariableValues: []stateVariableValue{},
+	}
+
+	variables := state.moderation[serviceSubscriptionKey(service)]
+	for _, stateVariable := range service.SCPD.ServiceStateTable {
+		variable, found := variables[stateVariable.Name]
+		if !found || !variable.pending || (!final && now.Before(variable.pendingDue)) {
+			continue
+		}
+
+		variable.pending = false
+		variable.lastValue = variable.pendingValue
+		variable.lastEvent = now
+		result.stateVariableValues = append(result.stateVariableValues, stateVariableValue{
+			stateVar: variable.stateVar,
+			value:    variable.pendingValue,
+		})
+	}
+
+	return result
+}
+
+func (state *GenaState) moderatedVariable(service Service, stateVariable *StateVariable) *moderatedVariable {
+	key := serviceSubscriptionKey(service)
+	if state.moderation[key] == nil {
+		state.moderation[key] = make(map[string]*moderatedVariable)
+	}
+
+	variable, found := state.moderation[key][stateVariable.Name]
+	if !found {
+		variable = &moderatedVariable{service: service, stateVar: stateVariable}
+		state.moderation[key][stateVariable.Name] = variable
+	}
+
+	return variable
+}
+
+// Returns the services with moderated variables
+func (state *GenaState) moderatedServices() []Service {
+	result := []Service{}
+	for _, variables := range state.moderation {
+		for _, variable := range variables {
+			result = append(result, variable.service)
+			break
+		}
+	}
+
+	return result
+}
+
+// Reports whether value differs from lastValue by less than the minimumDelta of the numeric stateVariable
+func withinMinimumDelta(stateVariable *StateVariable, lastValue string, value string) bool {
+	if stateVariable.MinimumDelta <= 0 || !slices.Contains(numericDataTypes, stateVariable.DataType) {
+		return false
+	}
+
+	last, err := strconv.ParseFloat(lastValue, 64)
+	if err != nil {
+		return false
+	}
+	current, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return false
+	}
+
+	return math.Abs(current-last) < stateVariable.MinimumDelta
+}
@@ -0,0 +1,116 @@
+package upnp
+
+import (
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+// Returns a GenaState not started and a service whose level variable is moderated
+func newTestModeration(t *testing.T, maximumRate time.Duration, minimumDelta float64) (*GenaState, Service) {
+	t.Helper()
+
+	ctx, _ := logging.Init(context.Background(), slog.LevelError)
+	gena := NewGenaListener(ctx)
+	t.Cleanup(func() {
+		gena.Shutdown(context.Background())
+	})
+
+	service := Service{
+		ServiceType: testServiceType,
+		ServiceId:   "urn:upnp-org:serviceId:Sensor",
+		EventSubURL: "/Sensor/event",
+		SCPD: Scpd{
+			ServiceStateTable: []*StateVariable{{SendEvents: true, Name: "level", DataType: "ui4", DefaultValue: "0", MaximumRate: maximumRate, MinimumDelta: minimumDelta}},
+		},
+	}
+
+	return gena, service
+}
+
+// Moderates the change of level to value at now, returns the evented values
+func moderateLevel(gena *GenaState, service Service, value string, now time.Time) []string {
+	notification := notification{
+		service:             service,
+		stateVariableValues: []stateVariableValue{{stateVar: service.SCPD.ServiceStateTable[0], value: value}},
+	}
+
+	return eventedValues(gena.moderate(gena.ctx, notification, now))
+}
+
+func eventedValues(notification notification) []string {
+	result := []string{}
+	for _, value := range notification.stateVariableValues {
+		result = append(result, value.value)
+	}
+	return result
+}
+
+func expectEvented(t *testing.T, step string, evented []string, expected ...string) {
+	t.Helper()
+
+	if len(evented) != len(expected) || len(expected) > 0 && evented[0] != expected[0] {
+		t.Errorf("%s: evented %v, expected %v", step, evented, expected)
+	}
+}
+
+func TestModerationMinimumDeltaFinalValue(t *testing.T) {
+	gena, service := newTestModeration(t, 0, 5)
+	start := time.Now()
+
+	expectEvented(t, "first value", moderateLevel(gena, service, "10", start), "10")
+	expectEvented(t, "change beyond delta", moderateLevel(gena, service, "20", start.Add(10*time.Millisecond)), "20")
+
+	// The sensor drifts in small steps and stops: the last value is evented when the window ends
+	expectEvented(t, "sub-delta change", moderateLevel(gena, service, "22", start.Add(20*time.Millisecond)))
+	expectEvented(t, "sub-delta change", moderateLevel(gena, service, "23", start.Add(30*time.Millisecond)))
+	expectEvented(t, "flush before the window ends", eventedValues(gena.moderationFlush(service, start.Add(500*time.Millisecond), false)))
+	expectEvented(t, "flush at the end of the window", eventedValues(gena.moderationFlush(service, start.Add(20*time.Millisecond+genaMinimumDeltaWindow), false)), "23")
+
+	select {
+	case due := <-gena.moderationDue:
+		if due.ServiceId != service.ServiceId {
+			t.Errorf("Window of %s scheduled", due.ServiceId)
+		}
+	case <-time.After(testEventWait):
+		t.Error("End of the window not scheduled")
+	}
+
+	// The final flush at shutdown sends the held value
+	expectEvented(t, "sub-delta change", moderateLevel(gena, service, "24", start.Add(2*genaMinimumDeltaWindow)))
+	expectEvented(t, "final flush", eventedValues(gena.moderationFlush(service, start.Add(2*genaMinimumDeltaWindow), true)), "24")
+	expectEvented(t, "flush after the final one", eventedValues(gena.moderationFlush(service, start.Add(3*genaMinimumDeltaWindow), true)))
+}
+
+func TestModerationMinimumDeltaSuperseded(t *testing.T) {
+	gena, service := newTestModeration(t, 0, 5)
+	start := time.Now()
+
+	expectEvented(t, "first value", moderateLevel(gena, service, "10", start), "10")
+	expectEvented(t, "sub-delta change", moderateLevel(gena, service, "12", start.Add(10*time.Millisecond)))
+
+	// A change beyond delta is evented at once and replaces the held one
+	expectEvented(t, "change beyond delta", moderateLevel(gena, service, "30", start.Add(20*time.Millisecond)), "30")
+	expectEvented(t, "flush at the end of the window", eventedValues(gena.moderationFlush(service, start.Add(10*time.Millisecond+genaMinimumDeltaWindow), false)))
+
+	// A window scheduled before does not flush the next held value early
+	expectEvented(t, "sub-delta change", moderateLevel(gena, service, "31", start.Add(900*time.Millisecond)))
+	expectEvented(t, "flush of the previous window", eventedValues(gena.moderationFlush(service, start.Add(10*time.Millisecond+genaMinimumDeltaWindow), false)))
+	expectEvented(t, "flush at the end of the window", eventedValues(gena.moderationFlush(service, start.Add(900*time.Millisecond+genaMinimumDeltaWindow), false)), "31")
+}
+
+func TestModerationMaximumRate(t *testing.T) {
+	gena, service := newTestModeration(t, time.Second, 5)
+	start := time.Now()
+
+	expectEvented(t, "first value", moderateLevel(gena, service, "10", start), "10")
+	expectEvented(t, "change within the window", moderateLevel(gena, service, "30", start.Add(100*time.Millisecond)))
+	expectEvented(t, "sub-delta change within the window", moderateLevel(gena, service, "32", start.Add(200*time.Millisecond)))
+	expectEvented(t, "flush at the end of the window", eventedValues(gena.moderationFlush(service, start.Add(time.Second), false)), "32")
+
+	// After the window a change beyond delta is evented at once
+	expectEvented(t, "change after the window", moderateLevel(gena, service, "50", start.Add(2100*time.Millisecond)), "50")
+}
@@ -0,0 +1,407 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+const (
+	testDeviceType  = "urn:schemas-upnp-org:device:BinaryLight:1"
+	testServiceType = "urn:schemas-upnp-org:service:SwitchPower:1"
+	testDeviceUDN   = "uuid:6f1c5b0e-8a3d-4c7e-9b21-0d4e5f6a7b8c"
+	testEventWait   = 5 * time.Second
+)
+
+// Returns a context running on a new host of network with address ip
+func newTestContext(t *testing.T, network *VirtualNetwork, ip string) context.Context {
+	t.Helper()
+
+	host, err := network.NewHost(net.ParseIP(ip))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, _ := logging.Init(context.Background(), slog.LevelError)
+	return context.WithValue(ctx, "transport", host)
+}
+
+// Device of the tests: GENA, HTTP and SSDP of a BinaryLight with a SwitchPower service
+type testDevice struct {
+	rootDevice RootDevice
+	gena       *GenaState
+	httpServer HttpServer
+	ssdp       *SsdpState
+}
+
+func startTestDevice(t *testing.T, ctx context.Context) *testDevice {
+	t.Helper()
+
+	return startTestDeviceWithConfig(t, ctx, SsdpConfig{})
+}
+
+// Same as startTestDevice, SSDP and the multicast events use the interfaces of config
+func startTestDeviceWithConfig(t *testing.T, ctx context.Context, config SsdpConfig) *testDevice {
+	t.Helper()
+
+	gena := NewGenaListenerWithConfig(ctx, NewMemorySubscriptionStore(), config)
+	gena.Start()
+	ctx = context.WithValue(ctx, "gena", gena)
+
+	httpServer, err := NewHttpServer(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	host := getTransport(ctx).(*VirtualHost)
+	rootDevice, err := newTestRootDevice(ctx, "http://"+net.JoinHostPort(host.IP().String(), strconv.Itoa(httpServer.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	httpServer.ServeRootDevice(rootDevice)
+	httpServer.Start()
+
+	ssdp, err := SsdpDeviceWithConfig(ctx, rootDevice, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testDevice{
+		rootDevice: rootDevice,
+		gena:       gena,
+		httpServer: httpServer,
+		ssdp:       ssdp,
+	}
+}
+
+// Stops the device in the same order of main-device
+func (testDevice *testDevice) stop(t *testing.T) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), testEventWait)
+	defer cancel()
+
+	if err := testDevice.httpServer.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+	if err := testDevice.gena.Shutdown(ctx); err != nil {
+		t.Error(err)
+	}
+	StopSsdpDevice(testDevice.ssdp)
+}
+
+// Returns a BinaryLight served at deviceUrl whose action Turn sets the evented state and actualState,
+// actualState is also multicast
+func newTestRootDevice(ctx context.Context, deviceUrl string) (RootDevice, error) {
+	state := &StateVariable{SendEvents: true, Name: "state", DataType: "boolean", DefaultValue: "0"}
+	actualState := &StateVariable{SendEvents: true, Multicast: true, Name: "actualState", DataType: "boolean", DefaultValue: "0"}
+
+	scpd := Scpd{
+		SpecVersion:       SpecVersion{Major: "1", Minor: "1"},
+		ServiceStateTable: []*StateVariable{state, actualState},
+	}
+	err := scpd.AddAction(FormalAction{
+		Name: "Turn",
+		ArgumentList: []FormalArgument{
+			{Name: "StateValue", Direction: In, RelatedStateVariable: state},
+			{Name: "ActualValue", Direction: Out, RelatedStateVariable: actualState},
+		},
+	})
+	if err != nil {
+		return RootDevice{}, err
+	}
+
+	result := RootDevice{
+		SpecVersion:    SpecVersion{Major: "2", Minor: "0"},
+		DescriptionURL: deviceUrl + "/description.xml",
+		Device: Device{
+			DeviceType:   testDeviceType,
+			UDN:          testDeviceUDN,
+			FriendlyName: "Test light",
+			Manufacturer: "DF Corp.",
+			ModelName:    "Test light",
+			ServiceList: []Service{
+				{
+					ServiceType: testServiceType,
+					ServiceId:   "urn:upnp-org:serviceId:SwitchPower",
+					SCPDURL:     "/SwitchPower",
+					EventSubURL: "/SwitchPower/event",
+					ControlURL:  "/SwitchPower/control",
+					SCPD:        scpd,
+				},
+			},
+			EmbeddedDevices: []Device{},
+		},
+		BootId:   1,
+		ConfigId: 1,
+	}
+
+	service := &result.Device.ServiceList[0]
+	service.State = NewStateStore(ctx, *service)
+	store := service.State
+	service.HandleAction("Turn", func(arguments ...device.Argument) device.Response {
+		err := store.SetValues(
+			device.Argument{Name: "state", Value: arguments[0].Value},
+			device.Argument{Name: "actualState", Value: arguments[0].Value},
+		)
+		if err != nil {
+			return device.Response{ErrorCode: 501, ErrorMessage: err.Error()}
+		}
+		return device.Response{Value: arguments[0].Value}
+	})
+
+	return result, nil
+}
+
+// Searches the test device from ctx and retrieves its description
+func discoverTestDevice(t *testing.T, ctx context.Context) RootDevice {
+	t.Helper()
+
+	results, err := SearchMx(ctx, testDeviceType, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, result := range results {
+		if strings.HasPrefix(result.USN, testDeviceUDN+"::") {
+			rootDevice, err := FetchRootDevice(ctx, result.Location)
+			if err != nil {
+				t.Fatal(err)
+			}
+			return rootDevice
+		}
+	}
+
+	t.Fatalf("Device not found among %d search results", len(results))
+	return RootDevice{}
+}
+
+func TestVirtualNetworkDiscovery(t *testing.T) {
+	network := NewVirtualNetwork(7, LinkConfig{})
+	testDevice := startTestDevice(t, newTestContext(t, network, "10.0.0.1"))
+	defer testDevice.stop(t)
+
+	rootDevice := discoverTestDevice(t, newTestContext(t, network, "10.0.0.2"))
+
+	if rootDevice.Device.UDN != testDeviceUDN || rootDevice.Device.DeviceType != testDeviceType {
+		t.Fatalf("Discovered %s %s", rootDevice.Device.UDN, rootDevice.Device.DeviceType)
+	}
+	if len(rootDevice.Device.ServiceList) != 1 {
+		t.Fatalf("Expected 1 service, found %d", len(rootDevice.Device.ServiceList))
+	}
+
+	actions := rootDevice.Device.ServiceList[0].SCPD.GetActions()
+	if len(actions) != 1 || actions[0].Name != "Turn" || len(actions[0].ArgumentList) != 2 {
+		t.Fatalf("SCPD not retrieved: %v", actions)
+	}
+}
+
+func TestVirtualNetworkInvokeAction(t *testing.T) {
+	network := NewVirtualNetwork(7, LinkConfig{})
+	testDevice := startTestDevice(t, newTestContext(t, network, "10.0.0.1"))
+	defer testDevice.stop(t)
+
+	ctx := newTestContext(t, network, "10.0.0.2")
+	service := discoverTestDevice(t, ctx).Device.ServiceList[0]
+
+	reply, err := InvokeAction(ctx, service, "Turn", []device.Argument{{Name: "StateValue", Value: "true"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reply) != 1 || reply[0].Name != "ActualValue" || reply[0].Value != "1" {
+		t.Fatalf("Turn returned %v", reply)
+	}
+
+	value, err := QueryStateVariable(ctx, service, "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value != "1" {
+		t.Fatalf("state is %q after Turn", value)
+	}
+
+	_, err = InvokeAction(ctx, service, "Turn", []device.Argument{{Name: "StateValue", Value: "maybe"}})
+	var upnpError UPnPError
+	if !errors.As(err, &upnpError) {
+		t.Fatalf("Expected UPnPError for an argument not valid, got %v", err)
+	}
+
+	_, err = InvokeAction(ctx, service, "Blink", []device.Argument{})
+	if !errors.As(err, &upnpError) || upnpError.ErrorCode != 401 {
+		t.Fatalf("Expected UPnPError 401 for an unknown action, got %v", err)
+	}
+}
+
+func TestVirtualNetworkSubscribe(t *testing.T) {
+	network := NewVirtualNetwork(7, LinkConfig{})
+	testDevice := startTestDevice(t, newTestContext(t, network, "10.0.0.1"))
+	defer testDevice.stop(t)
+
+	ctx := newTestContext(t, network, "10.0.0.2")
+	rootDevice := discoverTestDevice(t, ctx)
+	service := rootDevice.Device.ServiceList[0]
+
+	events := make(chan Event, 8)
+	cancel, sid, err := GenaSubscribeToServiceWithInitialEvent(ctx, rootDevice, service, func(event Event) {
+		events <- event
+	}, func(event Event) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer (*cancel)()
+
+	if !strings.HasPrefix(sid, "uuid:") {
+		t.Errorf("SID not valid: %s", sid)
+	}
+
+	expectEvent(t, events, sid, 0, "0")
+
+	_, err = InvokeAction(ctx, service, "Turn", []device.Argument{{Name: "StateValue", Value: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, events, sid, 1, "1")
+
+	err = GenaUnsubscribeFromService(ctx, rootDevice, service, sid)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = GenaUnsubscribeFromService(ctx, rootDevice, service, sid)
+	if err == nil {
+		t.Error("Unsubscribed twice from " + sid)
+	}
+}
+
+// Waits for the event with seq setting state and actualState to value
+func expectEvent(t *testing.T, events <-chan Event, sid string, seq int, value string) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.SID != sid || event.Seq != seq || event.Properties["state"] != value || event.Properties["actualState"] != value {
+			t.Fatalf("Expected SEQ %d with value %s, received %s", seq, value, event.String())
+		}
+	case <-time.After(testEventWait):
+		t.Fatalf("Event SEQ %d not received", seq)
+	}
+}
+
+func TestVirtualNetworkMulticastEvents(t *testing.T) {
+	network := NewVirtualNetwork(7, LinkConfig{})
+	testDevice := startTestDevice(t, newTestContext(t, network, "10.0.0.1"))
+	defer testDevice.stop(t)
+
+	ctx, cancel := context.WithCancel(newTestContext(t, network, "10.0.0.2"))
+	defer cancel()
+	rootDevice := discoverTestDevice(t, ctx)
+	service := rootDevice.Device.ServiceList[0]
+
+	events := make(chan MulticastEvent, 8)
+	err := GenaListenMulticastEvents(ctx, rootDevice, service, func(event MulticastEvent) {
+		events <- event
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = InvokeAction(ctx, service, "Turn", []device.Argument{{Name: "StateValue", Value: "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMulticastEvent(t, events, 1, 0, "1")
+
+	// The event messages after an update carry the new BOOTID.UPNP.ORG, the SEQ goes on
+	UpdateSsdpDevice(testDevice.ssdp, testDevice.rootDevice)
+	_, err = InvokeAction(ctx, service, "Turn", []device.Argument{{Name: "StateValue", Value: "0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMulticastEvent(t, events, 2, 1, "0")
+}
+
+func TestVirtualNetworkMulticastEventsIPv6(t *testing.T) {
+	network := NewVirtualNetwork(7, LinkConfig{})
+	config := SsdpConfig{Network: SsdpIPv6}
+	testDevice := startTestDeviceWithConfig(t, newTestContext(t, network, "fd00::1"), config)
+	defer testDevice.stop(t)
+
+	ctx, cancel := context.WithCancel(newTestContext(t, network, "fd00::2"))
+	defer cancel()
+	service := testDevice.rootDevice.Device.ServiceList[0]
+
+	events := make(chan MulticastEvent, 8)
+	err := GenaListenMulticastEventsWithConfig(ctx, testDevice.rootDevice, service, func(event MulticastEvent) {
+		events <- event
+	}, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Raw receiver of both scopes, the device has an address wider than link-local
+	observer, err := network.NewHost(net.ParseIP("fd00::3"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := observer.ListenMulticastUDP("udp6", nil, []*net.UDPAddr{
+		{IP: net.ParseIP(genaMulticastNotificationAddressIPv6LinkLocal), Port: genaMulticastNotificationPort},
+		{IP: net.ParseIP(genaMulticastNotificationAddressIPv6SiteLocal), Port: genaMulticastNotificationPort},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	err = service.State.Set("actualState", "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectMulticastEvent(t, events, 1, 0, "1")
+
+	hosts := []string{}
+	buffer := make([]byte, genaMaxMulticastMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(testEventWait))
+	for range 2 {
+		n, _, _, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		host, _ := FindHeader(string(buffer[:n]), "HOST")
+		hosts = append(hosts, host)
+	}
+	slices.Sort(hosts)
+	if !slices.Equal(hosts, []string{"[FF02::130]:7900", "[FF05::130]:7900"}) {
+		t.Errorf("Multicast events sent to %v", hosts)
+	}
+
+	// The event received from both scopes is delivered once
+	select {
+	case event := <-events:
+		t.Errorf("Duplicate event delivered: %s", event.String())
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Waits for the multicast event with bootId and seq setting actualState to value
+func expectMulticastEvent(t *testing.T, events <-chan MulticastEvent, bootId int, seq int, value string) {
+	t.Helper()
+
+	select {
+	case event := <-events:
+		if event.BootId != bootId || event.Seq != seq || event.Level != General || event.Properties["actualState"] != value {
+			t.Fatalf("Expected BOOTID %d SEQ %d with value %s, received %s", bootId, seq, value, event.String())
+		}
+	case <-time.After(testEventWait):
+		t.Fatalf("Multicast event SEQ %d not received", seq)
+	}
+}
@@ -0,0 +1,242 @@
+package upnp
+
+import (
+	"context"
+	"encoding/xml"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/utils"
+)
+
+// Page served at the presentationURL of a device (see 5): the current value of the state variables
+// of each service and, if enabled, a form for invoking each action
+var presentationTemplate = template.Must(template.New("presentation").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Device.FriendlyName}}</title>
+</head>
+<body>
+<h1>{{range .Icons}}<img src="{{.Url}}" width="{{.Width}}" height="{{.Height}}" alt=""> {{end}}{{.Device.FriendlyName}}</h1>
+<p>{{.Device.Manufacturer}} {{.Device.ModelName}} {{.Device.ModelNumber}} - {{.Device.UDN}}</p>
+{{if .Message}}<p><strong>{{.Message}}</strong></p>{{end}}
+{{range .Services}}
+<h2>{{.ServiceId}}</h2>
+<p>{{.ServiceType}}</p>
+<table border="1">
+<tr><th>State variable</th><th>Data type</th><th>Value</th></tr>
+{{range .StateVariables}}<tr><td>{{.Name}}</td><td>{{.DataType}}</td><td>{{.Value}}</td></tr>
+{{end}}</table>
+{{$serviceId := .ServiceId}}{{if $.InvokeActions}}{{range .Actions}}
+<form method="post">
+<input type="hidden" name="serviceId" value="{{$serviceId}}">
+<input type="hidden" name="action" value="{{.Name}}">
+{{range .InArguments}}<label>{{.}} <input type="text" name="{{.}}"></label>
+{{end}}<input type="submit" value="{{.Name}}">
+</form>
+{{end}}{{end}}{{end}}
+</body>
+</html>
+`))
+
+type presentationPage struct {
+	Device        Device
+	Icons         []Icon
+	Services      []presentationService
+	InvokeActions bool
+	Message       string
+}
+
+type presentationService struct {
+	ServiceId      string
+	ServiceType    string
+	StateVariables []presentationStateVariable
+	Actions        []presentationAction
+}
+
+type presentationStateVariable struct {
+	Name     string
+	DataType string
+	Value    string
+}
+
+type presentationAction struct {
+	Name        string
+	InArguments []string
+}
+
+// Serves the presentation page of device. If invokeActions, a POST invokes the action submitted by the form
+// of the page: the form is accepted only from the page itself, as reported by the Origin or Referer of the browser
+func presentationHandler(ctx context.Context, device Device, invokeActions bool, request *http.Request, response http.ResponseWriter) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	log.Info("[http] Request from " + request.RemoteAddr + " presentation page " + request.RequestURI)
+
+	message := ""
+	if request.Method == http.MethodPost {
+		if !invokeActions {
+			response.Header().Set("ALLOW", http.MethodGet)
+			response.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !isSameOrigin(request) {
+			log.Warn("[http] Presentation page form from another origin refused, request from " + request.RemoteAddr)
+			response.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		message = invokeFromPresentation(ctx, device, request)
+	}
+
+	page := presentationPage{
+		Device:        device,
+		Icons:         utils.Find(device.IconList, func(icon Icon) bool { return len(icon.Data) > 0 }),
+		Services:      []presentationService{},
+		InvokeActions: invokeActions,
+		Message:       message,
+	}
+
+	for _, service := range device.ServiceList {
+		pageService := presentationService{
+			ServiceId:      service.ServiceId,
+			ServiceType:    service.ServiceType,
+			StateVariables: []presentationStateVariable{},
+			Actions:        []presentationAction{},
+		}
+
+		for _, stateVariable := range service.SCPD.ServiceStateTable {
+			value := stateVariable.DefaultValue
+			if service.State != nil {
+				value, _ = service.State.Value(stateVariable.Name)
+			}
+
+			pageService.StateVariables = append(pageService.StateVariables, presentationStateVariable{
+				Name:     stateVariable.Name,
+				DataType: stateVariable.DataType,
+				Value:    value,
+			})
+		}
+
+		for _, action := range service.SCPD.actionList {
+			pageAction := presentationAction{
+				Name:        action.Name,
+				InArguments: []string{},
+			}
+			for _, argument := range action.ArgumentList {
+				if argument.Direction == In {
+					pageAction.InArguments = append(pageAction.InArguments, argument.Name)
+				}
+			}
+
+			pageService.Actions = append(pageService.Actions, pageAction)
+		}
+
+		page.Services = append(page.Services, pageService)
+	}
+
+	response.Header().Set("CONTENT-TYPE", "text/html; charset=\"utf-8\"")
+	response.WriteHeader(http.StatusOK)
+	err := presentationTemplate.Execute(response, page)
+	if err != nil {
+		log.Error("[http] Error while generating the presentation page: " + err.Error())
+	}
+}
+
+// Reports whether request was sent from a page of the same host, browsers set Origin or Referer on a POST
+func isSameOrigin(request *http.Request) bool {
+	origin := request.Header.Get("Origin")
+	if len(origin) == 0 {
+		origin = request.Header.Get("Referer")
+	}
+
+	originUrl, err := url.Parse(origin)
+	if len(origin) == 0 || err != nil {
+		return false
+	}
+
+	return originUrl.Host == request.Host
+}
+
+// Invokes the action submitted by the form of the presentation page, returns the outcome to show on the page
+func invokeFromPresentation(ctx context.Context, device Device, request *http.Request) string {
+	log := ctx.Value("logger").(logging.Logger)
+
+	err := request.ParseForm()
+	if err != nil {
+		return "Request not valid: " + err.Error()
+	}
+
+	serviceId := request.PostForm.Get("serviceId")
+	actionName := request.PostForm.Get("action")
+
+	service, findService := utils.FindFirst(device.ServiceList, func(service Service) bool {
+		return service.ServiceId == serviceId
+	})
+	if !findService {
+		return "Service not found: " + serviceId
+	}
+
+	formalAction, findAction := utils.FindFirst(service.SCPD.actionList, func(action FormalAction) bool {
+		return action.Name == actionName
+	})
+	if !findAction {
+		return "Action not found: " + actionName
+	}
+
+	actualArguments := []ActualArgumentName{}
+	for name, values := range request.PostForm {
+		if len(values) > 0 {
+			actualArguments = append(actualArguments, ActualArgumentName{XMLName: xml.Name{Local: name}, Value: values[0]})
+		}
+	}
+
+	formalInArguments := utils.Find(formalAction.ArgumentList, func(argument FormalArgument) bool {
+		return argument.Direction == In
+	})
+	inArguments, err := getInArguments(formalInArguments, actualArguments)
+	if err != nil {
+		return actionName + ": " + err.Error()
+	}
+
+	log.Info("[http] Presentation page invoking " + serviceId + " action: " + actionName)
+
+	deviceResponse, err := executeAction(service, actionName, inArguments)
+	if err != nil {
+		return actionName + ": " + err.Error()
+	}
+	if deviceResponse.ErrorCode != 0 {
+		return actionName + " failed (" + strconv.Itoa(deviceResponse.ErrorCode) + "): " + deviceResponse.ErrorMessage
+	}
+
+	formalOutArguments := utils.Find(formalAction.ArgumentList, func(argument FormalArgument) bool {
+		return argument.Direction == Out
+	})
+	outArguments, err := getOutArguments(formalOutArguments, deviceResponse)
+	if err != nil {
+		return actionName + ": " + err.Error()
+	}
+
+	result := []string{}
+	for _, outArgument := range outArguments {
+		result = append(result, outArgument.XMLName.Local+" = "+outArgument.Value)
+	}
+
+	return actionName + ": " + strings.Join(result, ", ")
+}
+
+// Serves the image of icon
+func iconHandler(ctx context.Context, icon Icon, request *http.Request, response http.ResponseWriter) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	log.Info("[http] Request from " + request.RemoteAddr + " icon " + request.RequestURI)
+
+	response.Header().Set("CONTENT-TYPE", icon.Mimetype)
+	response.Header().Set("CONTENT-LENGTH", strconv.Itoa(len(icon.Data)))
+	response.WriteHeader(http.StatusOK)
+	response.Write(icon.Data)
+}
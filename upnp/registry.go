@@ -0,0 +1,383 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+const registryExpirationCheckSeconds = 1 // Seconds between two checks of the expired advertisements
+
+type DeviceRegistryEventType string
+
+const (
+	DeviceAdded   DeviceRegistryEventType = "added"
+	DeviceUpdated DeviceRegistryEventType = "updated"
+	DeviceRemoved DeviceRegistryEventType = "removed"
+)
+
+func (eventType DeviceRegistryEventType) String() string {
+	switch eventType {
+	case DeviceAdded:
+		return "added"
+	case DeviceUpdated:
+		return "updated"
+	case DeviceRemoved:
+		return "removed"
+	default:
+		return "updated"
+	}
+}
+
+// Change of an advertisement in the DeviceRegistry.
+// For DeviceUpdated events Previous holds the advertisement before the change: a different BootId
+// without a previous ssdp:update means that the device has been rebooted (see 1.2.2).
+type DeviceRegistryEvent struct {
+	Type     DeviceRegistryEventType
+	Device   MSearchResult
+	Previous MSearchResult
+}
+
+type registryEntry struct {
+	device     MSearchResult
+	expiration time.Time
+}
+
+// Cache of the advertisements (keyed by USN) received via NOTIFY or as M-SEARCH response
+type DeviceRegistry struct {
+	ctx      context.Context
+	config   SsdpConfig
+	mutex    sync.Mutex
+	entries  map[string]registryEntry
+	handlers []func(DeviceRegistryEvent)
+}
+
+// Parsed NOTIFY message (see 1.2)
+type ssdpNotify struct {
+	nts      string
+	device   MSearchResult
+	bootInfo ssdpBootInfo
+}
+
+// Creates a DeviceRegistry listening for NOTIFY on the SSDP multicast address until ctx is done
+func NewDeviceRegistry(ctx context.Context) (*DeviceRegistry, error) {
+	return NewDeviceRegistryWithConfig(ctx, SsdpConfig{})
+}
+
+// Same as NewDeviceRegistry, listens on each interface of config
+func NewDeviceRegistryWithConfig(ctx context.Context, config SsdpConfig) (*DeviceRegistry, error) {
+	log := ctx.Value("logger").(logging.Logger)
+	transport := getTransport(ctx)
+
+	interfaces, err := resolveSsdpInterfaces(transport, config)
+	if err != nil {
+		log.Error("[ssdp] Error while resolving interfaces: " + err.Error())
+		return nil, err
+	}
+
+	conns := []UDPConn{}
+	for _, ssdpInterface := range interfaces {
+		conn, err := transport.ListenMulticastUDP(ssdpInterface.network, ssdpInterface.iface, ssdpInterface.multicastGroups())
+		if err != nil {
+			log.Error("[ssdp] Error while listen multicast UDP on " + ssdpInterface.String() + ": " + err.Error())
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, errors.New("Error while listen")
+		}
+		conns = append(conns, conn)
+	}
+
+	result := &DeviceRegistry{
+		ctx:      ctx,
+		config:   config,
+		entries:  make(map[string]registryEntry),
+		handlers: []func(DeviceRegistryEvent){},
+	}
+
+	for i, conn := range conns {
+		result.registryListenDaemon(ctx, conn, interfaces[i])
+	}
+	result.registryExpirationDaemon(ctx)
+
+	return result, nil
+}
+
+// Registers a handler invoked for every change of the registry
+func (registry *DeviceRegistry) AddEventHandler(handler func(DeviceRegistryEvent)) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	registry.handlers = append(registry.handlers, handler)
+}
+
+// Returns the cached advertisements matching st, "ssdp:all" returns all of them
+func (registry *DeviceRegistry) Lookup(st string) []MSearchResult {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
+	result := []MSearchResult{}
+	now := time.Now()
+	for _, entry := range registry.entries {
+		if entry.expiration.After(now) && (st == "ssdp:all" || entry.device.St == st) {
+			result = append(result, entry.device)
+		}
+	}
+
+	return result
+}
+
+// Sends an M-SEARCH and stores the responses in the registry
+func (registry *DeviceRegistry) Search(ctx context.Context, st string) ([]MSearchResult, error) {
+	return registry.SearchMx(ctx, st, ssdpMSearchMX)
+}
+
+// Sends an M-SEARCH and stores the responses in the registry
+func (registry *DeviceRegistry) SearchMx(ctx context.Context, st string, mx int) ([]MSearchResult, error) {
+	result, err := SearchMxWithConfig(ctx, st, mx, registry.config)
+	if err != nil {
+		return result, err
+	}
+
+	for _, device := range result {
+		registry.alive(device)
+	}
+
+	return result, nil
+}
+
+func (registry *DeviceRegistry) registryListenDaemon(ctx context.Context, conn UDPConn, ssdpInterface ssdpInterface) {
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		log := ctx.Value("logger").(logging.Logger)
+
+		defer conn.Close()
+
+		log.Info("[ssdp] Registry listening for NOTIFY on " + ssdpInterface.String())
+		messageBuffer := make([]byte, 1024)
+		for {
+			n, source, info, err := conn.ReadFrom(messageBuffer)
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Info("[ssdp] Registry stop listening for NOTIFY on " + ssdpInterface.String())
+					return
+				}
+				log.Error("[ssdp] Error while receiving a message")
+				continue
+			}
+
+			if !ssdpInterface.receivedOn(info) {
+				continue
+			}
+
+			message := string(messageBuffer[:n])
+			if !strings.HasPrefix(message, "NOTIFY") {
+				continue
+			}
+
+			notify, err := parseSSDPNotify(message)
+			if err != nil {
+				log.Warn("[ssdp] Received malformed NOTIFY from " + source.String() + ": " + err.Error())
+				continue
+			}
+
+			notify.device.Location = locationFrom(notify.device.Location, *source)
+
+			log.Debug("[ssdp] Registry received " + notify.nts + " from " + source.String() + " USN: " + notify.device.USN)
+
+			switch notify.nts {
+			case "ssdp:alive":
+				registry.alive(notify.device)
+			case "ssdp:byebye":
+				registry.byebye(notify.device)
+			case "ssdp:update":
+				registry.update(notify.device, notify.bootInfo.nextBootId)
+			}
+		}
+	}()
+}
+
+// Periodically removes the advertisements whose CACHE-CONTROL max-age is elapsed (see 1.2.2)
+func (registry *DeviceRegistry) registryExpirationDaemon(ctx context.Context) {
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(registryExpirationCheckSeconds * time.Second):
+				now := time.Now()
+				events := []DeviceRegistryEvent{}
+
+				registry.mutex.Lock()
+				for usn, entry := range registry.entries {
+					if !entry.expiration.After(now) {
+						delete(registry.entries, usn)
+						events = append(events, DeviceRegistryEvent{
+							Type:   DeviceRemoved,
+							Device: entry.device,
+						})
+					}
+				}
+				registry.mutex.Unlock()
+
+				registry.notifyHandlers(events...)
+			}
+		}
+	}()
+}
+
+// Adds or refreshes an advertisement
+func (registry *DeviceRegistry) alive(device MSearchResult) {
+	registry.mutex.Lock()
+	previous, found := registry.entries[device.USN]
+	registry.entries[device.USN] = registryEntry{
+		device:     device,
+		expiration: time.Now().Add(time.Duration(device.CacheControl) * time.Second),
+	}
+	registry.mutex.Unlock()
+
+	if !found {
+		registry.notifyHandlers(DeviceRegistryEvent{
+			Type:   DeviceAdded,
+			Device: device,
+		})
+	} else if previous.device.BootId != device.BootId || previous.device.ConfigId != device.ConfigId || previous.device.Location != device.Location {
+		registry.notifyHandlers(DeviceRegistryEvent{
+			Type:     DeviceUpdated,
+			Device:   device,
+			Previous: previous.device,
+		})
+	}
+}
+
+// Removes an advertisement
+func (registry *DeviceRegistry) byebye(device MSearchResult) {
+	registry.mutex.Lock()
+	previous, found := registry.entries[device.USN]
+	delete(registry.entries, device.USN)
+	registry.mutex.Unlock()
+
+	if found {
+		registry.notifyHandlers(DeviceRegistryEvent{
+			Type:   DeviceRemoved,
+			Device: previous.device,
+		})
+	}
+}
+
+// Moves an advertisement to its next BOOTID.UPNP.ORG keeping its expiration (see 1.2.4)
+func (registry *DeviceRegistry) update(device MSearchResult, nextBootId int) {
+	registry.mutex.Lock()
+	previous, found := registry.entries[device.USN]
+	if found {
+		updated := previous.device
+		updated.BootId = nextBootId
+		updated.ConfigId = device.ConfigId
+		updated.SearchPort = device.SearchPort
+		if len(device.Location) > 0 {
+			updated.Location = device.Location
+		}
+
+		registry.entries[device.USN] = registryEntry{
+			device:     updated,
+			expiration: previous.expiration,
+		}
+		device = updated
+	}
+	registry.mutex.Unlock()
+
+	if found {
+		registry.notifyHandlers(DeviceRegistryEvent{
+			Type:     DeviceUpdated,
+			Device:   device,
+			Previous: previous.device,
+		})
+	}
+}
+
+func (registry *DeviceRegistry) notifyHandlers(events ...DeviceRegistryEvent) {
+	registry.mutex.Lock()
+	handlers := make([]func(DeviceRegistryEvent), len(registry.handlers))
+	copy(handlers, registry.handlers)
+	registry.mutex.Unlock()
+
+	for _, event := range events {
+		for _, handler := range handlers {
+			handler(event)
+		}
+	}
+}
+
+// Parses a NOTIFY message, the required headers depend on NTS (see 1.2.2, 1.2.3 and 1.2.4)
+func parseSSDPNotify(message string) (ssdpNotify, error) {
+	nt, find := FindHeader(message, "NT")
+	if !find {
+		return ssdpNotify{}, errors.New("NT not present")
+	}
+
+	nts, find := FindHeader(message, "NTS")
+	if !find {
+		return ssdpNotify{}, errors.New("NTS not present")
+	}
+
+	usn, find := FindHeader(message, "USN")
+	if !find {
+		return ssdpNotify{}, errors.New("USN not present")
+	}
+
+	bootInfo := parseSSDPBootInfo(message)
+	result := ssdpNotify{
+		nts: nts,
+		device: MSearchResult{
+			Date:       time.Now(),
+			St:         nt,
+			USN:        usn,
+			BootId:     bootInfo.bootId,
+			ConfigId:   bootInfo.configId,
+			SearchPort: bootInfo.searchPort,
+		},
+		bootInfo: bootInfo,
+	}
+
+	switch nts {
+	case "ssdp:alive":
+		cacheControl, find := FindHeader(message, "CACHE-CONTROL")
+		if !find {
+			return ssdpNotify{}, errors.New("CACHE-CONTROL not present")
+		}
+		maxAge, err := parseCacheControlMaxAge(cacheControl)
+		if err != nil {
+			return ssdpNotify{}, err
+		}
+		result.device.CacheControl = maxAge
+
+		location, find := FindHeader(message, "LOCATION")
+		if !find {
+			return ssdpNotify{}, errors.New("LOCATION not present")
+		}
+		result.device.Location = location
+
+		result.device.Server, _ = FindHeader(message, "SERVER")
+
+	case "ssdp:update":
+		if bootInfo.nextBootId < 0 {
+			return ssdpNotify{}, errors.New("NEXTBOOTID.UPNP.ORG not present")
+		}
+		result.device.Location, _ = FindHeader(message, "LOCATION")
+
+	case "ssdp:byebye":
+
+	default:
+		return ssdpNotify{}, errors.New("NTS not valid: " + nts)
+	}
+
+	return result, nil
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	device "github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
@@ -15,7 +17,10 @@ import (
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/utils"
 )
 
-const soapTimeoutSeconds = 30 // Timeout for a SOAP request (see 3.2.5)
+const (
+	soapTimeoutSeconds = 30                                 // Timeout for a SOAP request (see 3.2.5)
+	controlNamespace   = "urn:schemas-upnp-org:control-1-0" // Namespace of UPnPError and QueryStateVariable
+)
 
 type Envelope struct {
 	XMLName       xml.Name `xml:"Envelope"`
@@ -31,6 +36,7 @@ type EnvelopeBody struct {
 
 type ActualActionName struct {
 	XMLName       xml.Name
+	Xmlns         string               `xml:"xmlns:u,attr,omitempty"` // Namespace of the "u:" prefix, only used when marshaling
 	ArgumentNames []ActualArgumentName `xml:",any"`
 }
 
@@ -58,10 +64,40 @@ type ActualArgumentName struct {
 
 type ActionNameResponse struct {
 	XMLName       xml.Name
-	Xmlns         string               `xml:"xmlns,attr"`
+	Xmlns         string               `xml:"xmlns:u,attr,omitempty"` // Namespace of the "u:" prefix, only used when marshaling
 	ArgumentNames []ActualArgumentName `xml:",any"`
 }
 
+// Error returned by a device in a SOAP fault (see 3.2.2)
+type UPnPError struct {
+	ErrorCode        int
+	ErrorDescription string
+}
+
+func (err UPnPError) Error() string {
+	return "UPnPError " + strconv.Itoa(err.ErrorCode) + ": " + err.ErrorDescription
+}
+
+type soapFault struct {
+	FaultCode   string `xml:"faultcode"`
+	FaultString string `xml:"faultstring"`
+	Detail      struct {
+		UPnPError struct {
+			ErrorCode        int    `xml:"errorCode"`
+			ErrorDescription string `xml:"errorDescription"`
+		} `xml:"UPnPError"`
+	} `xml:"detail"`
+}
+
+// Envelope of a response, the body holds either the action response or a fault
+type soapResponseEnvelope struct {
+	XMLName xml.Name `xml:"Envelope"`
+	Body    struct {
+		Fault          *soapFault         `xml:"Fault"`
+		ActionResponse ActionNameResponse `xml:",any"`
+	} `xml:"Body"`
+}
+
 /*
 	HTTP/1.0 500 Internal Server Error
 	CONTENT-TYPE: text/xml; charset="utf-8"
@@ -108,6 +144,11 @@ func SoapControlHandler(ctx context.Context, deviceService Service, request *htt
 
 	log.Debug("[soap] Action name: " + envelope.Body.ActionName.XMLName.Local)
 
+	// Legacy action of UPnP 1.0 answered from the state store of the service
+	if envelope.Body.ActionName.XMLName.Space == controlNamespace && envelope.Body.ActionName.XMLName.Local == "QueryStateVariable" {
+		return queryStateVariableHandler(ctx, deviceService, envelope.Body.ActionName.ArgumentNames, response)
+	}
+
 	formalAction, findAction := utils.FindFirst(deviceService.SCPD.actionList, func(action FormalAction) bool {
 		return action.Name == envelope.Body.ActionName.XMLName.Local
 	})
@@ -116,56 +157,98 @@ func SoapControlHandler(ctx context.Context, deviceService Service, request *htt
 		return errors.New("Action not found")
 	}
 
+	if deviceService.actionHandler(formalAction.Name) == nil {
+		generateErrorResponse(errorCodeOptionalActionNotImplemented, "Optional Action Not Implemented", response)
+		return errors.New("Handler not found: " + formalAction.Name)
+	}
+
 	formalInArguments := utils.Find(formalAction.ArgumentList, func(argument FormalArgument) bool {
 		return argument.Direction == In
 	})
 
 	inArguments, err := getInArguments(formalInArguments, envelope.Body.ActionName.ArgumentNames)
 	if err != nil {
-		generateErrorResponse(402, "Actual arguments do not match formal argument", response)
-		log.Error("[soap] Error while assigning formal-arguments to actual-arguments")
+		upnpError, isUPnPError := err.(UPnPError)
+		if !isUPnPError {
+			upnpError = UPnPError{ErrorCode: errorCodeInvalidArgs, ErrorDescription: "Actual arguments do not match formal argument"}
+		}
+		generateErrorResponse(upnpError.ErrorCode, upnpError.ErrorDescription, response)
+		log.Error("[soap] Error while assigning formal-arguments to actual-arguments: " + err.Error())
 		return err
 	}
 
-	deviceResponseChan := make(chan device.Response)
-	go func() {
-		deviceResponseChan <- deviceService.Handler(inArguments...)
-	}()
-
-	var deviceResponse device.Response
-	select {
-	case deviceResponse = <-deviceResponseChan:
-		if deviceResponse.ErrorCode != 0 {
-			generateErrorResponse(501, "Execution failed: "+deviceResponse.ErrorMessage, response)
-			log.Warn("[soap] Device execution failed. Code: " + strconv.Itoa(deviceResponse.ErrorCode) + " - " + deviceResponse.ErrorMessage)
-			return nil
-		}
-	case <-time.After(soapTimeoutSeconds * time.Second):
+	deviceResponse, err := executeAction(deviceService, formalAction.Name, inArguments)
+	if err != nil {
 		generateErrorResponse(501, "Timeout", response)
-		return errors.New("Timeout")
+		return err
+	}
+	if deviceResponse.ErrorCode != 0 {
+		generateErrorResponse(actionErrorCode(deviceResponse.ErrorCode), "Execution failed: "+deviceResponse.ErrorMessage, response)
+		log.Warn("[soap] Device execution failed. Code: " + strconv.Itoa(deviceResponse.ErrorCode) + " - " + deviceResponse.ErrorMessage)
+		return nil
 	}
 
-	formalOutArgument, findOutArgument := utils.FindFirst(formalAction.ArgumentList, func(argument FormalArgument) bool {
+	formalOutArguments := utils.Find(formalAction.ArgumentList, func(argument FormalArgument) bool {
 		return argument.Direction == Out
 	})
 
-	var resultArgument ActualArgumentName
-	if findOutArgument {
-		resultArgument = ActualArgumentName{
-			XMLName: xml.Name{
-				Local: formalOutArgument.Name,
-			},
-			Value: deviceResponse.Value,
-		}
+	outArguments, err := getOutArguments(formalOutArguments, deviceResponse)
+	if err != nil {
+		generateErrorResponse(501, "Action Failed", response)
+		log.Error("[soap] Device response of " + formalAction.Name + " not valid: " + err.Error())
+		return err
 	}
 
 	result, err := xml.Marshal(ActionNameResponse{
-		/* Should be in this way but actual implementation does not support it
 		XMLName: xml.Name{
-			Local: envelope.Body.ActionName.XMLName.Space + "Response",
-		},*/
+			Local: "u:" + formalAction.Name + "Response",
+		},
 		Xmlns:         envelope.Body.ActionName.XMLName.Space,
-		ArgumentNames: []ActualArgumentName{resultArgument},
+		ArgumentNames: outArguments,
+	})
+	if err != nil {
+		log.Error("[soap] Error while mashaling the response")
+		return err
+	}
+	generetePositiveResponse(response, string(result))
+
+	return nil
+}
+
+// Answers QueryStateVariable with the current value of the variable varName
+func queryStateVariableHandler(ctx context.Context, deviceService Service, actualArguments []ActualArgumentName, response http.ResponseWriter) error {
+	log := ctx.Value("logger").(logging.Logger)
+
+	if deviceService.State == nil {
+		generateErrorResponse(401, "Action requested not implemented by this service", response)
+		return errors.New("State store not present")
+	}
+
+	varName, findVarName := utils.FindFirst(actualArguments, func(actual ActualArgumentName) bool {
+		return actual.XMLName.Local == "varName"
+	})
+	if !findVarName {
+		generateErrorResponse(errorCodeInvalidArgs, "Invalid Args", response)
+		return errors.New("varName not present")
+	}
+
+	value, findValue := deviceService.State.Value(strings.TrimSpace(varName.Value))
+	if !findValue {
+		generateErrorResponse(errorCodeInvalidVar, "Invalid Var", response)
+		return errors.New("StateVariable not found: " + varName.Value)
+	}
+
+	log.Debug("[soap] Query of " + deviceService.ServiceId + " state variable: " + varName.Value)
+
+	result, err := xml.Marshal(ActionNameResponse{
+		XMLName: xml.Name{
+			Local: "u:QueryStateVariableResponse",
+		},
+		Xmlns: controlNamespace,
+		ArgumentNames: []ActualArgumentName{{
+			XMLName: xml.Name{Local: "return"},
+			Value:   value,
+		}},
 	})
 	if err != nil {
 		log.Error("[soap] Error while mashaling the response")
@@ -176,7 +259,28 @@ func SoapControlHandler(ctx context.Context, deviceService Service, request *htt
 	return nil
 }
 
-// Checks if all the requested formalArgument are present.
+// Runs the handler of actionName, fails if it does not complete within soapTimeoutSeconds
+func executeAction(deviceService Service, actionName string, inArguments []device.Argument) (device.Response, error) {
+	handler := deviceService.actionHandler(actionName)
+	if handler == nil {
+		return device.Response{}, errors.New("Handler not found: " + actionName)
+	}
+
+	deviceResponseChan := make(chan device.Response, 1)
+	go func() {
+		deviceResponseChan <- handler(inArguments...)
+	}()
+
+	select {
+	case deviceResponse := <-deviceResponseChan:
+		return deviceResponse, nil
+	case <-time.After(soapTimeoutSeconds * time.Second):
+		return device.Response{}, errors.New("Timeout")
+	}
+}
+
+// Checks if all the requested formalArgument are present and valid for their RelatedStateVariable.
+// The values are normalized to the canonical form of the data type, an invalid value is returned as UPnPError.
 // In case of more actualArgument than needed, the surplus is discarded.
 func getInArguments(formalArguments []FormalArgument, actualArguments []ActualArgumentName) ([]device.Argument, error) {
 	result := []device.Argument{}
@@ -189,9 +293,52 @@ func getInArguments(formalArguments []FormalArgument, actualArguments []ActualAr
 			return []device.Argument{}, errors.New("Argument not found")
 		}
 
+		value := actualArgument.Value
+		if formalArgument.RelatedStateVariable != nil {
+			coercedValue, err := coerceValue(formalArgument.RelatedStateVariable, value)
+			if err != nil {
+				return []device.Argument{}, err
+			}
+			value = coercedValue
+		}
+
 		result = append(result, device.Argument{
 			Name:  actualArgument.XMLName.Local,
-			Value: actualArgument.Value,
+			Value: value,
+		})
+	}
+
+	return result, nil
+}
+
+// Orders the out-arguments of deviceResponse as formalArguments, normalizing the values to their data type.
+// The Value of deviceResponse is used for the first out-argument when OutArguments does not contain it.
+func getOutArguments(formalArguments []FormalArgument, deviceResponse device.Response) ([]ActualArgumentName, error) {
+	result := []ActualArgumentName{}
+
+	for i, formalArgument := range formalArguments {
+		outArgument, findOutArgument := utils.FindFirst(deviceResponse.OutArguments, func(argument device.Argument) bool {
+			return argument.Name == formalArgument.Name
+		})
+		if !findOutArgument {
+			if i > 0 {
+				return []ActualArgumentName{}, errors.New("Argument not found: " + formalArgument.Name)
+			}
+			outArgument = device.Argument{Name: formalArgument.Name, Value: deviceResponse.Value}
+		}
+
+		value := outArgument.Value
+		if formalArgument.RelatedStateVariable != nil {
+			coercedValue, err := coerceValue(formalArgument.RelatedStateVariable, value)
+			if err != nil {
+				return []ActualArgumentName{}, errors.New(formalArgument.Name + ": " + err.Error())
+			}
+			value = coercedValue
+		}
+
+		result = append(result, ActualArgumentName{
+			XMLName: xml.Name{Local: formalArgument.Name},
+			Value:   value,
 		})
 	}
 
@@ -201,16 +348,28 @@ func getInArguments(formalArguments []FormalArgument, actualArguments []ActualAr
 // Generates a positive response
 func generetePositiveResponse(response http.ResponseWriter, actionNameResponseString string) {
 	response.WriteHeader(http.StatusOK)
-	fmt.Fprint(response, "<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\" s:encodingStyle=\"http://schemas.xmlsoap.org/soap/encoding/\">\n")
-	fmt.Fprint(response, "<s:Body>\n")
-
-	fmt.Fprint(response, actionNameResponseString)
+	fmt.Fprint(response, soapEnvelope(actionNameResponseString))
+}
 
-	fmt.Fprint(response, "</s:Body>\n")
-	fmt.Fprint(response, "</s:Envelope>\n")
+// Wraps body in a SOAP envelope
+func soapEnvelope(body string) string {
+	return "<s:Envelope xmlns:s=\"http://schemas.xmlsoap.org/soap/envelope/\" s:encodingStyle=\"http://schemas.xmlsoap.org/soap/encoding/\">\n" +
+		"<s:Body>\n" +
+		body +
+		"</s:Body>\n" +
+		"</s:Envelope>\n"
 }
 
 // Generates a negative response
+// Returns the errorCode of the UPnPError for the error code of an action handler: the codes defined for the
+// actions are kept (see 3.2.2), the others become 501 Action Failed
+func actionErrorCode(code int) int {
+	if code >= 401 && code <= 404 || code == errorCodeActionFailed || code >= 600 && code <= 899 {
+		return code
+	}
+	return errorCodeActionFailed
+}
+
 func generateErrorResponse(errorCode int, errorMessage string, response http.ResponseWriter) {
 	response.Header().Set("CONTENT-TYPE", "text/xml; charset=\"utf-8\"")
 	response.Header().Set("DATE", time.Now().Format(time.RFC1123))
@@ -223,12 +382,164 @@ func generateErrorResponse(errorCode int, errorMessage string, response http.Res
 	fmt.Fprint(response, "<faultcode>s:Client</faultcode>\n")
 	fmt.Fprint(response, "<faultstring>UPnPError</faultstring>\n")
 	fmt.Fprint(response, "<detail>\n")
-	fmt.Fprint(response, "<UPnPError xmlns=\"urn:schemas-upnp-org:control-1-0\">\n")
+	fmt.Fprint(response, "<UPnPError xmlns=\""+controlNamespace+"\">\n")
 	fmt.Fprint(response, "<errorCode>"+strconv.Itoa(errorCode)+"</errorCode>\n")
-	fmt.Fprint(response, "<errorDescription>"+errorMessage+"</errorDescription>\n")
+	fmt.Fprint(response, "<errorDescription>")
+	xml.EscapeText(response, []byte(errorMessage))
+	fmt.Fprint(response, "</errorDescription>\n")
 	fmt.Fprint(response, "</UPnPError>\n")
 	fmt.Fprint(response, "</detail>\n")
 	fmt.Fprint(response, "</s:Fault>\n")
 	fmt.Fprint(response, "</s:Body>\n")
 	fmt.Fprint(response, "</s:Envelope>\n")
 }
+
+// For upnp control point
+
+/*
+	POST path control URL HTTP/1.0
+	HOST: hostname:portNumber
+	CONTENT-LENGTH: bytes in body
+	CONTENT-TYPE: text/xml; charset="utf-8"
+	USER-AGENT: OS/version UPnP/2.0 product/version
+	SOAPACTION: "urn:schemas-upnp-org:service:serviceType:v#actionName"
+
+	<?xml version="1.0"?>
+	<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">
+		<s:Body>
+			<u:actionName xmlns:u="urn:schemas-upnp-org:service:serviceType:v">
+				<argumentName>in arg value</argumentName>
+				<!-- other in args and their values go here, if any -->
+			</u:actionName>
+		</s:Body>
+	</s:Envelope>
+*/
+
+// Invokes actionName on service with the in-arguments, returns the out-arguments in the order sent by the device.
+// The ControlURL of service is resolved against its BaseURL when relative (see 3.2.1).
+// A SOAP fault sent by the device is returned as UPnPError.
+func InvokeAction(ctx context.Context, service Service, actionName string, arguments []device.Argument) ([]device.Argument, error) {
+	return invokeAction(ctx, service, service.ServiceType, actionName, arguments)
+}
+
+// Queries the current value of the state variable varName of service.
+// QueryStateVariable is deprecated since UPnP 1.1, devices may not implement it.
+func QueryStateVariable(ctx context.Context, service Service, varName string) (string, error) {
+	result, err := invokeAction(ctx, service, controlNamespace, "QueryStateVariable", []device.Argument{{Name: "varName", Value: varName}})
+	if err != nil {
+		return "", err
+	}
+
+	returnArgument, findReturn := utils.FindFirst(result, func(argument device.Argument) bool {
+		return argument.Name == "return"
+	})
+	if !findReturn {
+		return "", errors.New("return not present")
+	}
+
+	return returnArgument.Value, nil
+}
+
+// Invokes actionName, defined in namespace, on service
+func invokeAction(ctx context.Context, service Service, namespace string, actionName string, arguments []device.Argument) ([]device.Argument, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	controlUrl, err := resolveServiceURL(service, service.ControlURL)
+	if err != nil {
+		log.Error("[soap] Error while resolving control URL of " + service.ServiceId + ": " + err.Error())
+		return []device.Argument{}, err
+	}
+
+	actualArguments := []ActualArgumentName{}
+	for _, argument := range arguments {
+		actualArguments = append(actualArguments, ActualArgumentName{
+			XMLName: xml.Name{Local: argument.Name},
+			Value:   argument.Value,
+		})
+	}
+
+	body, err := xml.Marshal(ActualActionName{
+		XMLName:       xml.Name{Local: "u:" + actionName},
+		Xmlns:         namespace,
+		ArgumentNames: actualArguments,
+	})
+	if err != nil {
+		log.Error("[soap] Error while marshaling the request: " + err.Error())
+		return []device.Argument{}, err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, controlUrl.String(), strings.NewReader("<?xml version=\"1.0\"?>\n"+soapEnvelope(string(body)+"\n")))
+	if err != nil {
+		log.Error("[soap] Error while creating the request: " + err.Error())
+		return []device.Argument{}, err
+	}
+	request.Header.Set("CONTENT-TYPE", "text/xml; charset=\"utf-8\"")
+	request.Header.Set("USER-AGENT", ClientUserAgent)
+	request.Header.Set("SOAPACTION", "\""+namespace+"#"+actionName+"\"")
+
+	log.Debug("[soap] Invoking " + actionName + " at " + controlUrl.String())
+
+	response, err := newHttpClient(ctx, soapTimeoutSeconds*time.Second).Do(request)
+	if err != nil {
+		log.Error("[soap] Error while sending the request: " + err.Error())
+		return []device.Argument{}, err
+	}
+	defer response.Body.Close()
+
+	data, err := io.ReadAll(response.Body)
+	if err != nil {
+		log.Error("[soap] Error reading response body: " + err.Error())
+		return []device.Argument{}, err
+	}
+
+	return parseSoapResponse(response.StatusCode, data)
+}
+
+// Parses the response of an action: the out-arguments on 200 OK, an UPnPError on fault (see 3.2.2)
+func parseSoapResponse(statusCode int, data []byte) ([]device.Argument, error) {
+	envelope := soapResponseEnvelope{}
+	err := xml.Unmarshal(data, &envelope)
+
+	if statusCode != http.StatusOK {
+		if err != nil || envelope.Body.Fault == nil {
+			return []device.Argument{}, errors.New("Action failed with status " + strconv.Itoa(statusCode))
+		}
+
+		return []device.Argument{}, UPnPError{
+			ErrorCode:        envelope.Body.Fault.Detail.UPnPError.ErrorCode,
+			ErrorDescription: envelope.Body.Fault.Detail.UPnPError.ErrorDescription,
+		}
+	}
+
+	if err != nil {
+		return []device.Argument{}, err
+	}
+
+	result := []device.Argument{}
+	for _, argument := range envelope.Body.ActionResponse.ArgumentNames {
+		result = append(result, device.Argument{
+			Name:  argument.XMLName.Local,
+			Value: argument.Value,
+		})
+	}
+
+	return result, nil
+}
+
+// Resolves rawURL, one of the URLs of service, against the BaseURL of service
+func resolveServiceURL(service Service, rawURL string) (*url.URL, error) {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if parsedURL.IsAbs() {
+		return parsedURL, nil
+	}
+
+	baseUrl, err := url.Parse(service.BaseURL)
+	if err != nil || !baseUrl.IsAbs() {
+		return nil, errors.New("Service without absolute URL")
+	}
+
+	return baseUrl.ResolveReference(parsedURL), nil
+}
@@ -0,0 +1,48 @@
+package upnp
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
+)
+
+func TestSoapActionErrorCode(t *testing.T) {
+	tests := []struct {
+		handlerCode int
+		errorCode   int
+	}{
+		{402, 402},
+		{501, 501},
+		{600, 600},
+		{701, 701},
+		{899, 899},
+		{101, 501}, // Not an action error code
+		{500, 501},
+		{900, 501},
+		{-1, 501},
+	}
+
+	for _, test := range tests {
+		handler, _ := newTestHandler(t, HttpConfig{}, func(rootDevice *RootDevice) {
+			rootDevice.Device.ServiceList[0].HandleAction("Turn", func(arguments ...device.Argument) device.Response {
+				return device.Response{ErrorCode: test.handlerCode, ErrorMessage: "Failed"}
+			})
+		})
+
+		body := soapEnvelope(`<u:Turn xmlns:u="` + testServiceType + `"><StateValue>1</StateValue></u:Turn>`)
+		request := httptest.NewRequest(http.MethodPost, "/SwitchPower/control", strings.NewReader(body))
+		request.Header.Set("CONTENT-TYPE", "text/xml; charset=\"utf-8\"")
+		request.Header.Set("SOAPACTION", "\""+testServiceType+"#Turn\"")
+		response := httptest.NewRecorder()
+		handler.ServeHTTP(response, request)
+
+		expected := "<errorCode>" + strconv.Itoa(test.errorCode) + "</errorCode>"
+		if response.Code != http.StatusInternalServerError || !strings.Contains(response.Body.String(), expected) {
+			t.Errorf("Handler error %d answered %d %s, expected %s", test.handlerCode, response.Code, response.Body.String(), expected)
+		}
+	}
+}
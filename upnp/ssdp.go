@@ -7,20 +7,26 @@ import (
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
 	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/utils"
-	"golang.org/x/net/ipv4"
 )
 
 const (
 	ssdpMulticastAddress               = "239.255.255.250"
+	ssdpMulticastAddressIPv6LinkLocal  = "FF02::C" // See Annex A
+	ssdpMulticastAddressIPv6SiteLocal  = "FF05::C"
 	ssdpMulticastPort                  = 1900
 	ssdpNotifyValiditySeconds          = 1800 // Seconds of validity for the NOTIFY message (see 1.2.2)
 	ssdpWaitMillisBeforeSend           = 100  // Milliseconds between sends in NOTIFY
 	ssdpMSearchMX                      = 2
 	ssdpMSearchResponseValiditySeconds = 600
+	ssdpUnicastMSearchTimeoutSeconds   = 1     // Seconds to wait for the responses of a unicast M-SEARCH
+	ssdpSearchPortMin                  = 49152 // Range of SEARCHPORT.UPNP.ORG (see 1.2.2)
+	ssdpSearchPortMax                  = 65535
+	ssdpSearchPortAttempts             = 16 // Random ports tried before falling back to 1900
 )
 
 type MSearchResult struct {
@@ -30,62 +36,154 @@ type MSearchResult struct {
 	Server       string
 	St           string
 	USN          string
+	BootId       int // Value of BOOTID.UPNP.ORG, -1 if not present (upnp < 1.1)
+	ConfigId     int // Value of CONFIGID.UPNP.ORG, -1 if not present (upnp < 1.1)
+	SearchPort   int // Value of SEARCHPORT.UPNP.ORG, default 1900 if not present
 }
 
 // --------------------------------------------------------------------------------------
 // For upnp control point
 // --------------------------------------------------------------------------------------
 
+// IP version used by SSDP
+type SsdpNetwork string
+
+const (
+	SsdpIPv4      SsdpNetwork = "ipv4"
+	SsdpIPv6      SsdpNetwork = "ipv6"
+	SsdpDualStack SsdpNetwork = "dual"
+)
+
+// Returns the UDP networks of the SsdpNetwork, IPv4 if not set
+func (network SsdpNetwork) networks() []string {
+	switch network {
+	case SsdpIPv6:
+		return []string{"udp6"}
+	case SsdpDualStack:
+		return []string{"udp4", "udp6"}
+	default:
+		return []string{"udp4"}
+	}
+}
+
+// Network configuration of SSDP
+type SsdpConfig struct {
+	Interfaces []string    // Names of the network interfaces to use, if empty the one with the first non-loopback address
+	Network    SsdpNetwork // IP version to use, IPv4 if empty
+}
+
 func Search(ctx context.Context, st string) ([]MSearchResult, error) {
 	return SearchMx(ctx, st, ssdpMSearchMX)
 }
 
 func SearchMx(ctx context.Context, st string, mx int) ([]MSearchResult, error) {
+	return SearchMxWithConfig(ctx, st, mx, SsdpConfig{})
+}
+
+// Sends the multicast M-SEARCH on each interface of config and collects the responses for mx seconds.
+// On IPv6 the M-SEARCH is sent to each multicast scope of the interface (see Annex A).
+func SearchMxWithConfig(ctx context.Context, st string, mx int, config SsdpConfig) ([]MSearchResult, error) {
 	log := ctx.Value("logger").(logging.Logger)
+	transport := getTransport(ctx)
 
-	addr, err := net.ResolveUDPAddr("udp4", ssdpMulticastAddress+":"+strconv.Itoa(ssdpMulticastPort))
+	interfaces, err := resolveSsdpInterfaces(transport, config)
 	if err != nil {
-		log.Error("[ssdp] Error while resolving address: " + err.Error())
-		return []MSearchResult{}, errors.New("Resolve error")
+		log.Error("[ssdp] Error while resolving interfaces: " + err.Error())
+		return []MSearchResult{}, err
 	}
 
-	conn, err := net.ListenUDP("udp4", nil)
-	if err != nil {
-		log.Error("[ssdp] Error while listen multicast UDP")
-		return []MSearchResult{}, errors.New("Error listen multicast UDP")
+	conns := map[string]UDPConn{}
+	for _, network := range config.Network.networks() {
+		conn, err := transport.ListenUDP(network, nil)
+		if err != nil {
+			log.Error("[ssdp] Error while listen multicast UDP")
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return []MSearchResult{}, errors.New("Error listen multicast UDP")
+		}
+		defer conn.Close()
+		conns[network] = conn
 	}
-	defer conn.Close()
 
-	message := generateSSDPMSearchMulticast(st, mx)
+	for _, ssdpInterface := range interfaces {
+		conn := conns[ssdpInterface.network]
+		err = conn.SetMulticastInterface(ssdpInterface.iface)
+		if err != nil {
+			log.Error("[ssdp] Error setting multicast interface " + ssdpInterface.String() + ": " + err.Error())
+			continue
+		}
+
+		for _, group := range ssdpInterface.multicastGroups() {
+			message := generateSSDPMSearch(st, mx, *group)
 
-	packConn := ipv4.NewPacketConn(conn)
-	err = packConn.SetMulticastTTL(2)
+			log.Debug("[ssdp] Sending M-SEARCH on " + ssdpInterface.String() + " to " + group.String())
+			conn.WriteTo([]byte(message.message), &message.receiver)
+		}
+	}
+
+	var responsesMutex sync.Mutex
+	responses := []UDPPacket{}
+	var waitGroup sync.WaitGroup
+	for _, conn := range conns {
+		waitGroup.Go(func() {
+			connResponses, err := listenMSearchResponse(ctx, conn, mx)
+			if err != nil {
+				return
+			}
+
+			responsesMutex.Lock()
+			responses = append(responses, connResponses...)
+			responsesMutex.Unlock()
+		})
+	}
+	waitGroup.Wait()
+
+	return parseMSearchResponses(responses), nil
+}
+
+// Sends a unicast M-SEARCH (without MX) directly to host, the device responds immediately (see 1.3.2).
+// host is "ip" or "ip:port" (IPv6 addresses in brackets), when the port is omitted 1900 is used: devices
+// advertising a different SEARCHPORT.UPNP.ORG should be searched at that port.
+func SearchUnicast(ctx context.Context, host string, st string) ([]MSearchResult, error) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		host = net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(ssdpMulticastPort))
+	}
+	receiver, err := net.ResolveUDPAddr("udp", host)
 	if err != nil {
-		log.Error("Error setting Multicast TTL: " + err.Error())
+		log.Error("[ssdp] Invalid address for unicast M-SEARCH: " + host)
+		return []MSearchResult{}, errors.New("Invalid address")
 	}
 
-	packConn.WriteTo([]byte(message.message), nil, addr)
+	conn, err := getTransport(ctx).ListenUDP(udpNetworkOf(receiver.IP), nil)
+	if err != nil {
+		log.Error("[ssdp] Error while listen UDP")
+		return []MSearchResult{}, errors.New("Error listen UDP")
+	}
+	defer conn.Close()
+
+	message := generateSSDPMSearchUnicast(st, *receiver)
 
-	responses, err := listenMSearchResponse(ctx, conn, mx)
+	_, err = conn.WriteTo([]byte(message.message), &message.receiver)
 	if err != nil {
+		log.Error("[ssdp] Error while sending unicast M-SEARCH: " + err.Error())
 		return []MSearchResult{}, err
 	}
 
-	result := []MSearchResult{}
-	for _, response := range responses {
-		mResponse, err := parseMSearchResponse(response)
-		if err == nil {
-			result = append(result, mResponse)
-		}
+	responses, err := listenMSearchResponse(ctx, conn, ssdpUnicastMSearchTimeoutSeconds)
+	if err != nil {
+		return []MSearchResult{}, err
 	}
 
-	return result, nil
+	return parseMSearchResponses(responses), nil
 }
 
-func listenMSearchResponse(ctx context.Context, conn *net.UDPConn, mx int) ([]string, error) {
+func listenMSearchResponse(ctx context.Context, conn UDPConn, mx int) ([]UDPPacket, error) {
 	log := ctx.Value("logger").(logging.Logger)
 
-	responses := []string{}
+	responses := []UDPPacket{}
 	messageBuffer := make([]byte, 1024)
 	deadLine := time.Now().Add(time.Duration(mx) * time.Second)
 	for {
@@ -95,7 +193,7 @@ func listenMSearchResponse(ctx context.Context, conn *net.UDPConn, mx int) ([]st
 			return responses, nil
 		default:
 			conn.SetReadDeadline(deadLine)
-			n, source, err := conn.ReadFromUDP(messageBuffer)
+			n, source, _, err := conn.ReadFrom(messageBuffer)
 			if err != nil {
 				errorMessageSplit := strings.Split(err.Error(), ":")
 				errorMessage := strings.TrimSpace(errorMessageSplit[len(errorMessageSplit)-1])
@@ -108,34 +206,57 @@ func listenMSearchResponse(ctx context.Context, conn *net.UDPConn, mx int) ([]st
 				return responses, nil
 
 			} else {
-				responses = append(responses, string(messageBuffer[:n]))
+				responses = append(responses, UDPPacket{
+					source:  *source,
+					message: string(messageBuffer[:n]),
+				})
 				log.Debug("[ssdp] Received message from " + source.String())
 			}
 		}
 	}
 }
 
-// Generates an UDPPacket for multicast M-Search as described in 1.3.2
-func generateSSDPMSearchMulticast(st string, mx int) UDPPacket {
-	return generateSSDPMSearch(st, mx, ssdpMulticastAddress, ssdpMulticastPort)
-}
-
 // Produces an UDPPacket for M-SEARCH as described in 1.3.2
-func generateSSDPMSearch(st string, mx int, receiverAddr string, receiverPort int) UDPPacket {
+func generateSSDPMSearch(st string, mx int, receiver net.UDPAddr) UDPPacket {
 	searchMessage := "M-SEARCH * HTTP/1.1\r\n" +
-		"HOST: " + receiverAddr + ":" + strconv.Itoa(receiverPort) + "\r\n" +
+		"HOST: " + ssdpHost(receiver) + "\r\n" +
 		"MAN: \"ssdp:discover\"\r\n" +
 		"MX: " + strconv.Itoa(mx) + "\r\n" +
 		"ST: " + st + "\r\n" +
 		"USER-AGENT: " + ServerUserAgent + "\r\n" +
 		"\r\n"
 	return UDPPacket{
-		receiver: net.UDPAddr{
-			IP:   net.ParseIP(ssdpMulticastAddress),
-			Port: ssdpMulticastPort,
-		},
-		message: searchMessage,
+		receiver: receiver,
+		message:  searchMessage,
+	}
+}
+
+// Produces an UDPPacket for unicast M-SEARCH as described in 1.3.2, MX is not used
+func generateSSDPMSearchUnicast(st string, receiver net.UDPAddr) UDPPacket {
+	searchMessage := "M-SEARCH * HTTP/1.1\r\n" +
+		"HOST: " + ssdpHost(receiver) + "\r\n" +
+		"MAN: \"ssdp:discover\"\r\n" +
+		"ST: " + st + "\r\n" +
+		"USER-AGENT: " + ServerUserAgent + "\r\n" +
+		"\r\n"
+	return UDPPacket{
+		receiver: receiver,
+		message:  searchMessage,
+	}
+}
+
+// Parses the valid responses, LOCATION is made reachable from the interface the response arrived from
+func parseMSearchResponses(responses []UDPPacket) []MSearchResult {
+	result := []MSearchResult{}
+	for _, response := range responses {
+		mResponse, err := parseMSearchResponse(response.message)
+		if err == nil {
+			mResponse.Location = locationFrom(mResponse.Location, response.source)
+			result = append(result, mResponse)
+		}
 	}
+
+	return result
 }
 
 func parseMSearchResponse(response string) (MSearchResult, error) {
@@ -143,9 +264,9 @@ func parseMSearchResponse(response string) (MSearchResult, error) {
 	if !find {
 		return MSearchResult{}, errors.New("CACHE-CONTROL not present")
 	}
-	cacheControlMaxAge, err := strconv.Atoi(strings.TrimSpace(strings.Split(cacheControl, "=")[1]))
+	cacheControlMaxAge, err := parseCacheControlMaxAge(cacheControl)
 	if err != nil {
-		return MSearchResult{}, errors.New("CACHE-CONTROL max-age not well formatted")
+		return MSearchResult{}, err
 	}
 
 	// Date in not "Required" but "Recommended" (see 1.3.3)
@@ -178,6 +299,8 @@ func parseMSearchResponse(response string) (MSearchResult, error) {
 		return MSearchResult{}, errors.New("USN not present")
 	}
 
+	bootInfo := parseSSDPBootInfo(response)
+
 	return MSearchResult{
 		CacheControl: cacheControlMaxAge,
 		Date:         date,
@@ -185,144 +308,385 @@ func parseMSearchResponse(response string) (MSearchResult, error) {
 		Server:       server,
 		St:           st,
 		USN:          usn,
+		BootId:       bootInfo.bootId,
+		ConfigId:     bootInfo.configId,
+		SearchPort:   bootInfo.searchPort,
 	}, nil
 }
 
+// Reads the max-age directive of a CACHE-CONTROL header (see 1.2.2)
+func parseCacheControlMaxAge(cacheControl string) (int, error) {
+	for _, directive := range strings.Split(cacheControl, ",") {
+		name, value, found := strings.Cut(directive, "=")
+		if found && strings.EqualFold(strings.TrimSpace(name), "max-age") {
+			maxAge, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || maxAge < 0 {
+				return 0, errors.New("CACHE-CONTROL max-age not well formatted")
+			}
+			return maxAge, nil
+		}
+	}
+
+	return 0, errors.New("CACHE-CONTROL max-age not present")
+}
+
+// Reads the BOOTID.UPNP.ORG, NEXTBOOTID.UPNP.ORG, CONFIGID.UPNP.ORG and SEARCHPORT.UPNP.ORG headers.
+// Missing or malformed ids are reported as -1, a missing SEARCHPORT.UPNP.ORG as the default port 1900 (see 1.2.2)
+func parseSSDPBootInfo(message string) ssdpBootInfo {
+	parseHeader := func(headerName string, defaultValue int) int {
+		value, find := FindHeader(message, headerName)
+		if !find {
+			return defaultValue
+		}
+
+		result, err := strconv.Atoi(value)
+		if err != nil || result < 0 {
+			return defaultValue
+		}
+
+		return result
+	}
+
+	return ssdpBootInfo{
+		bootId:     parseHeader("BOOTID.UPNP.ORG", -1),
+		nextBootId: parseHeader("NEXTBOOTID.UPNP.ORG", -1),
+		configId:   parseHeader("CONFIGID.UPNP.ORG", -1),
+		searchPort: parseHeader("SEARCHPORT.UPNP.ORG", ssdpMulticastPort),
+	}
+}
+
 // --------------------------------------------------------------------------------------
 // For upnp device
 // --------------------------------------------------------------------------------------
 
-func SsdpDevice(ctx context.Context, rootDevice RootDevice) error {
+// Handle of a running SSDP device
+type SsdpState struct {
+	ctx        context.Context
+	cancel     context.CancelFunc
+	done       chan bool
+	searchPort int
+	interfaces []ssdpInterface
+
+	mutex      sync.RWMutex
+	rootDevice RootDevice
+}
+
+// Values of the BOOTID.UPNP.ORG, NEXTBOOTID.UPNP.ORG, CONFIGID.UPNP.ORG and SEARCHPORT.UPNP.ORG headers (see 1.2.2)
+type ssdpBootInfo struct {
+	bootId     int
+	nextBootId int
+	configId   int
+	searchPort int
+}
+
+func newSsdpBootInfo(rootDevice RootDevice, searchPort int) ssdpBootInfo {
+	return ssdpBootInfo{
+		bootId:     rootDevice.BootId,
+		nextBootId: rootDevice.BootId,
+		configId:   rootDevice.ConfigId,
+		searchPort: searchPort,
+	}
+}
+
+// Starts advertising the rootDevice and answering to M-SEARCH.
+// When ctx is cancelled (or StopSsdpDevice is called) the ssdp:byebye messages are sent (see 1.2.3).
+func SsdpDevice(ctx context.Context, rootDevice RootDevice) (*SsdpState, error) {
+	return SsdpDeviceWithConfig(ctx, rootDevice, SsdpConfig{})
+}
+
+// Same as SsdpDevice, one NOTIFY and M-SEARCH loop runs for each interface of config.
+// The LOCATION advertised on an interface uses the address of that interface.
+func SsdpDeviceWithConfig(ctx context.Context, rootDevice RootDevice, config SsdpConfig) (*SsdpState, error) {
 	log := ctx.Value("logger").(logging.Logger)
+	transport := getTransport(ctx)
 	deviceXML := ""
 	ctx = context.WithValue(ctx, "deviceXML", deviceXML)
 
-	addr, err := net.ResolveUDPAddr("udp4", ssdpMulticastAddress+":"+strconv.Itoa(ssdpMulticastPort))
+	interfaces, err := resolveSsdpInterfaces(transport, config)
 	if err != nil {
-		log.Error("[ssdp] Error while resolving address: " + err.Error())
-		return errors.New("Resolve error")
+		log.Error("[ssdp] Error while resolving interfaces: " + err.Error())
+		return nil, err
 	}
 
-	ssdpNotifyDaemon(ctx, addr, rootDevice)
+	conns := []UDPConn{}
+	for _, ssdpInterface := range interfaces {
+		conn, err := transport.ListenMulticastUDP(ssdpInterface.network, ssdpInterface.iface, ssdpInterface.multicastGroups())
+		if err != nil {
+			log.Error("[ssdp] Error while listen multicast UDP on " + ssdpInterface.String() + ": " + err.Error())
+			for _, conn := range conns {
+				conn.Close()
+			}
+			return nil, errors.New("Error while listen")
+		}
+		conns = append(conns, conn)
+	}
 
-	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
+	// Unicast M-SEARCH sent to port 1900 reach only one of the devices running on the same host,
+	// so each device listens at its own SEARCHPORT.UPNP.ORG (see 1.2.2)
+	searchPort := ssdpMulticastPort
+	searchConns, err := listenSearchPort(transport, config.Network.networks())
 	if err != nil {
-		log.Error("[ssdp] Error while listen multicast UDP")
-		return errors.New("Error while listen")
+		log.Warn("[ssdp] Error while listen unicast UDP, SEARCHPORT.UPNP.ORG will be " + strconv.Itoa(ssdpMulticastPort) + ": " + err.Error())
+	} else {
+		searchPort = searchConns[0].LocalAddr().(*net.UDPAddr).Port
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	state := &SsdpState{
+		ctx:        ctx,
+		cancel:     cancel,
+		done:       make(chan bool),
+		searchPort: searchPort,
+		interfaces: interfaces,
+		rootDevice: rootDevice,
+	}
+
+	ssdpNotifyDaemon(ctx, state)
+	for i, conn := range conns {
+		ssdpListenDaemon(ctx, state, conn, &interfaces[i])
+	}
+	for _, searchConn := range searchConns {
+		ssdpListenDaemon(ctx, state, searchConn, nil)
 	}
 
+	return state, nil
+}
+
+// Listens at a random port in the SEARCHPORT.UPNP.ORG range, the same port is used for each network (see 1.2.2)
+func listenSearchPort(transport Transport, networks []string) ([]UDPConn, error) {
+	var err error
+	for range ssdpSearchPortAttempts {
+		port := ssdpSearchPortMin + rand.IntN(ssdpSearchPortMax-ssdpSearchPortMin+1)
+
+		conns := []UDPConn{}
+		for _, network := range networks {
+			var conn UDPConn
+			conn, err = transport.ListenUDP(network, &net.UDPAddr{Port: port})
+			if err != nil {
+				break
+			}
+			conns = append(conns, conn)
+		}
+
+		if err == nil {
+			return conns, nil
+		}
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}
+
+	return nil, err
+}
+
+// Runs the daemon that answers to the M-SEARCH received from conn until ctx is done.
+// Multicast sockets are bound to ssdpInterface, unicast ones (ssdpInterface == nil) answer
+// with the address the request was sent to.
+func ssdpListenDaemon(ctx context.Context, state *SsdpState, conn UDPConn, ssdpInterface *ssdpInterface) {
 	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	go func() {
+		log := ctx.Value("logger").(logging.Logger)
 
 		defer conn.Close()
 
-		log.Info("[ssdp] Listening for request")
+		log.Info("[ssdp] Listening for request at " + conn.LocalAddr().String())
 		messageBuffer := make([]byte, 1024)
 		for {
-			n, source, err := conn.ReadFromUDP(messageBuffer)
-
-			go func(message string, src net.UDPAddr, err error) {
-				if err != nil {
-					log.Error("[ssdp] Error while receiving a message")
+			n, source, info, err := conn.ReadFrom(messageBuffer)
+			if err != nil {
+				if ctx.Err() != nil {
+					log.Info("[ssdp] Stop listening for request at " + conn.LocalAddr().String())
 					return
 				}
+				log.Error("[ssdp] Error while receiving a message")
+				continue
+			}
 
+			var localIP net.IP
+			if ssdpInterface != nil {
+				if !ssdpInterface.receivedOn(info) {
+					continue
+				}
+				localIP = ssdpInterface.ip
+			} else if info.Dst != nil && !info.Dst.IsUnspecified() {
+				localIP = info.Dst
+			} else {
+				localIP = state.defaultIP(udpNetworkOf(source.IP))
+			}
+
+			go func(message string, src net.UDPAddr) {
 				packet := UDPPacket{
-					source:  *source,
+					source:  src,
 					message: message,
 				}
 				log.Debug("[ssdp] Received message from " + packet.source.String())
 
-				_, isMSearch := FindHeader(packet.message, "M-SEARCH")
-
-				if isMSearch {
-					log.Info("[ssdp] Received M-SEARCH from " + packet.source.String())
-					// MX wait seconds to send the response to prevent DOS (see 1.3.2)
-					wait := make(chan bool, 1)
-					mx, findMx := FindHeader(packet.message, "MX")
-
-					if findMx {
-						mxValue, err := strconv.Atoi(mx)
-						if err == nil {
-							sleepTime := int((rand.Float32() * float32(mxValue)) * 1000)
-							utils.AlertAfter(time.Duration(sleepTime)*time.Millisecond, wait)
-						}
-					} else {
-						wait <- true
-					}
-
-					responses, err := handleSSDPMSEARCHRequest(packet, rootDevice)
-
-					if err != nil && err.Error() == "Request not valid: ST not present" {
-						log.Warn("[ssdp] Received a M-SEARCH without ST header")
-					} else if err != nil && err.Error() == "Request not for this device" {
-						log.Debug("[ssdp] Request not for this device")
-					} else {
-						<-wait // Fun fun fact: my tvs never wait and reply immediately
-						for _, response := range responses {
-							log.Debug("[ssdp] Responding to " + response.receiver.String() + " with " + response.message)
-							conn.WriteToUDP([]byte(response.message), &response.receiver)
-						}
-					}
+				if strings.HasPrefix(packet.message, "M-SEARCH") {
+					handleSSDPMSEARCH(ctx, state, conn, localIP, packet)
 				} else {
 					log.Debug("[ssdp] NOT M-SEARCH Received message from " + packet.source.String())
 				}
 
-			}(string(messageBuffer[:n]), *source, err)
+			}(string(messageBuffer[:n]), *source)
 		}
 	}()
-
-	return nil
 }
 
-// Handles a single SSDP request
-// Returns error if it is not a M-SEARCH request
-func handleSSDPMSEARCHRequest(message UDPPacket, rootDevice RootDevice) ([]UDPPacket, error) {
-	st, findSt := FindHeader(message.message, "ST")
-	if !findSt {
-		return []UDPPacket{}, errors.New("Request not valid: ST not present")
+// Validates a M-SEARCH and sends the responses from conn, LOCATION points to localIP.
+// Multicast requests are answered after a random delay up to MX seconds, unicast ones immediately (see 1.3.2)
+func handleSSDPMSEARCH(ctx context.Context, state *SsdpState, conn UDPConn, localIP net.IP, packet UDPPacket) {
+	log := ctx.Value("logger").(logging.Logger)
+
+	log.Info("[ssdp] Received M-SEARCH from " + packet.source.String())
+
+	man, _ := FindHeader(packet.message, "MAN")
+	if man != "\"ssdp:discover\"" {
+		log.Warn("[ssdp] Received a M-SEARCH with invalid MAN header: " + man)
+		return
 	}
 
-	genByDeviceUUID := func() UDPPacket {
-		usn := rootDevice.Device.UDN
-		return generateSSDPResponseByDevice(st, usn, rootDevice.Device, message)
+	host, _ := FindHeader(packet.message, "HOST")
+	isMulticast := isSsdpMulticastHost(host)
+
+	// MX wait seconds to send the response to prevent DOS (see 1.3.2)
+	wait := make(chan bool, 1)
+	if isMulticast {
+		mx, findMx := FindHeader(packet.message, "MX")
+		mxValue, err := strconv.Atoi(mx)
+		if !findMx || err != nil || mxValue < 1 {
+			log.Warn("[ssdp] Received a multicast M-SEARCH without valid MX header")
+			return
+		}
+
+		sleepTime := int((rand.Float32() * float32(mxValue)) * 1000)
+		utils.AlertAfter(time.Duration(sleepTime)*time.Millisecond, wait)
+	} else {
+		wait <- true
 	}
-	genByRootDevice := func() UDPPacket {
-		usn := rootDevice.Device.UDN + "::upnp:rootdevice"
-		return generateSSDPResponseByDevice(st, usn, rootDevice.Device, message)
+
+	rootDevice := rootDeviceAt(state.getRootDevice(), localIP)
+	responses, err := handleSSDPMSEARCHRequest(packet, rootDevice, newSsdpBootInfo(rootDevice, state.searchPort))
+
+	if err != nil && err.Error() == "Request not valid: ST not present" {
+		log.Warn("[ssdp] Received a M-SEARCH without ST header")
+	} else if err != nil && err.Error() == "Request not for this device" {
+		log.Debug("[ssdp] Request not for this device")
+	} else {
+		<-wait // Fun fun fact: my tvs never wait and reply immediately
+		for _, response := range responses {
+			log.Debug("[ssdp] Responding to " + response.receiver.String() + " with " + response.message)
+			conn.WriteTo([]byte(response.message), &response.receiver)
+		}
 	}
-	genByDeviceType := func() UDPPacket {
-		usn := rootDevice.Device.UDN + "::" + rootDevice.Device.DeviceType
-		return generateSSDPResponseByDevice(st, usn, rootDevice.Device, message)
+}
+
+// Stops the SSDP device and waits until all the ssdp:byebye messages have been sent
+func StopSsdpDevice(state *SsdpState) {
+	state.cancel()
+	<-state.done
+}
+
+// Announces that the rootDevice changed (e.g. its address, therefore LOCATION) without leaving the network.
+// The ssdp:update messages carry the current BOOTID.UPNP.ORG and the new one as NEXTBOOTID.UPNP.ORG,
+// afterwards the device is advertised again using the new BOOTID.UPNP.ORG (see 1.2.4).
+// The GenaState of the ctx of the SSDP device, if any, sends the new one with the multicast event messages.
+func UpdateSsdpDevice(state *SsdpState, rootDevice RootDevice) {
+	log := state.ctx.Value("logger").(logging.Logger)
+
+	state.mutex.Lock()
+	oldRootDevice := state.rootDevice
+	if rootDevice.BootId <= oldRootDevice.BootId {
+		rootDevice.BootId = oldRootDevice.BootId + 1
 	}
-	genByServiceType := func(service Service) UDPPacket {
-		usn := rootDevice.Device.UDN + "::" + service.ServiceType
-		return generateSSDPResponseByDevice(st, usn, rootDevice.Device, message)
+	state.rootDevice = rootDevice
+	state.mutex.Unlock()
+
+	bootInfo := newSsdpBootInfo(oldRootDevice, state.searchPort)
+	bootInfo.nextBootId = rootDevice.BootId
+
+	log.Info("[ssdp] Sending update for " + rootDevice.Device.UDN + " next boot id: " + strconv.Itoa(rootDevice.BootId))
+	state.multicast(rootDevice, func(rootDevice RootDevice, group net.UDPAddr) []UDPPacket {
+		return generateSSDPUpdateMessage(rootDevice, bootInfo, group)
+	})
+	// The multicast event messages carry the new BOOTID.UPNP.ORG as well
+	if gena, isGena := state.ctx.Value("gena").(*GenaState); isGena {
+		gena.updateBootId(rootDevice)
 	}
+	state.multicast(rootDevice, func(rootDevice RootDevice, group net.UDPAddr) []UDPPacket {
+		return generateSSDPNotifyMessage(rootDevice, newSsdpBootInfo(rootDevice, state.searchPort), group)
+	})
+}
 
-	result := []UDPPacket{}
+func (state *SsdpState) getRootDevice() RootDevice {
+	state.mutex.RLock()
+	defer state.mutex.RUnlock()
+
+	return state.rootDevice
+}
 
-	if st == "ssdp:all" {
-		result = append(result, genByDeviceUUID(), genByRootDevice(), genByDeviceType())
-		for _, service := range rootDevice.Device.ServiceList {
-			result = append(result, genByServiceType(service))
+// Returns the address of the first interface using network
+func (state *SsdpState) defaultIP(network string) net.IP {
+	for _, ssdpInterface := range state.interfaces {
+		if ssdpInterface.network == network {
+			return ssdpInterface.ip
 		}
-	} else {
-		switch st {
-		case rootDevice.Device.UDN:
-			result = append(result, genByDeviceUUID())
+	}
 
-		case "upnp:rootdevice":
-			result = append(result, genByRootDevice())
+	return state.interfaces[0].ip
+}
 
-		case rootDevice.Device.DeviceType:
-			result = append(result, genByDeviceType())
+// Sends the messages to the SSDP multicast addresses on every interface, in parallel.
+// The messages are generated for each interface and multicast group from the rootDevice as seen from that interface.
+func (state *SsdpState) multicast(rootDevice RootDevice, generator func(RootDevice, net.UDPAddr) []UDPPacket) {
+	log := state.ctx.Value("logger").(logging.Logger)
+	transport := getTransport(state.ctx)
 
-		default:
-			for _, service := range rootDevice.Device.ServiceList {
-				if st == service.ServiceType {
-					result = append(result, genByServiceType(service))
+	var waitGroup sync.WaitGroup
+	for _, ssdpInterface := range state.interfaces {
+		waitGroup.Go(func() {
+			conn, err := transport.ListenUDP(ssdpInterface.network, nil)
+			if err != nil {
+				log.Error("[ssdp] Error while listen UDP")
+				return
+			}
+			defer conn.Close()
+
+			err = conn.SetMulticastInterface(ssdpInterface.iface)
+			if err != nil {
+				log.Error("[ssdp] Error setting multicast interface " + ssdpInterface.String() + ": " + err.Error())
+				return
+			}
+
+			for _, group := range ssdpInterface.multicastGroups() {
+				for _, message := range generator(rootDeviceAt(rootDevice, ssdpInterface.ip), *group) {
+					conn.WriteTo([]byte(message.message), &message.receiver)
+					time.Sleep(ssdpWaitMillisBeforeSend * time.Millisecond)
 				}
 			}
+		})
+	}
+	waitGroup.Wait()
+}
+
+// Handles a single SSDP request, the whole device tree is searched (see 1.3.2).
+// Returns error if it is not a M-SEARCH request
+func handleSSDPMSEARCHRequest(message UDPPacket, rootDevice RootDevice, bootInfo ssdpBootInfo) ([]UDPPacket, error) {
+	st, findSt := FindHeader(message.message, "ST")
+	if !findSt {
+		return []UDPPacket{}, errors.New("Request not valid: ST not present")
+	}
+
+	result := []UDPPacket{}
+	for _, advertisement := range ssdpAdvertisements(rootDevice) {
+		if st == "ssdp:all" {
+			// One response for each NOTIFY, ST is the NT of the advertisement (see 1.3.3)
+			result = append(result, generateSSDPResponseByDevice(advertisement.nt, advertisement.usn, advertisement.location, bootInfo, message))
+		} else if st == advertisement.nt || ssdpTypeMatches(st, advertisement.nt) {
+			result = append(result, generateSSDPResponseByDevice(st, advertisement.usn, advertisement.location, bootInfo, message))
 		}
 	}
 
@@ -332,16 +696,44 @@ func handleSSDPMSEARCHRequest(message UDPPacket, rootDevice RootDevice) ([]UDPPa
 	return result, nil
 }
 
+// Tells if a device or service type answers a search for st: the type must be the same and its version
+// greater or equal than the requested one, since versions are backward compatible (see 1.3.2)
+func ssdpTypeMatches(st string, advertisedType string) bool {
+	if !strings.HasPrefix(st, "urn:") || !strings.HasPrefix(advertisedType, "urn:") {
+		return false
+	}
+
+	stSeparator := strings.LastIndex(st, ":")
+	advertisedSeparator := strings.LastIndex(advertisedType, ":")
+	if st[:stSeparator] != advertisedType[:advertisedSeparator] {
+		return false
+	}
+
+	stVersion, err := strconv.Atoi(st[stSeparator+1:])
+	if err != nil {
+		return false
+	}
+	advertisedVersion, err := strconv.Atoi(advertisedType[advertisedSeparator+1:])
+	if err != nil {
+		return false
+	}
+
+	return advertisedVersion >= stVersion
+}
+
 // Produces an UDPPacket for responding to M-SEARCH as described in 1.3.3
-func generateSSDPResponseByDevice(st string, usn string, device Device, request UDPPacket) UDPPacket {
+func generateSSDPResponseByDevice(st string, usn string, location string, bootInfo ssdpBootInfo, request UDPPacket) UDPPacket {
 	responseMessage := "HTTP/1.1 200 OK\r\n" +
 		"CACHE-CONTROL: max-age = " + strconv.Itoa(ssdpMSearchResponseValiditySeconds) + "\r\n" +
 		"DATE: " + time.Now().Format(time.RFC1123) + "\r\n" +
 		"EXT:\r\n" +
-		"LOCATION: " + device.PresentationURL + "\r\n" +
+		"LOCATION: " + location + "\r\n" +
 		"SERVER: " + ServerUserAgent + "\r\n" +
 		"ST: " + st + "\r\n" +
 		"USN: " + usn + "\r\n" +
+		"BOOTID.UPNP.ORG: " + strconv.Itoa(bootInfo.bootId) + "\r\n" +
+		"CONFIGID.UPNP.ORG: " + strconv.Itoa(bootInfo.configId) + "\r\n" +
+		"SEARCHPORT.UPNP.ORG: " + strconv.Itoa(bootInfo.searchPort) + "\r\n" +
 		"\r\n"
 	return UDPPacket{
 		receiver: request.source,
@@ -349,21 +741,18 @@ func generateSSDPResponseByDevice(st string, usn string, device Device, request
 	}
 }
 
-// Runs the daemon that periodically multicasts the NOTIFY message
-func ssdpNotifyDaemon(ctx context.Context, addr *net.UDPAddr, rootDevice RootDevice) {
+// Runs the daemon that periodically multicasts the NOTIFY message.
+// When ctx is done the ssdp:byebye messages are multicasted and state.done is closed.
+func ssdpNotifyDaemon(ctx context.Context, state *SsdpState) {
 	go func() {
 		log := ctx.Value("logger").(logging.Logger)
 
+		defer close(state.done)
+
 		notify := func() {
-			conn, err := net.DialUDP("udp4", nil, addr)
-			if err != nil {
-				log.Error("[ssdp] Error while dial UDP")
-			} else {
-				for _, message := range generateSSDPNotifyMessage(rootDevice) {
-					conn.Write([]byte(message.message))
-					time.Sleep(ssdpWaitMillisBeforeSend * time.Millisecond)
-				}
-			}
+			state.multicast(state.getRootDevice(), func(rootDevice RootDevice, group net.UDPAddr) []UDPPacket {
+				return generateSSDPNotifyMessage(rootDevice, newSsdpBootInfo(rootDevice, state.searchPort), group)
+			})
 		}
 
 		notify()
@@ -377,79 +766,175 @@ func ssdpNotifyDaemon(ctx context.Context, addr *net.UDPAddr, rootDevice RootDev
 				notify()
 			}
 		}
+
+		rootDevice := state.getRootDevice()
+		log.Info("[ssdp] Sending byebye for " + rootDevice.Device.UDN)
+		state.multicast(rootDevice, func(rootDevice RootDevice, group net.UDPAddr) []UDPPacket {
+			return generateSSDPByeByeMessage(rootDevice, newSsdpBootInfo(rootDevice, state.searchPort), group)
+		})
 	}()
 }
 
 // Generates the list of packets to be send during a NOTIFY
-func generateSSDPNotifyMessage(rootDevice RootDevice) []UDPPacket {
+func generateSSDPNotifyMessage(rootDevice RootDevice, bootInfo ssdpBootInfo, group net.UDPAddr) []UDPPacket {
+	return generateSSDPAdvertisement(rootDevice, bootInfo, group, generateSSDPNotifyMessageByDevice)
+}
+
+// Generates the list of packets to be send when the device leaves the network, one for each NOTIFY (see 1.2.3)
+func generateSSDPByeByeMessage(rootDevice RootDevice, bootInfo ssdpBootInfo, group net.UDPAddr) []UDPPacket {
+	return generateSSDPAdvertisement(rootDevice, bootInfo, group, generateSSDPByeByeMessageByDevice)
+}
+
+// Generates the list of packets to be send when the device changes BOOTID.UPNP.ORG, one for each NOTIFY (see 1.2.4)
+func generateSSDPUpdateMessage(rootDevice RootDevice, bootInfo ssdpBootInfo, group net.UDPAddr) []UDPPacket {
+	return generateSSDPAdvertisement(rootDevice, bootInfo, group, generateSSDPUpdateMessageByDevice)
+}
+
+// Generates the full set of advertisement packets for the rootDevice (see 1.2.2) sent to group, each one is built by generator
+func generateSSDPAdvertisement(rootDevice RootDevice, bootInfo ssdpBootInfo, group net.UDPAddr, generator ssdpAdvertisementGenerator) []UDPPacket {
 	result := []UDPPacket{}
+	for _, advertisement := range ssdpAdvertisements(rootDevice) {
+		result = append(result, generator(advertisement.nt, advertisement.usn, advertisement.location, bootInfo, group))
+	}
+
+	return result
+}
+
+// Builds a single advertisement packet given NT and USN, sent to the multicast group
+type ssdpAdvertisementGenerator func(nt string, usn string, location string, bootInfo ssdpBootInfo, group net.UDPAddr) UDPPacket
+
+// NT, USN and LOCATION of a single NOTIFY of the device.
+// LOCATION is the URL of the root device description also for embedded devices and services (see 1.2.2)
+type ssdpAdvertisement struct {
+	nt       string
+	usn      string
+	location string
+}
+
+// Lists the advertisements of the rootDevice: 3 for the root device, 2 for each embedded device
+// (at any depth) and 1 for each distinct service type of each device (see 1.2.2).
+// The same list is matched against the ST of the M-SEARCH (see 1.3.2)
+func ssdpAdvertisements(rootDevice RootDevice) []ssdpAdvertisement {
+	result := []ssdpAdvertisement{}
 
 	// RootDevice 3 messages
-	result = append(result, generateSSDPNotifyMessageForRootDevice(rootDevice))
-	secondRootMessage, thirdRootMessage := generateSSDPNotifyMessageForDevice(rootDevice.Device)
-	result = append(result, secondRootMessage, thirdRootMessage)
+	result = append(result, ssdpAdvertisementForRootDevice(rootDevice))
+	devices := flattenDevices(rootDevice.Device)
 
 	// EmbeddedDevices 2 messages
-	for _, embeddedDevice := range rootDevice.Device.EmbeddedDevices {
-		firstDeviceMessage, secondDeviceMessage := generateSSDPNotifyMessageForDevice(embeddedDevice)
+	for _, device := range devices {
+		firstDeviceMessage, secondDeviceMessage := ssdpAdvertisementForDevice(rootDevice, device)
 		result = append(result, firstDeviceMessage, secondDeviceMessage)
 	}
 
-	for _, service := range rootDevice.Device.ServiceList {
-		result = append(result, generateSSDPNotifyMessageForService(rootDevice.Device, service))
-	}
-	for _, embeddedDevice := range rootDevice.Device.EmbeddedDevices {
-		for _, embeddedDeviceService := range embeddedDevice.ServiceList {
-			result = append(result, generateSSDPNotifyMessageForService(embeddedDevice, embeddedDeviceService))
+	for _, device := range devices {
+		serviceTypes := map[string]bool{}
+		for _, service := range device.ServiceList {
+			if !serviceTypes[service.ServiceType] {
+				serviceTypes[service.ServiceType] = true
+				result = append(result, ssdpAdvertisementForService(rootDevice, device, service))
+			}
 		}
 	}
 
 	return result
 }
 
-// Produces an UDPPacket as described in 1.2.2 Table 1-1
-func generateSSDPNotifyMessageForRootDevice(rootDevice RootDevice) UDPPacket {
-	nt := "upnp:rootdevice"
-	usn := rootDevice.Device.UDN + "::upnp:rootdevice"
+// Returns the device followed by all its embedded devices, at any depth
+func flattenDevices(device Device) []Device {
+	result := []Device{device}
+	for _, embeddedDevice := range device.EmbeddedDevices {
+		result = append(result, flattenDevices(embeddedDevice)...)
+	}
 
-	return generateSSDPNotifyMessageByDevice(nt, usn, rootDevice.Device)
+	return result
 }
 
-// Produces two distinct UDPPacket as described in 1.2.2 Table 1-1 and Table 1-2
-func generateSSDPNotifyMessageForDevice(device Device) (UDPPacket, UDPPacket) {
-	nt1 := device.UDN
-	usn1 := nt1
+// As described in 1.2.2 Table 1-1
+func ssdpAdvertisementForRootDevice(rootDevice RootDevice) ssdpAdvertisement {
+	return ssdpAdvertisement{
+		nt:       "upnp:rootdevice",
+		usn:      rootDevice.Device.UDN + "::upnp:rootdevice",
+		location: rootDevice.DescriptionURL,
+	}
+}
 
-	nt2 := device.DeviceType
-	usn2 := device.UDN + "::" + device.DeviceType
+// Two distinct advertisements as described in 1.2.2 Table 1-1 and Table 1-2
+func ssdpAdvertisementForDevice(rootDevice RootDevice, device Device) (ssdpAdvertisement, ssdpAdvertisement) {
+	first := ssdpAdvertisement{
+		nt:       device.UDN,
+		usn:      device.UDN,
+		location: rootDevice.DescriptionURL,
+	}
+	second := ssdpAdvertisement{
+		nt:       device.DeviceType,
+		usn:      device.UDN + "::" + device.DeviceType,
+		location: rootDevice.DescriptionURL,
+	}
 
-	return generateSSDPNotifyMessageByDevice(nt1, usn1, device), generateSSDPNotifyMessageByDevice(nt2, usn2, device)
+	return first, second
 }
 
-// Produces two distinct UDPPacket as described in 1.2.2 Table 1-3
-func generateSSDPNotifyMessageForService(device Device, service Service) UDPPacket {
-	nt1 := service.ServiceType
-	usn1 := device.UDN + "::" + service.ServiceType
-
-	return generateSSDPNotifyMessageByDevice(nt1, usn1, device)
+// As described in 1.2.2 Table 1-3
+func ssdpAdvertisementForService(rootDevice RootDevice, device Device, service Service) ssdpAdvertisement {
+	return ssdpAdvertisement{
+		nt:       service.ServiceType,
+		usn:      device.UDN + "::" + service.ServiceType,
+		location: rootDevice.DescriptionURL,
+	}
 }
 
 // Generates the UDPPacket formatted for NOTIFY
-func generateSSDPNotifyMessageByDevice(nt string, usn string, device Device) UDPPacket {
+func generateSSDPNotifyMessageByDevice(nt string, usn string, location string, bootInfo ssdpBootInfo, group net.UDPAddr) UDPPacket {
 	responseMessage := "NOTIFY * HTTP/1.1\r\n" +
-		"HOST: " + ssdpMulticastAddress + ":" + strconv.Itoa(ssdpMulticastPort) + "\r\n" +
+		"HOST: " + ssdpHost(group) + "\r\n" +
 		"CACHE-CONTROL: max-age = " + strconv.Itoa(ssdpNotifyValiditySeconds) + "\r\n" +
-		"LOCATION: " + device.PresentationURL + "\r\n" +
+		"LOCATION: " + location + "\r\n" +
 		"NT: " + nt + "\r\n" +
 		"NTS: ssdp:alive\r\n" +
 		"SERVER: " + ServerUserAgent + "\r\n" +
 		"USN: " + usn + "\r\n" +
+		"BOOTID.UPNP.ORG: " + strconv.Itoa(bootInfo.bootId) + "\r\n" +
+		"CONFIGID.UPNP.ORG: " + strconv.Itoa(bootInfo.configId) + "\r\n" +
+		"SEARCHPORT.UPNP.ORG: " + strconv.Itoa(bootInfo.searchPort) + "\r\n" +
 		"\r\n"
 	return UDPPacket{
-		receiver: net.UDPAddr{
-			IP:   net.ParseIP(ssdpMulticastAddress),
-			Port: ssdpMulticastPort,
-		},
-		message: responseMessage,
+		receiver: group,
+		message:  responseMessage,
+	}
+}
+
+// Generates the UDPPacket formatted for NOTIFY ssdp:byebye (see 1.2.3)
+func generateSSDPByeByeMessageByDevice(nt string, usn string, location string, bootInfo ssdpBootInfo, group net.UDPAddr) UDPPacket {
+	responseMessage := "NOTIFY * HTTP/1.1\r\n" +
+		"HOST: " + ssdpHost(group) + "\r\n" +
+		"NT: " + nt + "\r\n" +
+		"NTS: ssdp:byebye\r\n" +
+		"USN: " + usn + "\r\n" +
+		"BOOTID.UPNP.ORG: " + strconv.Itoa(bootInfo.bootId) + "\r\n" +
+		"CONFIGID.UPNP.ORG: " + strconv.Itoa(bootInfo.configId) + "\r\n" +
+		"\r\n"
+	return UDPPacket{
+		receiver: group,
+		message:  responseMessage,
+	}
+}
+
+// Generates the UDPPacket formatted for NOTIFY ssdp:update (see 1.2.4)
+func generateSSDPUpdateMessageByDevice(nt string, usn string, location string, bootInfo ssdpBootInfo, group net.UDPAddr) UDPPacket {
+	responseMessage := "NOTIFY * HTTP/1.1\r\n" +
+		"HOST: " + ssdpHost(group) + "\r\n" +
+		"LOCATION: " + location + "\r\n" +
+		"NT: " + nt + "\r\n" +
+		"NTS: ssdp:update\r\n" +
+		"USN: " + usn + "\r\n" +
+		"BOOTID.UPNP.ORG: " + strconv.Itoa(bootInfo.bootId) + "\r\n" +
+		"CONFIGID.UPNP.ORG: " + strconv.Itoa(bootInfo.configId) + "\r\n" +
+		"NEXTBOOTID.UPNP.ORG: " + strconv.Itoa(bootInfo.nextBootId) + "\r\n" +
+		"SEARCHPORT.UPNP.ORG: " + strconv.Itoa(bootInfo.searchPort) + "\r\n" +
+		"\r\n"
+	return UDPPacket{
+		receiver: group,
+		message:  responseMessage,
 	}
 }
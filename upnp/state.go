@@ -0,0 +1,136 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/device"
+)
+
+// Current values of the state variables of a service (see 2.5).
+// The values are seeded from the DefaultValue of each variable, the changes of the evented variables
+// are notified to the subscribers of the service (see 4.3).
+type StateStore struct {
+	mutex   sync.Mutex
+	service Service
+	gena    *GenaState
+	values  map[string]string
+	nextSeq uint64 // Ticket of the next change, taken while holding mutex
+
+	notifyMutex sync.Mutex
+	notifyTurn  *sync.Cond // Signaled when notified is incremented
+	notified    uint64     // Ticket of the next change to be notified
+}
+
+// Creates the state store of service, the changes are notified through the GenaState of ctx, if any
+func NewStateStore(ctx context.Context, service Service) *StateStore {
+	gena, _ := ctx.Value("gena").(*GenaState)
+
+	result := &StateStore{
+		service: service,
+		gena:    gena,
+		values:  make(map[string]string),
+	}
+	result.service.State = nil
+	result.notifyTurn = sync.NewCond(&result.notifyMutex)
+
+	for _, stateVariable := range service.SCPD.ServiceStateTable {
+		result.values[stateVariable.Name] = stateVariable.DefaultValue
+	}
+
+	return result
+}
+
+// Returns the current value of the state variable name
+func (store *StateStore) Value(name string) (string, bool) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	value, found := store.values[name]
+	return value, found
+}
+
+// Returns the current value of each state variable in the order of the serviceStateTable
+func (store *StateStore) Values() []device.Argument {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	result := []device.Argument{}
+	for _, stateVariable := range store.service.SCPD.ServiceStateTable {
+		result = append(result, device.Argument{
+			Name:  stateVariable.Name,
+			Value: store.values[stateVariable.Name],
+		})
+	}
+
+	return result
+}
+
+// Sets the state variable name to value
+func (store *StateStore) Set(name string, value string) error {
+	return store.SetValues(device.Argument{Name: name, Value: value})
+}
+
+// Sets the state variables atomically, the values are checked and normalized as the arguments of an action.
+// The evented variables are notified in a single event message (see 4.3.2), also when the value is unchanged:
+// setting a variable asserts the state of the device.
+func (store *StateStore) SetValues(values ...device.Argument) error {
+	stateVariables := []*StateVariable{}
+	coercedValues := []string{}
+	for _, value := range values {
+		stateVariable := store.stateVariable(value.Name)
+		if stateVariable == nil {
+			return errors.New("StateVariable not found: " + value.Name)
+		}
+
+		coercedValue, err := coerceValue(stateVariable, value.Value)
+		if err != nil {
+			return errors.New(value.Name + ": " + err.Error())
+		}
+
+		stateVariables = append(stateVariables, stateVariable)
+		coercedValues = append(coercedValues, coercedValue)
+	}
+
+	store.mutex.Lock()
+	changes := []device.Argument{}
+	for i, stateVariable := range stateVariables {
+		store.values[stateVariable.Name] = coercedValues[i]
+
+		if stateVariable.SendEvents || stateVariable.Multicast {
+			changes = append(changes, device.Argument{
+				Name:  stateVariable.Name,
+				Value: coercedValues[i],
+			})
+		}
+	}
+	seq := store.nextSeq
+	store.nextSeq++
+	store.mutex.Unlock()
+
+	// The notification can wait for the GENA daemon: it is sent without holding mutex,
+	// in the order of the tickets so that the events follow the order of the changes
+	store.notifyMutex.Lock()
+	for store.notified != seq {
+		store.notifyTurn.Wait()
+	}
+	if len(changes) > 0 && store.gena != nil {
+		store.gena.GenaNotifySubscribers(store.service, changes)
+	}
+	store.notified++
+	store.notifyTurn.Broadcast()
+	store.notifyMutex.Unlock()
+
+	return nil
+}
+
+func (store *StateStore) stateVariable(name string) *StateVariable {
+	for _, stateVariable := range store.service.SCPD.ServiceStateTable {
+		if stateVariable.Name == name {
+			return stateVariable
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+package upnp
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/logging"
+)
+
+// Returns the store of a service with the evented ui4 counter, notified to a GenaState not started
+func newTestStateStore(t *testing.T) (*StateStore, *GenaState) {
+	t.Helper()
+
+	ctx, _ := logging.Init(context.Background(), slog.LevelError)
+	gena := NewGenaListener(ctx)
+	t.Cleanup(func() {
+		gena.Shutdown(context.Background())
+	})
+
+	service := Service{
+		ServiceType: testServiceType,
+		ServiceId:   "urn:upnp-org:serviceId:Counter",
+		SCPD: Scpd{
+			ServiceStateTable: []*StateVariable{{SendEvents: true, Name: "counter", DataType: "ui4", DefaultValue: "0"}},
+		},
+	}
+
+	return NewStateStore(context.WithValue(ctx, "gena", gena), service), gena
+}
+
+func TestStateStoreNotifyWithoutLock(t *testing.T) {
+	store, gena := newTestStateStore(t)
+
+	// The daemon is not running: once the queue of the notifications is full SetValues waits
+	blocked := make(chan struct{})
+	go func() {
+		for i := range cap(gena.notificationStateChange) + 1 {
+			store.Set("counter", strconv.Itoa(i+1))
+		}
+		close(blocked)
+	}()
+
+	deadline := time.Now().Add(testEventWait)
+	for len(gena.notificationStateChange) < cap(gena.notificationStateChange) {
+		if time.Now().After(deadline) {
+			t.Fatal("Notifications not queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	read := make(chan string)
+	go func() {
+		value, _ := store.Value("counter")
+		read <- value
+	}()
+	select {
+	case value := <-read:
+		if value != strconv.Itoa(cap(gena.notificationStateChange)+1) {
+			t.Errorf("counter is %s", value)
+		}
+	case <-time.After(testEventWait):
+		t.Fatal("Value blocked by a pending notification")
+	}
+
+	<-gena.notificationStateChange
+	select {
+	case <-blocked:
+	case <-time.After(testEventWait):
+		t.Fatal("SetValues still blocked")
+	}
+}
+
+func TestStateStoreNotifyOrder(t *testing.T) {
+	const writers = 8
+	const writes = 50
+
+	store, gena := newTestStateStore(t)
+
+	var waitGroup sync.WaitGroup
+	for writer := range writers {
+		waitGroup.Go(func() {
+			for i := range writes {
+				store.Set("counter", strconv.Itoa(writer*writes+i))
+			}
+		})
+	}
+
+	notified := []string{}
+	done := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(done)
+	}()
+	for len(notified) < writers*writes {
+		select {
+		case notification := <-gena.notificationStateChange:
+			notified = append(notified, notification.stateVariableValues[0].value)
+		case <-time.After(testEventWait):
+			t.Fatalf("Received %d notifications", len(notified))
+		}
+	}
+	<-done
+
+	// The last notification carries the last change
+	value, _ := store.Value("counter")
+	if notified[len(notified)-1] != value {
+		t.Errorf("Last notification %s, counter is %s", notified[len(notified)-1], value)
+	}
+}
@@ -0,0 +1,173 @@
+package upnp
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Keeps the GENA subscriptions of a device, the unexpired ones are restored when the device starts serving
+type SubscriptionStore interface {
+	Save(record SubscriptionRecord) error // Inserts or replaces the subscription with the SID of record
+	Delete(sid string) error
+	Load() ([]SubscriptionRecord, error)
+}
+
+// Subscription as kept by a SubscriptionStore, the service is identified by its eventing URL
+type SubscriptionRecord struct {
+	SID         string    `json:"sid"`
+	EventSubURL string    `json:"eventSubURL"`
+	Callback    string    `json:"callback"`
+	StateVars   []string  `json:"stateVars,omitempty"`
+	UserAgent   string    `json:"userAgent,omitempty"`
+	Timeout     int       `json:"timeout"`
+	Creation    time.Time `json:"creation"`
+	Expiration  time.Time `json:"expiration"`
+}
+
+func subscriptionRecordOf(subscription subscription) SubscriptionRecord {
+	return SubscriptionRecord{
+		SID:         subscription.sid,
+		EventSubURL: serviceSubscriptionKey(subscription.service),
+		Callback:    subscription.callback.String(),
+		StateVars:   subscription.stateVar,
+		UserAgent:   subscription.subscriber.userAgent,
+		Timeout:     subscription.timeout,
+		Creation:    subscription.creation,
+		Expiration:  subscription.expiration,
+	}
+}
+
+// --------------------------------------------------------------------------------------
+// In memory
+// --------------------------------------------------------------------------------------
+
+// SubscriptionStore losing the subscriptions when the process ends
+type MemorySubscriptionStore struct {
+	mutex   sync.Mutex
+	records map[string]SubscriptionRecord
+}
+
+func NewMemorySubscriptionStore() *MemorySubscriptionStore {
+	return &MemorySubscriptionStore{
+		records: make(map[string]SubscriptionRecord),
+	}
+}
+
+func (store *MemorySubscriptionStore) Save(record SubscriptionRecord) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	store.records[record.SID] = record
+	return nil
+}
+
+func (store *MemorySubscriptionStore) Delete(sid string) error {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	delete(store.records, sid)
+	return nil
+}
+
+func (store *MemorySubscriptionStore) Load() ([]SubscriptionRecord, error) {
+	store.mutex.Lock()
+	defer store.mutex.Unlock()
+
+	return slices.Collect(maps.Values(store.records)), nil
+}
+
+// --------------------------------------------------------------------------------------
+// JSON file
+// --------------------------------------------------------------------------------------
+
+// SubscriptionStore keeping the subscriptions in a JSON file, rewritten at each change
+type FileSubscriptionStore struct {
+	memory MemorySubscriptionStore
+	path   string
+}
+
+// Opens the store at path, the file is created at the first change if it does not exist
+func NewFileSubscriptionStore(path string) (*FileSubscriptionStore, error) {
+	result := &FileSubscriptionStore{
+		memory: MemorySubscriptionStore{records: make(map[string]SubscriptionRecord)},
+		path:   path,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	records := []SubscriptionRecord{}
+	err = json.Unmarshal(data, &records)
+	if err != nil {
+		return nil, errors.New("Subscription store not valid: " + err.Error())
+	}
+	for _, record := range records {
+		result.memory.records[record.SID] = record
+	}
+
+	return result, nil
+}
+
+func (store *FileSubscriptionStore) Save(record SubscriptionRecord) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	store.memory.records[record.SID] = record
+	return store.write()
+}
+
+func (store *FileSubscriptionStore) Delete(sid string) error {
+	store.memory.mutex.Lock()
+	defer store.memory.mutex.Unlock()
+
+	delete(store.memory.records, sid)
+	return store.write()
+}
+
+func (store *FileSubscriptionStore) Load() ([]SubscriptionRecord, error) {
+	return store.memory.Load()
+}
+
+// Writes the records to a temporary file renamed over path: a crash never leaves the file truncated
+func (store *FileSubscriptionStore) write() error {
+	records := slices.SortedFunc(maps.Values(store.memory.records), func(first SubscriptionRecord, second SubscriptionRecord) int {
+		return first.Creation.Compare(second.Creation)
+	})
+
+	data, err := json.MarshalIndent(records, "", "\t")
+	if err != nil {
+		return err
+	}
+
+	temporary, err := os.CreateTemp(filepath.Dir(store.path), filepath.Base(store.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temporary.Name())
+
+	_, err = temporary.Write(data)
+	if err == nil {
+		err = temporary.Sync()
+	}
+	closeErr := temporary.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(temporary.Name(), store.path)
+}
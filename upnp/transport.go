@@ -0,0 +1,126 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/utils"
+)
+
+// Network used by SSDP, GENA and SOAP.
+// The Transport is taken from the "transport" value of the context, when not set the network of the host
+// (NetTransport) is used. A VirtualNetwork provides in-memory transports.
+type Transport interface {
+	// Listens for UDP packets at laddr, if nil at a random port. network is "udp4" or "udp6"
+	ListenUDP(network string, laddr *net.UDPAddr) (UDPConn, error)
+	// Joins all the multicast groups on iface, if nil on the default interface.
+	// The socket is bound to the port of the first group.
+	ListenMulticastUDP(network string, iface *net.Interface, groups []*net.UDPAddr) (UDPConn, error)
+
+	// Listens for TCP connections, address is "host:port" as in net.Listen
+	Listen(network string, address string) (net.Listener, error)
+	// Opens a TCP connection to address as in net.Dialer.DialContext
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+
+	Interfaces() ([]net.Interface, error)
+	InterfaceAddrs(iface net.Interface) ([]net.Addr, error)
+	// Returns the local address used to reach address ("host:port")
+	LocalIPFor(address string) (net.IP, error)
+}
+
+// UDP socket that reports on which interface and to which address each packet arrived
+type UDPConn interface {
+	ReadFrom(buffer []byte) (int, *net.UDPAddr, UDPPacketInfo, error)
+	WriteTo(buffer []byte, receiver *net.UDPAddr) (int, error)
+	JoinGroup(iface *net.Interface, group *net.UDPAddr) error
+	SetMulticastInterface(iface *net.Interface) error
+	SetReadDeadline(deadline time.Time) error
+	LocalAddr() net.Addr
+	Close() error
+}
+
+type UDPPacketInfo struct {
+	IfIndex int    // Index of the interface on which the packet arrived, 0 if unknown
+	Dst     net.IP // Destination address of the packet, nil if unknown
+}
+
+// Returns the Transport of ctx, NetTransport if not set
+func getTransport(ctx context.Context) Transport {
+	transport, isSet := ctx.Value("transport").(Transport)
+	if !isSet {
+		return NetTransport{}
+	}
+
+	return transport
+}
+
+// Returns an http.Client opening its connections with the Transport of ctx
+func newHttpClient(ctx context.Context, timeout time.Duration) *http.Client {
+	transport := getTransport(ctx)
+
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext:       transport.DialContext,
+			DisableKeepAlives: true,
+		},
+	}
+}
+
+// Transport over the network of the host
+type NetTransport struct{}
+
+func (NetTransport) ListenUDP(network string, laddr *net.UDPAddr) (UDPConn, error) {
+	conn, err := net.ListenUDP(network, laddr)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUdpConn(network, conn), nil
+}
+
+func (NetTransport) ListenMulticastUDP(network string, iface *net.Interface, groups []*net.UDPAddr) (UDPConn, error) {
+	if len(groups) == 0 {
+		return nil, errors.New("No multicast group")
+	}
+
+	conn, err := net.ListenMulticastUDP(network, iface, groups[0])
+	if err != nil {
+		return nil, err
+	}
+
+	result := newUdpConn(network, conn)
+	for _, group := range groups[1:] {
+		err = result.JoinGroup(iface, group)
+		if err != nil {
+			result.Close()
+			return nil, err
+		}
+	}
+
+	return result, nil
+}
+
+func (NetTransport) Listen(network string, address string) (net.Listener, error) {
+	return net.Listen(network, address)
+}
+
+func (NetTransport) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, address)
+}
+
+func (NetTransport) Interfaces() ([]net.Interface, error) {
+	return net.Interfaces()
+}
+
+func (NetTransport) InterfaceAddrs(iface net.Interface) ([]net.Addr, error) {
+	return iface.Addrs()
+}
+
+func (NetTransport) LocalIPFor(address string) (net.IP, error) {
+	return net.ParseIP(utils.GetLocalIPFor(address)), nil
+}
@@ -0,0 +1,352 @@
+package upnp
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/DaniDF/MQTT-Discovery-vs-UPnP/utils"
+	"golang.org/x/net/ipv4"
+	"golang.org/x/net/ipv6"
+)
+
+const udpMulticastTTL = 2 // See 1.1.2: TTL (hop limit on IPv6) of the multicast messages should default to 2
+
+// Wraps a socket of the host network, network is "udp4" or "udp6"
+func newUdpConn(network string, conn *net.UDPConn) UDPConn {
+	if network == "udp6" {
+		packetConn := ipv6.NewPacketConn(conn)
+		packetConn.SetControlMessage(ipv6.FlagInterface|ipv6.FlagDst, true)
+		packetConn.SetMulticastHopLimit(udpMulticastTTL)
+
+		return udp6Conn{
+			conn:       conn,
+			packetConn: packetConn,
+		}
+	}
+
+	packetConn := ipv4.NewPacketConn(conn)
+	packetConn.SetControlMessage(ipv4.FlagInterface|ipv4.FlagDst, true)
+	packetConn.SetMulticastTTL(udpMulticastTTL)
+
+	return udp4Conn{
+		conn:       conn,
+		packetConn: packetConn,
+	}
+}
+
+type udp4Conn struct {
+	conn       *net.UDPConn
+	packetConn *ipv4.PacketConn
+}
+
+func (conn udp4Conn) ReadFrom(buffer []byte) (int, *net.UDPAddr, UDPPacketInfo, error) {
+	n, controlMessage, source, err := conn.packetConn.ReadFrom(buffer)
+	if err != nil {
+		return n, nil, UDPPacketInfo{}, err
+	}
+
+	info := UDPPacketInfo{}
+	if controlMessage != nil {
+		info.IfIndex = controlMessage.IfIndex
+		info.Dst = controlMessage.Dst
+	}
+
+	return n, source.(*net.UDPAddr), info, nil
+}
+
+func (conn udp4Conn) WriteTo(buffer []byte, receiver *net.UDPAddr) (int, error) {
+	return conn.conn.WriteToUDP(buffer, receiver)
+}
+
+func (conn udp4Conn) JoinGroup(iface *net.Interface, group *net.UDPAddr) error {
+	return conn.packetConn.JoinGroup(iface, group)
+}
+
+func (conn udp4Conn) SetMulticastInterface(iface *net.Interface) error {
+	if iface == nil {
+		return nil
+	}
+	return conn.packetConn.SetMulticastInterface(iface)
+}
+
+func (conn udp4Conn) SetReadDeadline(deadline time.Time) error {
+	return conn.conn.SetReadDeadline(deadline)
+}
+
+func (conn udp4Conn) LocalAddr() net.Addr {
+	return conn.conn.LocalAddr()
+}
+
+func (conn udp4Conn) Close() error {
+	return conn.conn.Close()
+}
+
+type udp6Conn struct {
+	conn       *net.UDPConn
+	packetConn *ipv6.PacketConn
+}
+
+func (conn udp6Conn) ReadFrom(buffer []byte) (int, *net.UDPAddr, UDPPacketInfo, error) {
+	n, controlMessage, source, err := conn.packetConn.ReadFrom(buffer)
+	if err != nil {
+		return n, nil, UDPPacketInfo{}, err
+	}
+
+	info := UDPPacketInfo{}
+	if controlMessage != nil {
+		info.IfIndex = controlMessage.IfIndex
+		info.Dst = controlMessage.Dst
+	}
+
+	return n, source.(*net.UDPAddr), info, nil
+}
+
+func (conn udp6Conn) WriteTo(buffer []byte, receiver *net.UDPAddr) (int, error) {
+	return conn.conn.WriteToUDP(buffer, receiver)
+}
+
+func (conn udp6Conn) JoinGroup(iface *net.Interface, group *net.UDPAddr) error {
+	return conn.packetConn.JoinGroup(iface, group)
+}
+
+func (conn udp6Conn) SetMulticastInterface(iface *net.Interface) error {
+	if iface == nil {
+		return nil
+	}
+	return conn.packetConn.SetMulticastInterface(iface)
+}
+
+func (conn udp6Conn) SetReadDeadline(deadline time.Time) error {
+	return conn.conn.SetReadDeadline(deadline)
+}
+
+func (conn udp6Conn) LocalAddr() net.Addr {
+	return conn.conn.LocalAddr()
+}
+
+func (conn udp6Conn) Close() error {
+	return conn.conn.Close()
+}
+
+// Network interface used by SSDP with the address advertised in LOCATION
+type ssdpInterface struct {
+	network string         // "udp4" or "udp6"
+	iface   *net.Interface // nil when the default interface is used
+	ip      net.IP
+}
+
+func (ssdpInterface ssdpInterface) String() string {
+	if ssdpInterface.iface == nil {
+		return "default(" + ssdpInterface.ip.String() + ")"
+	}
+	return ssdpInterface.iface.Name + "(" + ssdpInterface.ip.String() + ")"
+}
+
+// Tells if a packet received with info arrived on this interface
+func (ssdpInterface ssdpInterface) receivedOn(info UDPPacketInfo) bool {
+	return ssdpInterface.iface == nil || info.IfIndex == 0 || ssdpInterface.iface.Index == info.IfIndex
+}
+
+// Returns the SSDP multicast addresses used on this interface.
+// On IPv6 the link-local scope is always used, the site-local one only if the interface has
+// an address wider than link-local to advertise (see Annex A)
+func (ssdpInterface ssdpInterface) multicastGroups() []*net.UDPAddr {
+	return ssdpInterface.scopedGroups(ssdpMulticastAddress, ssdpMulticastAddressIPv6LinkLocal, ssdpMulticastAddressIPv6SiteLocal, ssdpMulticastPort)
+}
+
+// Returns the addresses of the multicast event messages used on this interface, scoped as multicastGroups (see 4.3.3)
+func (ssdpInterface ssdpInterface) genaMulticastGroups() []*net.UDPAddr {
+	return ssdpInterface.scopedGroups(genaMulticastNotificationAddress, genaMulticastNotificationAddressIPv6LinkLocal, genaMulticastNotificationAddressIPv6SiteLocal, genaMulticastNotificationPort)
+}
+
+func (ssdpInterface ssdpInterface) scopedGroups(ipv4 string, ipv6LinkLocal string, ipv6SiteLocal string, port int) []*net.UDPAddr {
+	if ssdpInterface.network != "udp6" {
+		return []*net.UDPAddr{{IP: net.ParseIP(ipv4), Port: port}}
+	}
+
+	result := []*net.UDPAddr{{IP: net.ParseIP(ipv6LinkLocal), Port: port}}
+	if !ssdpInterface.ip.IsLinkLocalUnicast() {
+		result = append(result, &net.UDPAddr{IP: net.ParseIP(ipv6SiteLocal), Port: port})
+	}
+
+	return result
+}
+
+// Resolves the interfaces of config for each network, if no name is provided uses the interface with
+// the first non-loopback address
+func resolveSsdpInterfaces(transport Transport, config SsdpConfig) ([]ssdpInterface, error) {
+	switch config.Network {
+	case "", SsdpIPv4, SsdpIPv6, SsdpDualStack:
+	default:
+		return []ssdpInterface{}, errors.New("Network not valid: " + string(config.Network))
+	}
+
+	ifaces, err := transport.Interfaces()
+	if err != nil {
+		return []ssdpInterface{}, err
+	}
+
+	result := []ssdpInterface{}
+	for _, network := range config.Network.networks() {
+		var interfaces []ssdpInterface
+		if len(config.Interfaces) == 0 {
+			interfaces, err = resolveDefaultSsdpInterface(transport, network, ifaces)
+		} else {
+			interfaces, err = resolveSsdpInterfacesByName(transport, network, ifaces, config.Interfaces)
+		}
+		if err != nil {
+			return []ssdpInterface{}, err
+		}
+
+		result = append(result, interfaces...)
+	}
+
+	return result, nil
+}
+
+func resolveDefaultSsdpInterface(transport Transport, network string, ifaces []net.Interface) ([]ssdpInterface, error) {
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if network == "udp6" && iface.Flags&net.FlagMulticast == 0 {
+			continue
+		}
+
+		ip, err := interfaceIP(transport, network, iface)
+		if err == nil {
+			return []ssdpInterface{{network: network, iface: &iface, ip: net.ParseIP(ip)}}, nil
+		}
+	}
+
+	if network == "udp6" {
+		return []ssdpInterface{}, errors.New("No interface with IPv6 address")
+	}
+
+	return []ssdpInterface{{network: network, iface: nil, ip: net.IPv4(127, 0, 0, 1)}}, nil
+}
+
+func resolveSsdpInterfacesByName(transport Transport, network string, ifaces []net.Interface, names []string) ([]ssdpInterface, error) {
+	result := []ssdpInterface{}
+	for _, name := range names {
+		iface, found := utils.FindFirst(ifaces, func(iface net.Interface) bool { return iface.Name == name })
+		if !found {
+			return []ssdpInterface{}, errors.New("Interface not found: " + name)
+		}
+
+		ip, err := interfaceIP(transport, network, iface)
+		if err != nil {
+			return []ssdpInterface{}, errors.New("Interface " + name + ": " + err.Error())
+		}
+
+		result = append(result, ssdpInterface{network: network, iface: &iface, ip: net.ParseIP(ip)})
+	}
+
+	return result, nil
+}
+
+// Returns the address of iface advertised on network
+func interfaceIP(transport Transport, network string, iface net.Interface) (string, error) {
+	addrs, err := transport.InterfaceAddrs(iface)
+	if err != nil {
+		return "", err
+	}
+
+	if network == "udp6" {
+		return utils.FirstIPv6(addrs)
+	}
+	return utils.FirstIPv4(addrs)
+}
+
+// Tells if host (the HOST header) is one of the SSDP multicast addresses
+func isSsdpMulticastHost(host string) bool {
+	hostIP := host
+	if splitHost, port, err := net.SplitHostPort(host); err == nil {
+		if port != strconv.Itoa(ssdpMulticastPort) {
+			return false
+		}
+		hostIP = splitHost
+	}
+
+	ip := net.ParseIP(strings.Trim(hostIP, "[]"))
+	return ip != nil && (ip.Equal(net.ParseIP(ssdpMulticastAddress)) ||
+		ip.Equal(net.ParseIP(ssdpMulticastAddressIPv6LinkLocal)) ||
+		ip.Equal(net.ParseIP(ssdpMulticastAddressIPv6SiteLocal)))
+}
+
+// Formats addr for the HOST header, IPv6 addresses are bracketed (see Annex A)
+func ssdpHost(addr net.UDPAddr) string {
+	return strings.ToUpper(net.JoinHostPort(addr.IP.String(), strconv.Itoa(addr.Port)))
+}
+
+// Returns the network ("udp4" or "udp6") used to reach ip
+func udpNetworkOf(ip net.IP) string {
+	if ip.To4() == nil {
+		return "udp6"
+	}
+	return "udp4"
+}
+
+// A LOCATION with an IPv6 link-local host is only reachable through the interface it was received from:
+// adds the zone of source to it
+func locationFrom(location string, source net.UDPAddr) string {
+	parsedURL, err := url.Parse(location)
+	if err != nil || len(source.Zone) == 0 {
+		return location
+	}
+
+	ip := net.ParseIP(parsedURL.Hostname())
+	if ip == nil || !ip.IsLinkLocalUnicast() || ip.To4() != nil {
+		return location
+	}
+
+	host := ip.String() + "%" + source.Zone
+	if len(parsedURL.Port()) > 0 {
+		parsedURL.Host = net.JoinHostPort(host, parsedURL.Port())
+	} else {
+		parsedURL.Host = "[" + host + "]"
+	}
+
+	return parsedURL.String()
+}
+
+// Returns a copy of rootDevice whose URLs point to ip, as seen from the interface owning ip
+func rootDeviceAt(rootDevice RootDevice, ip net.IP) RootDevice {
+	rootDevice.DescriptionURL = replaceURLHost(rootDevice.DescriptionURL, ip)
+	rootDevice.Device = deviceAt(rootDevice.Device, ip)
+	return rootDevice
+}
+
+func deviceAt(device Device, ip net.IP) Device {
+	device.PresentationURL = replaceURLHost(device.PresentationURL, ip)
+
+	device.EmbeddedDevices = slices.Clone(device.EmbeddedDevices)
+	for i := range device.EmbeddedDevices {
+		device.EmbeddedDevices[i] = deviceAt(device.EmbeddedDevices[i], ip)
+	}
+
+	return device
+}
+
+// Replaces the host of rawURL with ip keeping the port, rawURL is returned unchanged if it is not absolute
+func replaceURLHost(rawURL string, ip net.IP) string {
+	parsedURL, err := url.Parse(rawURL)
+	if err != nil || len(parsedURL.Host) == 0 || ip == nil {
+		return rawURL
+	}
+
+	if len(parsedURL.Port()) > 0 {
+		parsedURL.Host = net.JoinHostPort(ip.String(), parsedURL.Port())
+	} else if ip.To4() == nil {
+		parsedURL.Host = "[" + ip.String() + "]"
+	} else {
+		parsedURL.Host = ip.String()
+	}
+
+	return parsedURL.String()
+}
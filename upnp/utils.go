@@ -6,12 +6,13 @@ import (
 	"strings"
 )
 
+// Finds the value of the header named headerName, names are case-insensitive (see RFC 2616 4.2)
 func FindHeader(header string, headerName string) (result string, flagFind bool) {
 	for _, h := range strings.Split(header, "\n") {
-		if strings.Contains(h, headerName) {
-			h, _ = strings.CutPrefix(h, headerName+":")
+		name, value, found := strings.Cut(h, ":")
+		if found && strings.EqualFold(strings.TrimSpace(name), headerName) {
 			flagFind = true
-			result = strings.Trim(h, " \t\r\n")
+			result = strings.Trim(value, " \t\r\n")
 		}
 	}
 
@@ -0,0 +1,625 @@
+package upnp
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	virtualInterfaceName   = "vnet0"
+	virtualEphemeralPort   = 32768 // First port assigned when binding to port 0
+	virtualUDPQueueLength  = 1024  // Datagrams queued on a socket before dropping them, as a full receive buffer
+	virtualListenerBacklog = 128   // Connections waiting to be accepted
+)
+
+// Quality of the link between two hosts of a VirtualNetwork
+type LinkConfig struct {
+	Latency time.Duration // One-way delay of each datagram and of the TCP connection setup
+	Jitter  time.Duration // Maximum random delay added to Latency
+	Loss    float64       // Probability of dropping a datagram, between 0 and 1. TCP is reliable so it is not affected
+}
+
+// Runs deliver once delay has elapsed
+type VirtualScheduler func(delay time.Duration, deliver func())
+
+// In-memory network of VirtualHosts, each one is a Transport with a single interface and address.
+// Multicast datagrams are delivered to every host (the sender included, as with multicast loopback)
+// with a socket joined to the group. The random latency and loss are drawn from a generator seeded with seed,
+// the delayed transmissions are run by the scheduler of the network (see SetScheduler).
+type VirtualNetwork struct {
+	mutex       sync.Mutex
+	random      *rand.Rand
+	scheduler   VirtualScheduler
+	defaultLink LinkConfig
+	links       map[virtualLink]LinkConfig
+	hosts       map[string]*VirtualHost
+}
+
+type virtualLink struct {
+	first  string
+	second string
+}
+
+func newVirtualLink(first net.IP, second net.IP) virtualLink {
+	if first.String() > second.String() {
+		first, second = second, first
+	}
+	return virtualLink{first: first.String(), second: second.String()}
+}
+
+// Creates a VirtualNetwork, defaultLink is used between hosts without a link set by SetLink
+func NewVirtualNetwork(seed uint64, defaultLink LinkConfig) *VirtualNetwork {
+	return &VirtualNetwork{
+		random:      rand.New(rand.NewPCG(seed, seed)),
+		scheduler:   realTimeScheduler,
+		defaultLink: defaultLink,
+		links:       make(map[virtualLink]LinkConfig),
+		hosts:       make(map[string]*VirtualHost),
+	}
+}
+
+// Replaces the scheduler of the delayed transmissions, by default they wait the delay on the real clock.
+// A scheduler driven by a simulated clock makes the latency independent of the real time (e.g. in tests).
+func (network *VirtualNetwork) SetScheduler(scheduler VirtualScheduler) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	network.scheduler = scheduler
+}
+
+func realTimeScheduler(delay time.Duration, deliver func()) {
+	time.AfterFunc(delay, deliver)
+}
+
+// Runs deliver after delay through the scheduler of the network, at once if there is no delay
+func (network *VirtualNetwork) schedule(delay time.Duration, deliver func()) {
+	if delay == 0 {
+		deliver()
+		return
+	}
+
+	network.mutex.Lock()
+	scheduler := network.scheduler
+	network.mutex.Unlock()
+
+	scheduler(delay, deliver)
+}
+
+// Sets the quality of the link between the hosts with address first and second, in both directions
+func (network *VirtualNetwork) SetLink(first net.IP, second net.IP, link LinkConfig) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	network.links[newVirtualLink(first, second)] = link
+}
+
+// Adds a host with address ip to the network
+func (network *VirtualNetwork) NewHost(ip net.IP) (*VirtualHost, error) {
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	if ip == nil || ip.IsUnspecified() || ip.IsMulticast() {
+		return nil, errors.New("Address not valid")
+	}
+	if _, found := network.hosts[ip.String()]; found {
+		return nil, errors.New("Address already in use: " + ip.String())
+	}
+
+	host := &VirtualHost{
+		network: network,
+		ip:      ip,
+		iface: net.Interface{
+			Index: 1,
+			MTU:   1500,
+			Name:  virtualInterfaceName,
+			Flags: net.FlagUp | net.FlagBroadcast | net.FlagMulticast,
+		},
+		udpConns:  []*virtualUDPConn{},
+		listeners: make(map[int]*virtualListener),
+		nextPort:  virtualEphemeralPort,
+	}
+	network.hosts[ip.String()] = host
+
+	return host, nil
+}
+
+// Returns the delay of a transmission from a host to another and if it is lost
+func (network *VirtualNetwork) transmit(from *VirtualHost, to *VirtualHost, isDatagram bool) (time.Duration, bool) {
+	if from == to {
+		return 0, false
+	}
+
+	network.mutex.Lock()
+	defer network.mutex.Unlock()
+
+	link, found := network.links[newVirtualLink(from.ip, to.ip)]
+	if !found {
+		link = network.defaultLink
+	}
+
+	if isDatagram && link.Loss > 0 && network.random.Float64() < link.Loss {
+		return 0, true
+	}
+
+	delay := link.Latency
+	if link.Jitter > 0 {
+		delay += time.Duration(network.random.Int64N(int64(link.Jitter)))
+	}
+
+	return delay, false
+}
+
+// Delivers a datagram sent by a host to the sockets addressed by receiver
+func (network *VirtualNetwork) deliver(from *VirtualHost, source *net.UDPAddr, receiver *net.UDPAddr, payload []byte) {
+	network.mutex.Lock()
+	hosts := []*VirtualHost{}
+	if receiver.IP.IsMulticast() {
+		for _, host := range network.hosts {
+			hosts = append(hosts, host)
+		}
+	} else if host, found := network.hosts[receiver.IP.String()]; found {
+		hosts = append(hosts, host)
+	}
+	network.mutex.Unlock()
+
+	for _, host := range hosts {
+		conns := host.udpConnsFor(receiver)
+		if len(conns) == 0 {
+			continue
+		}
+
+		delay, isLost := network.transmit(from, host, true)
+		if isLost {
+			continue
+		}
+
+		datagram := virtualDatagram{
+			payload: payload,
+			source:  source,
+			info: UDPPacketInfo{
+				IfIndex: host.iface.Index,
+				Dst:     receiver.IP,
+			},
+		}
+		receive := func() {
+			for _, conn := range conns {
+				conn.receive(datagram)
+			}
+		}
+
+		network.schedule(delay, receive)
+	}
+}
+
+// Host of a VirtualNetwork, it is the Transport used by the devices and control points running on it:
+//
+//	ctx = context.WithValue(ctx, "transport", host)
+type VirtualHost struct {
+	network *VirtualNetwork
+	ip      net.IP
+	iface   net.Interface
+
+	mutex     sync.Mutex
+	udpConns  []*virtualUDPConn // In bind order, unicast datagrams are delivered to the first one
+	listeners map[int]*virtualListener
+	nextPort  int
+}
+
+// Returns the address of the host
+func (host *VirtualHost) IP() net.IP {
+	return host.ip
+}
+
+func (host *VirtualHost) ListenUDP(network string, laddr *net.UDPAddr) (UDPConn, error) {
+	port := 0
+	if laddr != nil {
+		port = laddr.Port
+		if err := host.checkAddress(network, laddr.IP); err != nil {
+			return nil, err
+		}
+	} else if err := host.checkAddress(network, nil); err != nil {
+		return nil, err
+	}
+
+	return host.bindUDP(port, false)
+}
+
+func (host *VirtualHost) ListenMulticastUDP(network string, iface *net.Interface, groups []*net.UDPAddr) (UDPConn, error) {
+	if len(groups) == 0 {
+		return nil, errors.New("No multicast group")
+	}
+	if err := host.checkAddress(network, nil); err != nil {
+		return nil, err
+	}
+
+	conn, err := host.bindUDP(groups[0].Port, true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, group := range groups {
+		conn.JoinGroup(iface, group)
+	}
+
+	return conn, nil
+}
+
+func (host *VirtualHost) Listen(network string, address string) (net.Listener, error) {
+	hostAddress, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, errors.New("Invalid port: " + portString)
+	}
+	if err := host.checkAddress(network, net.ParseIP(hostAddress)); err != nil {
+		return nil, err
+	}
+
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	if port == 0 {
+		port = host.ephemeralPort()
+	} else if _, found := host.listeners[port]; found {
+		return nil, errors.New("Address already in use: " + address)
+	}
+
+	listener := &virtualListener{
+		host:   host,
+		addr:   &net.TCPAddr{IP: host.ip, Port: port},
+		conns:  make(chan net.Conn, virtualListenerBacklog),
+		closed: make(chan struct{}),
+	}
+	host.listeners[port] = listener
+
+	return listener, nil
+}
+
+func (host *VirtualHost) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	hostAddress, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil {
+		return nil, errors.New("Invalid port: " + portString)
+	}
+
+	targetIP := net.ParseIP(hostAddress)
+	if targetIP == nil {
+		return nil, errors.New("Unknown host: " + hostAddress)
+	}
+
+	host.network.mutex.Lock()
+	target, found := host.network.hosts[targetIP.String()]
+	host.network.mutex.Unlock()
+	if !found {
+		return nil, errors.New("No route to host: " + hostAddress)
+	}
+
+	target.mutex.Lock()
+	listener, found := target.listeners[port]
+	target.mutex.Unlock()
+	if !found {
+		return nil, errors.New("Connection refused: " + address)
+	}
+
+	delay, _ := host.network.transmit(host, target, false)
+	connected := make(chan struct{})
+	host.network.schedule(delay, func() {
+		close(connected)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-connected:
+	}
+
+	host.mutex.Lock()
+	localAddr := &net.TCPAddr{IP: host.ip, Port: host.ephemeralPort()}
+	host.mutex.Unlock()
+
+	client, server := net.Pipe()
+	select {
+	case listener.conns <- virtualConn{Conn: server, localAddr: listener.addr, remoteAddr: localAddr}:
+	case <-listener.closed:
+		client.Close()
+		server.Close()
+		return nil, errors.New("Connection refused: " + address)
+	case <-ctx.Done():
+		client.Close()
+		server.Close()
+		return nil, ctx.Err()
+	}
+
+	return virtualConn{Conn: client, localAddr: localAddr, remoteAddr: listener.addr}, nil
+}
+
+func (host *VirtualHost) Interfaces() ([]net.Interface, error) {
+	return []net.Interface{host.iface}, nil
+}
+
+func (host *VirtualHost) InterfaceAddrs(iface net.Interface) ([]net.Addr, error) {
+	if iface.Index != host.iface.Index {
+		return []net.Addr{}, nil
+	}
+
+	mask := net.CIDRMask(64, 128)
+	if host.ip.To4() != nil {
+		mask = net.CIDRMask(24, 32)
+	}
+
+	return []net.Addr{&net.IPNet{IP: host.ip, Mask: mask}}, nil
+}
+
+func (host *VirtualHost) LocalIPFor(address string) (net.IP, error) {
+	return host.ip, nil
+}
+
+// Checks that network is of the same family of the host and that ip, if specified, is the host address
+func (host *VirtualHost) checkAddress(network string, ip net.IP) error {
+	isIPv4 := host.ip.To4() != nil
+	if (network == "udp4" || network == "tcp4") && !isIPv4 || (network == "udp6" || network == "tcp6") && isIPv4 {
+		return errors.New("Network not supported by the host: " + network)
+	}
+
+	if ip != nil && !ip.IsUnspecified() && !ip.Equal(host.ip) {
+		return errors.New("Address not available: " + ip.String())
+	}
+
+	return nil
+}
+
+// Returns a free port, host.mutex must be held
+func (host *VirtualHost) ephemeralPort() int {
+	for {
+		port := host.nextPort
+		host.nextPort++
+		if host.nextPort > 65535 {
+			host.nextPort = virtualEphemeralPort
+		}
+
+		_, isListening := host.listeners[port]
+		isBound := false
+		for _, conn := range host.udpConns {
+			isBound = isBound || conn.port == port
+		}
+
+		if !isListening && !isBound {
+			return port
+		}
+	}
+}
+
+// Binds a UDP socket to port, reusable sockets (multicast) can share the port with each other
+func (host *VirtualHost) bindUDP(port int, isReusable bool) (*virtualUDPConn, error) {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	if port == 0 {
+		port = host.ephemeralPort()
+	} else {
+		for _, conn := range host.udpConns {
+			if conn.port == port && (!isReusable || !conn.isReusable) {
+				return nil, errors.New("Address already in use: " + strconv.Itoa(port))
+			}
+		}
+	}
+
+	conn := &virtualUDPConn{
+		host:       host,
+		port:       port,
+		isReusable: isReusable,
+		groups:     []net.IP{},
+		datagrams:  make(chan virtualDatagram, virtualUDPQueueLength),
+		closed:     make(chan struct{}),
+	}
+	host.udpConns = append(host.udpConns, conn)
+
+	return conn, nil
+}
+
+// Returns the sockets receiving a datagram sent to receiver
+func (host *VirtualHost) udpConnsFor(receiver *net.UDPAddr) []*virtualUDPConn {
+	host.mutex.Lock()
+	defer host.mutex.Unlock()
+
+	result := []*virtualUDPConn{}
+	for _, conn := range host.udpConns {
+		if conn.port != receiver.Port {
+			continue
+		}
+
+		if !receiver.IP.IsMulticast() {
+			return []*virtualUDPConn{conn}
+		}
+		if conn.isMember(receiver.IP) {
+			result = append(result, conn)
+		}
+	}
+
+	return result
+}
+
+type virtualDatagram struct {
+	payload []byte
+	source  *net.UDPAddr
+	info    UDPPacketInfo
+}
+
+// UDP socket of a VirtualHost
+type virtualUDPConn struct {
+	host       *VirtualHost
+	port       int
+	isReusable bool
+	datagrams  chan virtualDatagram
+	closed     chan struct{}
+	closeOnce  sync.Once
+
+	mutex    sync.Mutex
+	groups   []net.IP
+	deadline time.Time
+}
+
+func (conn *virtualUDPConn) ReadFrom(buffer []byte) (int, *net.UDPAddr, UDPPacketInfo, error) {
+	conn.mutex.Lock()
+	deadline := conn.deadline
+	conn.mutex.Unlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return 0, nil, UDPPacketInfo{}, os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	select {
+	case datagram := <-conn.datagrams:
+		n := copy(buffer, datagram.payload)
+		return n, datagram.source, datagram.info, nil
+	case <-conn.closed:
+		return 0, nil, UDPPacketInfo{}, net.ErrClosed
+	case <-timeout:
+		return 0, nil, UDPPacketInfo{}, os.ErrDeadlineExceeded
+	}
+}
+
+func (conn *virtualUDPConn) WriteTo(buffer []byte, receiver *net.UDPAddr) (int, error) {
+	select {
+	case <-conn.closed:
+		return 0, net.ErrClosed
+	default:
+	}
+
+	payload := make([]byte, len(buffer))
+	copy(payload, buffer)
+	source := &net.UDPAddr{IP: conn.host.ip, Port: conn.port}
+
+	conn.host.network.deliver(conn.host, source, receiver, payload)
+
+	return len(buffer), nil
+}
+
+func (conn *virtualUDPConn) JoinGroup(iface *net.Interface, group *net.UDPAddr) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.groups = append(conn.groups, group.IP)
+	return nil
+}
+
+func (conn *virtualUDPConn) SetMulticastInterface(iface *net.Interface) error {
+	return nil
+}
+
+func (conn *virtualUDPConn) SetReadDeadline(deadline time.Time) error {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	conn.deadline = deadline
+	return nil
+}
+
+func (conn *virtualUDPConn) LocalAddr() net.Addr {
+	return &net.UDPAddr{IP: conn.host.ip, Port: conn.port}
+}
+
+func (conn *virtualUDPConn) Close() error {
+	conn.closeOnce.Do(func() {
+		close(conn.closed)
+
+		conn.host.mutex.Lock()
+		defer conn.host.mutex.Unlock()
+		for i, hostConn := range conn.host.udpConns {
+			if hostConn == conn {
+				conn.host.udpConns = append(conn.host.udpConns[:i], conn.host.udpConns[i+1:]...)
+				break
+			}
+		}
+	})
+
+	return nil
+}
+
+func (conn *virtualUDPConn) isMember(group net.IP) bool {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
+
+	for _, joinedGroup := range conn.groups {
+		if joinedGroup.Equal(group) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Datagrams arriving when the queue is full or the socket is closed are dropped
+func (conn *virtualUDPConn) receive(datagram virtualDatagram) {
+	select {
+	case <-conn.closed:
+	case conn.datagrams <- datagram:
+	default:
+	}
+}
+
+// TCP listener of a VirtualHost
+type virtualListener struct {
+	host      *VirtualHost
+	addr      *net.TCPAddr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (listener *virtualListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-listener.conns:
+		return conn, nil
+	case <-listener.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (listener *virtualListener) Close() error {
+	listener.closeOnce.Do(func() {
+		close(listener.closed)
+
+		listener.host.mutex.Lock()
+		defer listener.host.mutex.Unlock()
+		delete(listener.host.listeners, listener.addr.Port)
+	})
+
+	return nil
+}
+
+func (listener *virtualListener) Addr() net.Addr {
+	return listener.addr
+}
+
+// In-memory TCP connection reporting the addresses of the VirtualHosts
+type virtualConn struct {
+	net.Conn
+	localAddr  *net.TCPAddr
+	remoteAddr *net.TCPAddr
+}
+
+func (conn virtualConn) LocalAddr() net.Addr {
+	return conn.localAddr
+}
+
+func (conn virtualConn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
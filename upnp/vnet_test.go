@@ -0,0 +1,232 @@
+package upnp
+
+import (
+	"context"
+	"net"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Simulated clock scheduling the delayed transmissions of a VirtualNetwork, they run only when it is advanced
+type testClock struct {
+	mutex   sync.Mutex
+	now     time.Duration
+	nextId  int
+	pending []testTimer
+}
+
+type testTimer struct {
+	due     time.Duration
+	id      int // Timers due at the same time run in scheduling order
+	deliver func()
+}
+
+func (clock *testClock) schedule(delay time.Duration, deliver func()) {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	clock.pending = append(clock.pending, testTimer{due: clock.now + delay, id: clock.nextId, deliver: deliver})
+	clock.nextId++
+}
+
+// Moves the clock forward by step running the timers due in the meantime
+func (clock *testClock) advance(step time.Duration) {
+	clock.mutex.Lock()
+	target := clock.now + step
+	for {
+		index := -1
+		for i, timer := range clock.pending {
+			if timer.due <= target && (index < 0 || timer.due < clock.pending[index].due || timer.due == clock.pending[index].due && timer.id < clock.pending[index].id) {
+				index = i
+			}
+		}
+		if index < 0 {
+			break
+		}
+
+		timer := clock.pending[index]
+		clock.pending = slices.Delete(clock.pending, index, index+1)
+		clock.now = timer.due
+
+		clock.mutex.Unlock()
+		timer.deliver()
+		clock.mutex.Lock()
+	}
+	clock.now = target
+	clock.mutex.Unlock()
+}
+
+func (clock *testClock) elapsed() time.Duration {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return clock.now
+}
+
+func (clock *testClock) pendingTimers() []testTimer {
+	clock.mutex.Lock()
+	defer clock.mutex.Unlock()
+
+	return slices.Clone(clock.pending)
+}
+
+type testArrival struct {
+	payload string
+	at      time.Duration
+}
+
+// Sends count datagrams over a lossy link with latency and jitter, returns when each one arrived
+func transmitDatagrams(t *testing.T, seed uint64, count int) []testArrival {
+	clock := &testClock{}
+	network := NewVirtualNetwork(seed, LinkConfig{Latency: 10 * time.Millisecond, Jitter: 10 * time.Millisecond, Loss: 0.25})
+	network.SetScheduler(clock.schedule)
+
+	sender, err := network.NewHost(net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver, err := network.NewHost(net.ParseIP("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	senderConn, err := sender.ListenUDP("udp4", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer senderConn.Close()
+	receiverConn, err := receiver.ListenUDP("udp4", &net.UDPAddr{Port: 5000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer receiverConn.Close()
+
+	for i := range count {
+		senderConn.WriteTo([]byte{byte(i)}, &net.UDPAddr{IP: receiver.IP(), Port: 5000})
+	}
+
+	result := []testArrival{}
+	datagrams := receiverConn.(*virtualUDPConn).datagrams
+	for range 30 {
+		clock.advance(time.Millisecond)
+		for len(datagrams) > 0 {
+			datagram := <-datagrams
+			result = append(result, testArrival{payload: string(datagram.payload), at: clock.elapsed()})
+		}
+	}
+
+	return result
+}
+
+func TestVirtualNetworkSeededLink(t *testing.T) {
+	const count = 100
+
+	arrivals := transmitDatagrams(t, 42, count)
+	if !slices.Equal(arrivals, transmitDatagrams(t, 42, count)) {
+		t.Fatal("Transmissions with the same seed differ")
+	}
+	if slices.Equal(arrivals, transmitDatagrams(t, 43, count)) {
+		t.Fatal("Transmissions with different seeds are the same")
+	}
+
+	if len(arrivals) == 0 || len(arrivals) == count {
+		t.Fatalf("Expected some of the %d datagrams lost, received %d", count, len(arrivals))
+	}
+	// Each datagram is due within [Latency, Latency+Jitter), it is read at the end of the step it arrived in
+	for _, arrival := range arrivals {
+		if arrival.at <= 10*time.Millisecond || arrival.at > 20*time.Millisecond {
+			t.Errorf("Datagram %d arrived at %s, outside latency and jitter", arrival.payload[0], arrival.at)
+		}
+	}
+}
+
+func TestVirtualNetworkMulticastLoopback(t *testing.T) {
+	network := NewVirtualNetwork(1, LinkConfig{})
+	group := &net.UDPAddr{IP: net.ParseIP(ssdpMulticastAddress), Port: ssdpMulticastPort}
+
+	conns := []UDPConn{}
+	for _, ip := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		host, err := network.NewHost(net.ParseIP(ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := host.ListenMulticastUDP("udp4", nil, []*net.UDPAddr{group})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conns = append(conns, conn)
+	}
+
+	conns[0].WriteTo([]byte("hello"), group)
+
+	for i, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		buffer := make([]byte, 16)
+		n, source, info, err := conn.ReadFrom(buffer)
+		if err != nil {
+			t.Fatalf("Host %d: %s", i, err)
+		}
+		if string(buffer[:n]) != "hello" || !source.IP.Equal(net.ParseIP("10.0.0.1")) || !info.Dst.Equal(group.IP) {
+			t.Errorf("Host %d received %q from %s to %s", i, buffer[:n], source, info.Dst)
+		}
+	}
+}
+
+func TestVirtualNetworkDialLatency(t *testing.T) {
+	clock := &testClock{}
+	network := NewVirtualNetwork(1, LinkConfig{Latency: 50 * time.Millisecond})
+	network.SetScheduler(clock.schedule)
+
+	server, err := network.NewHost(net.ParseIP("10.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := network.NewHost(net.ParseIP("10.0.0.2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := server.Listen("tcp", ":80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	dialed := make(chan error, 1)
+	go func() {
+		conn, err := client.DialContext(context.Background(), "tcp", "10.0.0.1:80")
+		if err == nil {
+			conn.Close()
+		}
+		dialed <- err
+	}()
+
+	// The connection is set up only when the simulated latency has elapsed
+	for len(clock.pendingTimers()) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	clock.advance(49 * time.Millisecond)
+	select {
+	case <-dialed:
+		t.Fatal("Connected before the latency elapsed")
+	default:
+	}
+
+	clock.advance(time.Millisecond)
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted.Close()
+	if err := <-dialed; err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = client.DialContext(context.Background(), "tcp", "10.0.0.1:81")
+	if err == nil {
+		t.Error("Connected to a port without listener")
+	}
+}
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"net"
 	"strings"
 	"time"
@@ -18,6 +19,50 @@ func GetLocalIP() string {
 	return "127.0.0.1"
 }
 
+// Returns the first IPv4 address of addrs (e.g. of an interface)
+func FirstIPv4(addrs []net.Addr) (string, error) {
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			return ipnet.IP.String(), nil
+		}
+	}
+
+	return "", errors.New("No IPv4 address")
+}
+
+// Returns the first IPv6 address of addrs (e.g. of an interface), global (or unique local) addresses
+// are preferred over link-local ones
+func FirstIPv6(addrs []net.Addr) (string, error) {
+	linkLocal := ""
+	for _, a := range addrs {
+		if ipnet, ok := a.(*net.IPNet); ok && ipnet.IP.To4() == nil && !ipnet.IP.IsLoopback() {
+			if ipnet.IP.IsGlobalUnicast() {
+				return ipnet.IP.String(), nil
+			}
+			if ipnet.IP.IsLinkLocalUnicast() && len(linkLocal) == 0 {
+				linkLocal = ipnet.IP.String()
+			}
+		}
+	}
+
+	if len(linkLocal) > 0 {
+		return linkLocal, nil
+	}
+
+	return "", errors.New("No IPv6 address")
+}
+
+// Returns the local IP used to reach remoteHost ("host:port"), GetLocalIP if the route is unknown
+func GetLocalIPFor(remoteHost string) string {
+	conn, err := net.Dial("udp", remoteHost)
+	if err != nil {
+		return GetLocalIP()
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP.String()
+}
+
 func AlertAfter(timeout time.Duration, channel chan bool) {
 	go func() {
 		time.Sleep(timeout)
@@ -69,7 +114,7 @@ type EqualComparable[T any] interface {
 func DeleteElement[T EqualComparable[T]](slice []T, element T) []T {
 	var result []T
 	for _, el := range slice {
-		if el.Equal(element) {
+		if !el.Equal(element) {
 			result = append(result, el)
 		}
 	}
@@ -0,0 +1,42 @@
+package utils
+
+import (
+	"slices"
+	"testing"
+)
+
+type testElement struct {
+	id    int
+	label string
+}
+
+// Elements are equal by id only
+func (element testElement) Equal(other testElement) bool {
+	return element.id == other.id
+}
+
+func TestDeleteElement(t *testing.T) {
+	slice := []testElement{{1, "a"}, {2, "b"}, {1, "c"}, {3, "d"}}
+	original := slices.Clone(slice)
+
+	result := DeleteElement(slice, testElement{id: 1})
+	if !slices.Equal(result, []testElement{{2, "b"}, {3, "d"}}) {
+		t.Errorf("Deleting 1 returned %v", result)
+	}
+	if !slices.Equal(slice, original) {
+		t.Errorf("Slice modified: %v", slice)
+	}
+
+	result = DeleteElement(slice, testElement{id: 4})
+	if !slices.Equal(result, original) {
+		t.Errorf("Deleting a missing element returned %v", result)
+	}
+
+	result = DeleteElement([]testElement{{1, "a"}}, testElement{id: 1})
+	if len(result) != 0 {
+		t.Errorf("Deleting the only element returned %v", result)
+	}
+	if result = DeleteElement(nil, testElement{id: 1}); len(result) != 0 {
+		t.Errorf("Deleting from nil returned %v", result)
+	}
+}